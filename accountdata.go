@@ -0,0 +1,248 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+/**
+ * Remove the account and everything we store about it. If it was connected, the peer is unlinked
+ * and gets a push so the app picks up the new state; the pushes are sent in the background.
+ */
+func DeleteAccount(store Store, account *Account) error {
+	connections, err := store.ListConnections(account.Id)
+	if err != nil {
+		return err
+	}
+
+	// Reports against the account stay for the moderators, but without the photo.
+	err = store.DeleteAccount(account.Id)
+	if err != nil {
+		return err
+	}
+
+	RunInBackground(store.Context(), "push", func(ctx context.Context) {
+		store := store.WithContext(ctx)
+		for _, connection := range connections {
+			peerId := connection.GetPeerId(account.Id)
+			err := SendNotificationToAccountId(store, peerId)
+			if err != nil {
+				Logger(ctx).Warn("failed to notify peer of deleted account", "peer_id", peerId, "error", err)
+			}
+		}
+	})
+	return nil
+}
+
+/**
+ * The metadata part of a data export, written as account.json.
+ */
+type AccountExport struct {
+	AccountId    int                `json:"accountId"`
+	ConnectCode  string             `json:"connectCode"`
+	DisplayName  string             `json:"displayName"`
+	Avatar       string             `json:"avatar,omitempty"` // File in the archive, if there is one
+	TimeCreated  string             `json:"timeCreated"`
+	Devices      []DeviceResponse   `json:"devices"`
+	Connections  []ConnectionExport `json:"connections"`
+	Payloads     []PayloadExport    `json:"payloads"`
+	Blocked      []int              `json:"blockedAccountIds"`
+	Reports      []ReportExport     `json:"reports"`
+	TimeExported time.Time          `json:"timeExported"`
+}
+
+type ConnectionExport struct {
+	ConnectionId int    `json:"connectionId"`
+	PeerId       int    `json:"peerId"`
+	Initiator    bool   `json:"initiator"`
+	Status       string `json:"status"`
+	TimeCreated  string `json:"timeCreated"`
+}
+
+/**
+ * A payload which is still stored, sent by the account or to it.
+ */
+type PayloadExport struct {
+	ConnectionId int       `json:"connectionId"`
+	Sent         bool      `json:"sent"`
+	Kind         string    `json:"kind"`
+	Caption      string    `json:"caption,omitempty"`
+	Fetched      bool      `json:"fetched"`
+	TimeCreated  time.Time `json:"timeCreated"`
+	// Files in the archive. Video is that of a Live Photo, File being its still.
+	File  string `json:"file,omitempty"`
+	Video string `json:"video,omitempty"`
+}
+
+type ReportExport struct {
+	ReportedId  int       `json:"reportedId"`
+	Reason      string    `json:"reason"`
+	TimeCreated time.Time `json:"timeCreated"`
+}
+
+/**
+ * Write a zip archive with everything we store about the account: account.json, the avatar, and all
+ * payloads the account sent or received which have not been cleared yet.
+ */
+func ExportAccount(store Store, account *Account, w io.Writer) error {
+	export := &AccountExport{
+		AccountId:    account.Id,
+		ConnectCode:  account.ConnectCode,
+		DisplayName:  account.DisplayName,
+		TimeCreated:  account.TimeCreated,
+		Devices:      []DeviceResponse{},
+		Connections:  []ConnectionExport{},
+		Payloads:     []PayloadExport{},
+		Blocked:      []int{},
+		Reports:      []ReportExport{},
+		TimeExported: time.Now(),
+	}
+
+	devices, err := ListDevices(store, account.Id)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		export.Devices = append(export.Devices, DeviceResponse{
+			DeviceId:     device.Id,
+			Name:         device.Name,
+			Platform:     device.Platform,
+			HasPushToken: device.PushToken != "",
+			AlertPushes:  device.AlertPushes,
+			TimeCreated:  device.TimeCreated,
+		})
+	}
+
+	blocks, err := store.ListBlocks(account.Id)
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		if block.BlockerId == account.Id {
+			export.Blocked = append(export.Blocked, block.BlockedId)
+		}
+	}
+
+	reports, err := store.ListReportsFiledBy(account.Id)
+	if err != nil {
+		return err
+	}
+	for _, report := range reports {
+		export.Reports = append(export.Reports, ReportExport{
+			ReportedId:  report.ReportedId,
+			Reason:      report.Reason,
+			TimeCreated: report.TimeCreated,
+		})
+	}
+
+	archive := zip.NewWriter(w)
+
+	avatar, err := GetAvatar(store, account.Id)
+	if err == nil {
+		export.Avatar = "avatar" + payloadExtension("", avatar.Data)
+		if err = writeArchiveFile(archive, export.Avatar, avatar.TimeUpdated, avatar.Data); err != nil {
+			return err
+		}
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	connections, err := store.ListConnections(account.Id)
+	if err != nil {
+		return err
+	}
+	for _, connection := range connections {
+		export.Connections = append(export.Connections, ConnectionExport{
+			ConnectionId: connection.Id,
+			PeerId:       connection.GetPeerId(account.Id),
+			Initiator:    connection.InitiatorId == account.Id,
+			Status:       connection.Status,
+			TimeCreated:  connection.TimeCreated,
+		})
+	}
+
+	payloads, err := store.ListAccountPayloads(account.Id)
+	if err != nil {
+		return err
+	}
+	for _, payload := range payloads {
+		if err = OpenPayload(&payload); err != nil {
+			return err
+		}
+		payloadExport := PayloadExport{
+			ConnectionId: payload.ConnectionId,
+			Sent:         payload.FromId == account.Id,
+			Kind:         payload.GetKind(),
+			Caption:      string(payload.Caption),
+			Fetched:      payload.Fetched,
+			TimeCreated:  payload.TimeCreated,
+		}
+		direction := "received"
+		if payloadExport.Sent {
+			direction = "sent"
+		}
+		name := fmt.Sprintf("payloads/%d-%s", payload.ConnectionId, direction)
+
+		if len(payload.Data) > 0 {
+			payloadExport.File = name + payloadExtension(payload.ContentType, payload.Data)
+			if err = writeArchiveFile(archive, payloadExport.File, payload.TimeCreated, payload.Data); err != nil {
+				return err
+			}
+		}
+		if len(payload.Video) > 0 {
+			payloadExport.Video = name + "-video" + payloadExtension(payload.VideoContentType, payload.Video)
+			if err = writeArchiveFile(archive, payloadExport.Video, payload.TimeCreated, payload.Video); err != nil {
+				return err
+			}
+		}
+		export.Payloads = append(export.Payloads, payloadExport)
+	}
+
+	file, err := archive.Create("account.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(export); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// Stored as they are; photos and videos are compressed already.
+func writeArchiveFile(archive *zip.Writer, name string, modified time.Time, data []byte) error {
+	file, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	return err
+}
+
+var payloadExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"image/heic":      ".heic",
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+}
+
+// A file extension for the content type the sender declared or, if it did not, a guess from the data.
+func payloadExtension(contentType string, data []byte) string {
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	if extension, ok := payloadExtensions[contentType]; ok {
+		return extension
+	}
+	return ".bin"
+}
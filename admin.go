@@ -0,0 +1,294 @@
+package main
+
+import (
+	"time"
+)
+
+// What operators get to see about accounts. Never includes credentials or photos.
+
+type AdminAccountSummary struct {
+	AccountId   int    `json:"accountId"`
+	ConnectCode string `json:"connectCode"`
+	DisplayName string `json:"displayName"`
+	Devices     int    `json:"devices"`
+	PeerId      int    `json:"peerId"`
+	Status      string `json:"status"`
+}
+
+type AdminAccountDetails struct {
+	AccountId      int              `json:"accountId"`
+	ConnectCode    string           `json:"connectCode"`
+	DisplayName    string           `json:"displayName"`
+	State          *StateResponse   `json:"state"`
+	Devices        []DeviceResponse `json:"devices"`
+	Payloads       []AdminPayload   `json:"payloads"`
+	Blocked        []int            `json:"blocked"`
+	BlockedBy      []int            `json:"blockedBy"`
+	ReportsFiled   int              `json:"reportsFiled"`
+	ReportsAgainst int              `json:"reportsAgainst"`
+}
+
+type AdminPayload struct {
+	FromId      int       `json:"fromId"`
+	Kind        string    `json:"kind"`
+	Size        int       `json:"size"`
+	Fetched     bool      `json:"fetched"`
+	TimeCreated time.Time `json:"timeCreated"`
+}
+
+type AdminStats struct {
+	Accounts           int `json:"accounts"`
+	Devices            int `json:"devices"`
+	DevicesWithPush    int `json:"devicesWithPush"`
+	ConnectionsLive    int `json:"connectionsLive"`
+	ConnectionsPending int `json:"connectionsPending"`
+	PayloadsWaiting    int `json:"payloadsWaiting"`
+	PayloadBytes       int `json:"payloadBytes"`
+	OpenReports        int `json:"openReports"`
+	Blocks             int `json:"blocks"`
+}
+
+/**
+ * Find accounts by id, connect code or display name. An empty query lists the newest accounts.
+ */
+func SearchAccounts(store Store, search string, limit int) ([]AdminAccountSummary, error) {
+	accounts, err := store.SearchAccounts(search, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := []AdminAccountSummary{}
+	for _, account := range accounts {
+		devices, err := store.ListDevices(account.Id)
+		if err != nil {
+			return nil, err
+		}
+		summary := AdminAccountSummary{
+			AccountId:   account.Id,
+			ConnectCode: account.ConnectCode,
+			DisplayName: account.DisplayName,
+			Devices:     len(devices),
+		}
+
+		connection, err := GetConnection(store, account.Id)
+		if err == nil {
+			summary.PeerId = connection.GetPeerId(account.Id)
+			summary.Status = connection.Status
+		} else if err != ErrNoConnection {
+			return nil, err
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+/**
+ * Everything about an account an operator might need to answer a support request. The state is
+ * exactly what the account would see from /query.
+ */
+func GetAccountDetails(store Store, accountId int) (*AdminAccountDetails, error) {
+	account, err := store.GetAccount(accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	details := &AdminAccountDetails{
+		AccountId:   account.Id,
+		ConnectCode: account.ConnectCode,
+		DisplayName: account.DisplayName,
+		Devices:     []DeviceResponse{},
+		Payloads:    []AdminPayload{},
+		Blocked:     []int{},
+		BlockedBy:   []int{},
+	}
+
+	details.State, err = BuildStateResponse(store, account)
+	if err != nil {
+		return nil, err
+	}
+	// The caption is as private as the photo.
+	details.State.Caption = ""
+
+	devices, err := ListDevices(store, account.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		details.Devices = append(details.Devices, DeviceResponse{
+			DeviceId:     device.Id,
+			Name:         device.Name,
+			Platform:     device.Platform,
+			HasPushToken: device.PushToken != "",
+			AlertPushes:  device.AlertPushes,
+			TimeCreated:  device.TimeCreated,
+		})
+	}
+
+	connection, err := GetConnection(store, account.Id)
+	if err == nil {
+		payloads, err := store.ListPayloads(connection.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, payload := range payloads {
+			details.Payloads = append(details.Payloads, AdminPayload{
+				FromId:      payload.FromId,
+				Kind:        payload.GetKind(),
+				Size:        len(payload.Data) + len(payload.Video),
+				Fetched:     payload.Fetched,
+				TimeCreated: payload.TimeCreated,
+			})
+		}
+	} else if err != ErrNoConnection {
+		return nil, err
+	}
+
+	blocks, err := store.ListBlocks(account.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range blocks {
+		if block.BlockerId == account.Id {
+			details.Blocked = append(details.Blocked, block.BlockedId)
+		} else {
+			details.BlockedBy = append(details.BlockedBy, block.BlockerId)
+		}
+	}
+
+	details.ReportsFiled, details.ReportsAgainst, err = store.CountReports(account.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return details, nil
+}
+
+/**
+ * Remove all connections of the account, with their payloads. Both sides get a push, so the apps
+ * notice.
+ */
+func ForceDisconnect(store Store, accountId int) error {
+	connections, err := store.ListConnections(accountId)
+	if err != nil {
+		return err
+	}
+
+	for _, connection := range connections {
+		err = UnlinkAccounts(store, connection.InitiatorId, connection.InviteeId)
+		if err != nil {
+			return err
+		}
+		for _, id := range []int{connection.InitiatorId, connection.InviteeId} {
+			err = SendNotificationToAccountId(store, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/**
+ * Delete all payloads sent by or waiting for the account. Returns how many there were.
+ */
+func PurgePayloads(store Store, accountId int) (int, error) {
+	connections, err := store.ListConnections(accountId)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, connection := range connections {
+		count, err := store.DeletePayloads(connection.Id)
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+/**
+ * Forget the push tokens of all devices of the account, e.g. when Apple keeps rejecting them.
+ * The apps send a fresh one on their next start.
+ */
+func ResetPushTokens(store Store, accountId int) (int, error) {
+	return store.ResetPushTokens(accountId)
+}
+
+func GetStats(store Store) (*AdminStats, error) {
+	return store.Stats()
+}
+
+// Columns of DailyActivity.
+const (
+	ActivityRegistrations = "registrations"
+	ActivityConnections   = "connections"
+	ActivityBeams         = "beams"
+)
+
+/**
+ * Count one event of the given kind for today, in the database and in the metrics. Call it once
+ * the event is stored; if counting fails, that is logged, and the event still happened.
+ */
+func RecordActivity(store Store, column string) {
+	eventsTotal.WithLabelValues(column).Inc()
+	if err := store.IncrementActivity(time.Now(), column); err != nil {
+		Logger(store.Context()).Warn("recording activity failed", "column", column, "error", err)
+	}
+}
+
+/**
+ * The activity of the last days, newest first. Days without any activity are left out.
+ */
+func ListActivity(store Store, days int) ([]DailyActivity, error) {
+	return store.ListActivity(time.Now().AddDate(0, 0, 1-days))
+}
+
+/**
+ * A report as moderators see it. The payload is downloaded separately.
+ */
+type AdminReport struct {
+	Id                    int        `json:"id"`
+	ReporterId            int        `json:"reporterId"`
+	ReportedId            int        `json:"reportedId"`
+	Reason                string     `json:"reason"`
+	ConnectionId          int        `json:"connectionId"`
+	ConnectionInitiatorId int        `json:"connectionInitiatorId"`
+	ConnectionInviteeId   int        `json:"connectionInviteeId"`
+	ConnectionStatus      string     `json:"connectionStatus"`
+	PayloadKind           string     `json:"payloadKind,omitempty"`
+	PayloadContentType    string     `json:"payloadContentType,omitempty"`
+	PayloadSize           int        `json:"payloadSize,omitempty"` // Lists do not load the payload
+	PayloadVideoSize      int        `json:"payloadVideoSize,omitempty"`
+	PayloadCaption        string     `json:"payloadCaption,omitempty"`
+	PayloadTimeCreated    *time.Time `json:"payloadTimeCreated"`
+	TimeCreated           time.Time  `json:"timeCreated"`
+	TimeResolved          *time.Time `json:"timeResolved"`
+}
+
+func NewAdminReport(report *Report) AdminReport {
+	adminReport := AdminReport{
+		Id:                    report.Id,
+		ReporterId:            report.ReporterId,
+		ReportedId:            report.ReportedId,
+		Reason:                report.Reason,
+		ConnectionId:          report.ConnectionId,
+		ConnectionInitiatorId: report.ConnectionInitiatorId,
+		ConnectionInviteeId:   report.ConnectionInviteeId,
+		ConnectionStatus:      report.ConnectionStatus,
+		PayloadKind:           report.PayloadKind,
+		PayloadContentType:    report.PayloadContentType,
+		PayloadSize:           len(report.PayloadData),
+		PayloadVideoSize:      len(report.PayloadVideo),
+		PayloadCaption:        string(report.PayloadCaption),
+		TimeCreated:           report.TimeCreated,
+	}
+	if !report.PayloadTimeCreated.IsZero() {
+		adminReport.PayloadTimeCreated = &report.PayloadTimeCreated.Time
+	}
+	if !report.TimeResolved.IsZero() {
+		adminReport.TimeResolved = &report.TimeResolved.Time
+	}
+	return adminReport
+}
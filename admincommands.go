@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"os"
+	"time"
+)
+
+var jsonFlag = &cli.BoolFlag{Name: "json", Usage: "print the result as JSON"}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func printAccountDetails(details *AdminAccountDetails) {
+	fmt.Printf("Account %d, connect code %s\n", details.AccountId, details.ConnectCode)
+	if details.DisplayName != "" {
+		fmt.Printf("  Name:       %s\n", details.DisplayName)
+	}
+
+	state := details.State
+	switch state.Status {
+	case "":
+		fmt.Println("  Connection: none")
+	default:
+		fmt.Printf("  Connection: %s with account %d\n", state.Status, state.PeerId)
+		fmt.Printf("  Fetch:      shouldFetch=%t shouldPeerFetch=%t\n", state.ShouldFetch, state.ShouldPeerFetch)
+	}
+	for _, payload := range details.Payloads {
+		fmt.Printf("  Payload:    %s from %d, %d bytes, sent %s, fetched=%t\n",
+			payload.Kind, payload.FromId, payload.Size, payload.TimeCreated.Format(time.RFC3339), payload.Fetched)
+	}
+
+	for _, device := range details.Devices {
+		fmt.Printf("  Device %d:  %s (%s), push=%t, added %s\n",
+			device.DeviceId, device.Name, device.Platform, device.HasPushToken, device.TimeCreated.Format(time.RFC3339))
+	}
+	if len(details.Blocked) > 0 {
+		fmt.Printf("  Blocked:    %v\n", details.Blocked)
+	}
+	if len(details.BlockedBy) > 0 {
+		fmt.Printf("  Blocked by: %v\n", details.BlockedBy)
+	}
+	fmt.Printf("  Reports:    %d filed, %d against\n", details.ReportsFiled, details.ReportsAgainst)
+}
+
+/**
+ * For operators, so answering a support request does not need psql.
+ */
+var accountsCommand = &cli.Command{
+	Name:  "accounts",
+	Usage: "inspect and manage accounts",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "list",
+			Usage:     "list the newest accounts, or search by id, connect code or name",
+			ArgsUsage: "[search]",
+			Flags: []cli.Flag{
+				&cli.IntFlag{Name: "limit", Value: 50},
+				jsonFlag,
+			},
+			Action: func(c *cli.Context) error {
+				store := OpenStore()
+				defer store.Close()
+				accounts, err := SearchAccounts(store, c.Args().First(), c.Int("limit"))
+				if err != nil {
+					return err
+				}
+				if c.Bool("json") {
+					return printJSON(accounts)
+				}
+				for _, account := range accounts {
+					connection := "not connected"
+					if account.Status != "" {
+						connection = fmt.Sprintf("%s with %d", account.Status, account.PeerId)
+					}
+					fmt.Printf("#%d  %s  %q  %d device(s), %s\n",
+						account.AccountId, account.ConnectCode, account.DisplayName, account.Devices, connection)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "show",
+			Usage: "show an account with its devices, connection and payloads",
+			Flags: []cli.Flag{
+				&cli.IntFlag{Name: "id", Required: true},
+				jsonFlag,
+			},
+			Action: func(c *cli.Context) error {
+				store := OpenStore()
+				defer store.Close()
+				details, err := GetAccountDetails(store, c.Int("id"))
+				if err != nil {
+					return err
+				}
+				if c.Bool("json") {
+					return printJSON(details)
+				}
+				printAccountDetails(details)
+				return nil
+			},
+		},
+		{
+			Name:  "disconnect",
+			Usage: "remove all connections of an account, and their payloads",
+			Flags: []cli.Flag{
+				&cli.IntFlag{Name: "id", Required: true},
+			},
+			Action: func(c *cli.Context) error {
+				store := OpenStore()
+				defer store.Close()
+				return ForceDisconnect(store, c.Int("id"))
+			},
+		},
+		{
+			Name:  "purge-payloads",
+			Usage: "delete all payloads sent by or waiting for an account",
+			Flags: []cli.Flag{
+				&cli.IntFlag{Name: "id", Required: true},
+				jsonFlag,
+			},
+			Action: func(c *cli.Context) error {
+				store := OpenStore()
+				defer store.Close()
+				count, err := PurgePayloads(store, c.Int("id"))
+				if err != nil {
+					return err
+				}
+				if c.Bool("json") {
+					return printJSON(map[string]int{"deleted": count})
+				}
+				fmt.Printf("Deleted %d payload(s).\n", count)
+				return nil
+			},
+		},
+		{
+			Name:  "reset-push",
+			Usage: "forget the push tokens of all devices of an account",
+			Flags: []cli.Flag{
+				&cli.IntFlag{Name: "id", Required: true},
+				jsonFlag,
+			},
+			Action: func(c *cli.Context) error {
+				store := OpenStore()
+				defer store.Close()
+				count, err := ResetPushTokens(store, c.Int("id"))
+				if err != nil {
+					return err
+				}
+				if c.Bool("json") {
+					return printJSON(map[string]int{"devices": count})
+				}
+				fmt.Printf("Reset the push token of %d device(s).\n", count)
+				return nil
+			},
+		},
+	},
+}
+
+var reportsCommand = &cli.Command{
+	Name:  "reports",
+	Usage: "review abuse reports",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "list",
+			Usage: "list open reports",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "all", Usage: "include resolved reports"},
+			},
+			Action: func(c *cli.Context) error {
+				store := OpenStore()
+				defer store.Close()
+				reports, err := ListReports(store, c.Bool("all"))
+				if err != nil {
+					return err
+				}
+				for _, report := range reports {
+					fmt.Printf("#%d  %s  account %d reported by %d: %q\n",
+						report.Id, report.TimeCreated.Format(time.RFC3339), report.ReportedId, report.ReporterId, report.Reason)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "show",
+			Usage: "show a report, and optionally save the reported payload",
+			Flags: []cli.Flag{
+				&cli.IntFlag{Name: "id", Required: true},
+				&cli.StringFlag{Name: "out", Usage: "write the payload snapshot to this file"},
+				&cli.StringFlag{Name: "video-out", Usage: "write the video of a Live Photo snapshot to this file"},
+			},
+			Action: func(c *cli.Context) error {
+				store := OpenStore()
+				defer store.Close()
+				report, err := GetReport(store, c.Int("id"))
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Report #%d filed %s\n", report.Id, report.TimeCreated.Format(time.RFC3339))
+				fmt.Printf("  Reporter:   %d\n", report.ReporterId)
+				fmt.Printf("  Reported:   %d\n", report.ReportedId)
+				fmt.Printf("  Reason:     %q\n", report.Reason)
+				fmt.Printf("  Connection: %d (%d -> %d, %s)\n", report.ConnectionId,
+					report.ConnectionInitiatorId, report.ConnectionInviteeId, report.ConnectionStatus)
+				if report.PayloadKind != "" {
+					fmt.Printf("  Payload:    %s, %d bytes\n", report.PayloadKind, len(report.PayloadData)+len(report.PayloadVideo))
+				} else {
+					fmt.Printf("  Payload:    %d bytes\n", len(report.PayloadData))
+				}
+				if len(report.PayloadCaption) > 0 {
+					fmt.Printf("  Caption:    %q\n", report.PayloadCaption)
+				}
+				if !report.TimeResolved.IsZero() {
+					fmt.Printf("  Resolved:   %s\n", report.TimeResolved.Format(time.RFC3339))
+				}
+				if out := c.String("out"); out != "" && len(report.PayloadData) > 0 {
+					if err := os.WriteFile(out, report.PayloadData, 0600); err != nil {
+						return err
+					}
+				}
+				if out := c.String("video-out"); out != "" && len(report.PayloadVideo) > 0 {
+					return os.WriteFile(out, report.PayloadVideo, 0600)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "resolve",
+			Usage: "mark a report as handled and drop its payload snapshot",
+			Flags: []cli.Flag{
+				&cli.IntFlag{Name: "id", Required: true},
+			},
+			Action: func(c *cli.Context) error {
+				store := OpenStore()
+				defer store.Close()
+				return ResolveReport(store, c.Int("id"))
+			},
+		},
+	},
+}
+
+var statsCommand = &cli.Command{
+	Name:  "stats",
+	Usage: "print counts of accounts, connections and payloads",
+	Flags: []cli.Flag{jsonFlag},
+	Action: func(c *cli.Context) error {
+		store := OpenStore()
+		defer store.Close()
+		stats, err := GetStats(store)
+		if err != nil {
+			return err
+		}
+		if c.Bool("json") {
+			return printJSON(stats)
+		}
+		fmt.Printf("Accounts:            %d\n", stats.Accounts)
+		fmt.Printf("Devices:             %d (%d with push)\n", stats.Devices, stats.DevicesWithPush)
+		fmt.Printf("Live connections:    %d\n", stats.ConnectionsLive)
+		fmt.Printf("Pending connections: %d\n", stats.ConnectionsPending)
+		fmt.Printf("Waiting payloads:    %d (%d bytes)\n", stats.PayloadsWaiting, stats.PayloadBytes)
+		fmt.Printf("Open reports:        %d\n", stats.OpenReports)
+		fmt.Printf("Blocks:              %d\n", stats.Blocks)
+		return nil
+	},
+}
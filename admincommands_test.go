@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+/**
+ * Run the command line against the store, as it would run against the configured database, and
+ * return what it printed.
+ */
+func RunCommand(t *testing.T, store Store, args ...string) string {
+	t.Helper()
+	storeConfig.store = store
+	defer func() { storeConfig.store = nil }()
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- data
+	}()
+	stdout := os.Stdout
+	os.Stdout = writer
+	app := &cli.App{Name: "photobeam", Commands: []*cli.Command{accountsCommand, reportsCommand, statsCommand}}
+	err = app.Run(append([]string{"photobeam"}, args...))
+	os.Stdout = stdout
+	writer.Close()
+	printed := <-output
+
+	if err != nil {
+		t.Fatalf("%s: %v", strings.Join(args, " "), err)
+	}
+	return string(printed)
+}
+
+/**
+ * Two accounts connected to each other, the second having sent the first a photo.
+ */
+func CreateTestConnection(t *testing.T, store Store) (*Account, *Account) {
+	alice, _ := CreateTestAccount(store, "code1")
+	bob, _ := CreateTestAccount(store, "code2")
+	alice.DisplayName = "alice"
+	if err := store.UpdateAccount(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := LinkAccounts(store, alice, bob, "live"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RecordNewPayload(store, bob.Id, &Payload{Data: []byte("a photo for alice"), Caption: []byte("for your eyes only")}); err != nil {
+		t.Fatal(err)
+	}
+	return alice, bob
+}
+
+func TestAccountsListCommand(t *testing.T) {
+	store := NewMemoryStore()
+	alice, bob := CreateTestConnection(t, store)
+
+	var accounts []AdminAccountSummary
+	if err := json.Unmarshal([]byte(RunCommand(t, store, "accounts", "list", "--json", "alice")), &accounts); err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 1 || accounts[0].AccountId != alice.Id || accounts[0].PeerId != bob.Id || accounts[0].Devices != 1 {
+		t.Errorf("got %+v, want alice connected to bob", accounts)
+	}
+
+	if printed := RunCommand(t, store, "accounts", "list"); !strings.Contains(printed, `"alice"  1 device(s), live with 2`) {
+		t.Errorf("got %q", printed)
+	}
+}
+
+func TestAccountsShowCommand(t *testing.T) {
+	store := NewMemoryStore()
+	alice, bob := CreateTestConnection(t, store)
+
+	var details AdminAccountDetails
+	if err := json.Unmarshal([]byte(RunCommand(t, store, "accounts", "show", "--json", "--id", "1")), &details); err != nil {
+		t.Fatal(err)
+	}
+	if details.AccountId != alice.Id || details.State.PeerId != bob.Id || details.State.Status != "connected" ||
+		!details.State.ShouldFetch || details.State.Caption != "" || len(details.Payloads) != 1 || details.Payloads[0].Size != len("a photo for alice") {
+		t.Errorf("got %+v", details)
+	}
+
+	printed := RunCommand(t, store, "accounts", "show", "--id", "1")
+	if !strings.Contains(printed, "Connection: connected with account 2") || !strings.Contains(printed, "Payload:    photo from 2") ||
+		strings.Contains(printed, "for your eyes only") {
+		t.Errorf("got %q", printed)
+	}
+}
+
+func TestAccountsDisconnectCommand(t *testing.T) {
+	store := NewMemoryStore()
+	alice, bob := CreateTestConnection(t, store)
+	apns := StartFakeAPNs()
+	defer apns.Close()
+	SetPushClient(apns.Client())
+	defer SetPushClient(nil)
+	for _, account := range []*Account{alice, bob} {
+		devices, _ := store.ListDevices(account.Id)
+		devices[0].PushToken = fmt.Sprint("token-", account.Id)
+		if err := store.UpdateDevice(&devices[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	RunCommand(t, store, "accounts", "disconnect", "--id", "1")
+
+	for _, account := range []*Account{alice, bob} {
+		if _, err := GetConnection(store, account.Id); err != ErrNoConnection {
+			t.Errorf("account %d is still connected: %v", account.Id, err)
+		}
+		if payloads, _ := store.ListAccountPayloads(account.Id); len(payloads) != 0 {
+			t.Errorf("account %d still has %d payloads", account.Id, len(payloads))
+		}
+	}
+	if notifications := apns.Notifications(); len(notifications) != 2 {
+		t.Errorf("got %d pushes, want one for each side", len(notifications))
+	}
+}
+
+func TestAccountsPurgePayloadsCommand(t *testing.T) {
+	store := NewMemoryStore()
+	alice, bob := CreateTestConnection(t, store)
+
+	if printed := RunCommand(t, store, "accounts", "purge-payloads", "--id", "1"); printed != "Deleted 1 payload(s).\n" {
+		t.Errorf("got %q", printed)
+	}
+	if payloads, _ := store.ListAccountPayloads(alice.Id); len(payloads) != 0 {
+		t.Errorf("%d payloads are left", len(payloads))
+	}
+	// The connection stays.
+	if connection, err := GetConnection(store, alice.Id); err != nil || connection.GetPeerId(alice.Id) != bob.Id {
+		t.Errorf("the connection is gone: %v", err)
+	}
+}
+
+func TestAccountsResetPushCommand(t *testing.T) {
+	store := NewMemoryStore()
+	alice, device := CreateTestAccount(store, "code1")
+	device.PushToken = "token-alice"
+	if err := store.UpdateDevice(device); err != nil {
+		t.Fatal(err)
+	}
+
+	if printed := RunCommand(t, store, "accounts", "reset-push", "--id", "1"); printed != "Reset the push token of 1 device(s).\n" {
+		t.Errorf("got %q", printed)
+	}
+	if devices, _ := store.ListDevices(alice.Id); devices[0].PushToken != "" {
+		t.Errorf("the device still has the push token %q", devices[0].PushToken)
+	}
+}
+
+func TestReportsCommand(t *testing.T) {
+	store := NewMemoryStore()
+	alice, _ := CreateTestConnection(t, store)
+	report, err := ReportPeer(store, alice, "not nice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if printed := RunCommand(t, store, "reports", "list"); !strings.Contains(printed, `account 2 reported by 1: "not nice"`) {
+		t.Errorf("got %q", printed)
+	}
+	out := t.TempDir() + "/payload"
+	printed := RunCommand(t, store, "reports", "show", "--id", fmt.Sprint(report.Id), "--out", out)
+	if !strings.Contains(printed, `Reason:     "not nice"`) {
+		t.Errorf("got %q", printed)
+	}
+	if data, err := os.ReadFile(out); err != nil || string(data) != "a photo for alice" {
+		t.Errorf("saved %q, %v, want the reported photo", data, err)
+	}
+
+	RunCommand(t, store, "reports", "resolve", "--id", fmt.Sprint(report.Id))
+	if printed := RunCommand(t, store, "reports", "list"); printed != "" {
+		t.Errorf("got %q, want no open reports", printed)
+	}
+}
+
+func TestStatsCommand(t *testing.T) {
+	store := NewMemoryStore()
+	CreateTestConnection(t, store)
+	CreateTestAccount(store, "code3")
+
+	var stats AdminStats
+	if err := json.Unmarshal([]byte(RunCommand(t, store, "stats", "--json")), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Accounts != 3 || stats.Devices != 3 || stats.ConnectionsLive != 1 || stats.PayloadsWaiting != 1 ||
+		stats.PayloadBytes != len("a photo for alice") {
+		t.Errorf("got %+v", stats)
+	}
+
+	if printed := RunCommand(t, store, "stats"); !strings.Contains(printed, "Accounts:            3\n") {
+		t.Errorf("got %q", printed)
+	}
+}
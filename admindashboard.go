@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+)
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>photobeam admin</title>
+<style>
+	body { font-family: sans-serif; margin: 2em; }
+	table { border-collapse: collapse; margin-bottom: 2em; }
+	td, th { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: right; }
+	th:first-child, td:first-child { text-align: left; }
+</style>
+</head>
+<body>
+<h1>photobeam</h1>
+
+<table>
+	<tr><td>Accounts</td><td>{{.Stats.Accounts}}</td></tr>
+	<tr><td>Devices</td><td>{{.Stats.Devices}} ({{.Stats.DevicesWithPush}} with push)</td></tr>
+	<tr><td>Live connections</td><td>{{.Stats.ConnectionsLive}}</td></tr>
+	<tr><td>Pending connections</td><td>{{.Stats.ConnectionsPending}}</td></tr>
+	<tr><td>Waiting payloads</td><td>{{.Stats.PayloadsWaiting}} ({{.Stats.PayloadBytes}} bytes)</td></tr>
+	<tr><td>Open reports</td><td><a href="api/reports">{{.Stats.OpenReports}}</a></td></tr>
+	<tr><td>Blocks</td><td>{{.Stats.Blocks}}</td></tr>
+</table>
+
+<h2>Last 30 days</h2>
+<table>
+	<tr><th>Day</th><th>Registrations</th><th>Connections</th><th>Beams</th></tr>
+	{{range .Activity}}
+	<tr><td>{{.Day.Format "2006-01-02"}}</td><td>{{.Registrations}}</td><td>{{.Connections}}</td><td>{{.Beams}}</td></tr>
+	{{else}}
+	<tr><td colspan="4">Nothing yet.</td></tr>
+	{{end}}
+</table>
+</body>
+</html>
+`))
+
+/**
+ * A page with the numbers we look at most, for a browser. Everything else is in the JSON API.
+ */
+func AdminDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	stats, err := GetStats(store)
+	if err != nil {
+		WriteInternalError(w, r, err, "GetStats")
+		return
+	}
+	activity, err := ListActivity(store, 30)
+	if err != nil {
+		WriteInternalError(w, r, err, "ListActivity")
+		return
+	}
+
+	// Render first, so a template error can still become a proper error response.
+	var page bytes.Buffer
+	err = dashboardTemplate.Execute(&page, map[string]interface{}{
+		"Stats":    stats,
+		"Activity": activity,
+	})
+	if err != nil {
+		WriteInternalError(w, r, err, "Rendering dashboard")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page.Bytes())
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/**
+ * The admin API is only for us, so its errors are not part of the public list in allAPIErrors.
+ */
+var (
+	APIErrNoSuchAccount = &APIError{http.StatusNotFound, "no_such_account", "No account with this id."}
+	APIErrNoSuchReport  = &APIError{http.StatusNotFound, "no_such_report", "No report with this id."}
+)
+
+type AdminAccountArguments struct {
+	AccountId int `json:"accountId"`
+}
+
+type AdminReportArguments struct {
+	ReportId int `json:"reportId"`
+}
+
+type AdminCountResponse struct {
+	Count int `json:"count"`
+}
+
+/**
+ * Only let requests through which carry the admin token, either as a bearer token (for scripts)
+ * or as the password of HTTP basic auth (so the dashboard works in a browser).
+ *
+ * The browser sends basic auth along with any request to us, including a form another site
+ * submits, so it only counts for reading. Actions need the bearer token, which no form can set.
+ */
+func withAdminAuth(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := ""
+		if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			given = strings.TrimPrefix(header, "Bearer ")
+		} else if _, password, ok := r.BasicAuth(); ok && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			given = password
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="photobeam admin"`)
+			WriteError(w, r, APIErrUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func queryInt(r *http.Request, name string) (int, bool) {
+	value, err := strconv.Atoi(r.URL.Query().Get(name))
+	return value, err == nil
+}
+
+func AdminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	stats, err := GetStats(store)
+	if err != nil {
+		WriteInternalError(w, r, err, "GetStats")
+		return
+	}
+	WriteJSON(w, r, stats)
+}
+
+func AdminActivityHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	days, ok := queryInt(r, "days")
+	if !ok {
+		days = 30
+	}
+	activity, err := ListActivity(store, days)
+	if err != nil {
+		WriteInternalError(w, r, err, "ListActivity")
+		return
+	}
+	WriteJSON(w, r, activity)
+}
+
+func AdminSearchAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	limit, ok := queryInt(r, "limit")
+	if !ok {
+		limit = 50
+	}
+	accounts, err := SearchAccounts(store, r.URL.Query().Get("search"), limit)
+	if err != nil {
+		WriteInternalError(w, r, err, "SearchAccounts")
+		return
+	}
+	WriteJSON(w, r, accounts)
+}
+
+func AdminAccountHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	accountId, ok := queryInt(r, "id")
+	if !ok {
+		WriteError(w, r, APIErrInvalidRequest)
+		return
+	}
+	details, err := GetAccountDetails(store, accountId)
+	if err == ErrNotFound {
+		WriteError(w, r, APIErrNoSuchAccount)
+		return
+	}
+	if err != nil {
+		WriteInternalError(w, r, err, "GetAccountDetails")
+		return
+	}
+	WriteJSON(w, r, details)
+}
+
+/**
+ * Read the account from the arguments of an admin action. Writes the error response if there
+ * is no such account.
+ */
+func readAdminAccount(w http.ResponseWriter, r *http.Request, store Store) (*Account, bool) {
+	var args AdminAccountArguments
+	err := GetFromReq(w, r, &args)
+	if err != nil {
+		WriteError(w, r, APIErrInvalidRequest)
+		return nil, false
+	}
+	account, err := store.GetAccount(args.AccountId)
+	if err == ErrNotFound {
+		WriteError(w, r, APIErrNoSuchAccount)
+		return nil, false
+	}
+	if err != nil {
+		WriteInternalError(w, r, err, "Loading account")
+		return nil, false
+	}
+	return account, true
+}
+
+func AdminDisconnectHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	account, ok := readAdminAccount(w, r, store)
+	if !ok {
+		return
+	}
+	err := ForceDisconnect(store, account.Id)
+	if err != nil {
+		WriteInternalError(w, r, err, "ForceDisconnect")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func AdminPurgePayloadsHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	account, ok := readAdminAccount(w, r, store)
+	if !ok {
+		return
+	}
+	count, err := PurgePayloads(store, account.Id)
+	if err != nil {
+		WriteInternalError(w, r, err, "PurgePayloads")
+		return
+	}
+	WriteJSON(w, r, &AdminCountResponse{Count: count})
+}
+
+func AdminResetPushHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	account, ok := readAdminAccount(w, r, store)
+	if !ok {
+		return
+	}
+	count, err := ResetPushTokens(store, account.Id)
+	if err != nil {
+		WriteInternalError(w, r, err, "ResetPushTokens")
+		return
+	}
+	WriteJSON(w, r, &AdminCountResponse{Count: count})
+}
+
+/**
+ * Send a push to all devices of the account, like the test-apns command.
+ */
+func AdminTestPushHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	account, ok := readAdminAccount(w, r, store)
+	if !ok {
+		return
+	}
+	err := SendNotificationToAccountId(store, account.Id)
+	if err != nil {
+		WriteInternalError(w, r, err, "SendNotificationToAccountId")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/**
+ * Delete an account which broke the rules, the same way the user can delete it themselves.
+ */
+func AdminDeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	account, ok := readAdminAccount(w, r, store)
+	if !ok {
+		return
+	}
+	err := DeleteAccount(store, account)
+	if err != nil {
+		WriteInternalError(w, r, err, "DeleteAccount")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func AdminListReportsHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	reports, err := ListReports(store, r.URL.Query().Get("all") == "true")
+	if err != nil {
+		WriteInternalError(w, r, err, "ListReports")
+		return
+	}
+	response := []AdminReport{}
+	for i := range reports {
+		response = append(response, NewAdminReport(&reports[i]))
+	}
+	WriteJSON(w, r, response)
+}
+
+func loadAdminReport(w http.ResponseWriter, r *http.Request, store Store) (*Report, bool) {
+	reportId, ok := queryInt(r, "id")
+	if !ok {
+		WriteError(w, r, APIErrInvalidRequest)
+		return nil, false
+	}
+	report, err := GetReport(store, reportId)
+	if err == ErrNotFound {
+		WriteError(w, r, APIErrNoSuchReport)
+		return nil, false
+	}
+	if err != nil {
+		WriteInternalError(w, r, err, "GetReport")
+		return nil, false
+	}
+	return report, true
+}
+
+func AdminReportHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	report, ok := loadAdminReport(w, r, store)
+	if !ok {
+		return
+	}
+	WriteJSON(w, r, NewAdminReport(report))
+}
+
+/**
+ * The snapshot of the reported photo. Served as an attachment, it is user content after all.
+ */
+func AdminReportPayloadHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	report, ok := loadAdminReport(w, r, store)
+	if !ok {
+		return
+	}
+	writeReportAttachment(w, r, "report-"+strconv.Itoa(report.Id), report.PayloadContentType, report.PayloadData)
+}
+
+/**
+ * The video of a reported Live Photo, whose still AdminReportPayloadHandler has.
+ */
+func AdminReportVideoHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	report, ok := loadAdminReport(w, r, store)
+	if !ok {
+		return
+	}
+	writeReportAttachment(w, r, "report-"+strconv.Itoa(report.Id)+"-video", report.PayloadVideoContentType, report.PayloadVideo)
+}
+
+func writeReportAttachment(w http.ResponseWriter, r *http.Request, name string, contentType string, data []byte) {
+	if len(data) == 0 {
+		WriteError(w, r, APIErrNoPayload)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename="+name+payloadExtension(contentType, data))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(data)
+}
+
+func AdminResolveReportHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	var args AdminReportArguments
+	err := GetFromReq(w, r, &args)
+	if err != nil {
+		WriteError(w, r, APIErrInvalidRequest)
+		return
+	}
+	err = ResolveReport(store, args.ReportId)
+	if err == ErrNotFound {
+		WriteError(w, r, APIErrNoSuchReport)
+		return
+	}
+	if err != nil {
+		WriteInternalError(w, r, err, "ResolveReport")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+/**
+ * An error as the client sees it. Code is stable and meant for programs; Message is for humans
+ * and may change. Never put internal error text in either.
+ */
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	APIErrInvalidRequest     = &APIError{http.StatusBadRequest, "invalid_request", "The request could not be parsed."}
+	APIErrUnauthorized       = &APIError{http.StatusUnauthorized, "unauthorized", "Missing or unknown auth key."}
+	APIErrNotFound           = &APIError{http.StatusNotFound, "not_found", "No such endpoint."}
+	APIErrMethodNotAllowed   = &APIError{http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed for this endpoint."}
+	APIErrInvalidConnectCode = &APIError{http.StatusNotFound, "invalid_connect_code", "No account with this connect code."}
+	APIErrInvalidPairingCode = &APIError{http.StatusNotFound, "invalid_pairing_code", "The pairing code is unknown or expired."}
+	APIErrNoConnection       = &APIError{http.StatusConflict, "no_connection", "You are not connected to anyone."}
+	APIErrNoPendingRequest   = &APIError{http.StatusConflict, "no_pending_request", "There is no pending request from this account."}
+	APIErrBlocked            = &APIError{http.StatusConflict, "blocked", "This account is blocked."}
+	APIErrBlockSelf          = &APIError{http.StatusBadRequest, "cannot_block_self", "You cannot block yourself."}
+	APIErrNoPayload          = &APIError{http.StatusNotFound, "no_payload", "No payload available."}
+	APIErrNoAvatar           = &APIError{http.StatusNotFound, "no_avatar", "No avatar available."}
+	APIErrNoSuchDevice       = &APIError{http.StatusNotFound, "no_such_device", "No such device on this account."}
+	APIErrLastDevice         = &APIError{http.StatusConflict, "last_device", "The last device of an account cannot be revoked."}
+	APIErrInvalidDisplayName = &APIError{http.StatusBadRequest, "invalid_display_name", "The display name is too long."}
+	APIErrInvalidDevice      = &APIError{http.StatusBadRequest, "invalid_device", "The device name must be text of at most 50 characters, the platform at most 20 lowercase letters or digits."}
+	APIErrInvalidAvatar      = &APIError{http.StatusBadRequest, "invalid_avatar", "The avatar must be a JPEG or PNG image of at most 64 KB."}
+	APIErrInvalidPublicKey   = &APIError{http.StatusBadRequest, "invalid_public_key", "The public key algorithm is unknown, or the key has the wrong length."}
+	APIErrStalePublicKey     = &APIError{http.StatusConflict, "stale_public_key", "The peer has a different public key now; encrypt to the one from /query."}
+	APIErrInvalidCaption     = &APIError{http.StatusBadRequest, "invalid_caption", "The caption must be UTF-8 text of at most 1000 characters."}
+	APIErrEmptyPayload       = &APIError{http.StatusBadRequest, "empty_payload", "Send a photo, a caption, or both."}
+	APIErrInvalidKind        = &APIError{http.StatusBadRequest, "invalid_kind", "The payload kind is unknown, or its parts or content types do not fit it."}
+	APIErrPayloadTooLarge    = &APIError{http.StatusRequestEntityTooLarge, "payload_too_large", "The payload is larger than its kind allows."}
+	APIErrInternal           = &APIError{http.StatusInternalServerError, "internal_error", "Something went wrong on our side."}
+)
+
+// Every error the API can return, for the OpenAPI document.
+var allAPIErrors = []*APIError{
+	APIErrInvalidRequest,
+	APIErrUnauthorized,
+	APIErrNotFound,
+	APIErrMethodNotAllowed,
+	APIErrInvalidConnectCode,
+	APIErrInvalidPairingCode,
+	APIErrNoConnection,
+	APIErrNoPendingRequest,
+	APIErrBlocked,
+	APIErrBlockSelf,
+	APIErrNoPayload,
+	APIErrNoAvatar,
+	APIErrNoSuchDevice,
+	APIErrLastDevice,
+	APIErrInvalidDisplayName,
+	APIErrInvalidDevice,
+	APIErrInvalidAvatar,
+	APIErrInvalidPublicKey,
+	APIErrStalePublicKey,
+	APIErrInvalidCaption,
+	APIErrEmptyPayload,
+	APIErrInvalidKind,
+	APIErrPayloadTooLarge,
+	APIErrInternal,
+}
+
+/**
+ * The API errors for the errors the logic layer returns on purpose. Anything not in here is
+ * treated as a server fault.
+ */
+var apiErrorsByCause = map[error]*APIError{
+	ErrNoConnection:       APIErrNoConnection,
+	ErrNoPendingRequest:   APIErrNoPendingRequest,
+	ErrBlocked:            APIErrBlocked,
+	ErrBlockSelf:          APIErrBlockSelf,
+	ErrNoPayload:          APIErrNoPayload,
+	ErrPayloadFetched:     APIErrNoPayload,
+	ErrInvalidPairingCode: APIErrInvalidPairingCode,
+	ErrNoSuchDevice:       APIErrNoSuchDevice,
+	ErrLastDevice:         APIErrLastDevice,
+	ErrDisplayNameTooLong: APIErrInvalidDisplayName,
+	ErrDeviceInvalid:      APIErrInvalidDevice,
+	ErrAvatarTooLarge:     APIErrInvalidAvatar,
+	ErrAvatarType:         APIErrInvalidAvatar,
+	ErrPublicKeyInvalid:   APIErrInvalidPublicKey,
+	ErrStalePublicKey:     APIErrStalePublicKey,
+	ErrInvalidEncryption:  APIErrInvalidRequest,
+	ErrCaptionInvalid:     APIErrInvalidCaption,
+	ErrEmptyPayload:       APIErrEmptyPayload,
+	ErrInvalidKind:        APIErrInvalidKind,
+	ErrPayloadTooLarge:    APIErrPayloadTooLarge,
+}
+
+func WriteError(w http.ResponseWriter, r *http.Request, apiErr *APIError) {
+	response := &ErrorResponse{
+		Error: ErrorDetails{
+			Code:      apiErr.Code,
+			Message:   apiErr.Message,
+			RequestId: RequestId(r.Context()),
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		Logger(r.Context()).Warn("failed to write error response", "error", err)
+	}
+}
+
+/**
+ * Write the response for an error from the logic layer. Expected errors map to their API error;
+ * anything else is logged (with what we were doing) and the client gets a generic 500.
+ */
+func WriteLogicError(w http.ResponseWriter, r *http.Request, err error, operation string) {
+	if apiErr, ok := apiErrorsByCause[err]; ok {
+		WriteError(w, r, apiErr)
+		return
+	}
+	WriteInternalError(w, r, err, operation)
+}
+
+func WriteInternalError(w http.ResponseWriter, r *http.Request, err error, operation string) {
+	Logger(r.Context()).Error(operation+" failed", "operation", operation, "error", err)
+	WriteError(w, r, APIErrInternal)
+}
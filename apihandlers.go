@@ -2,45 +2,47 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
-	"github.com/go-pg/pg/v10"
-	"github.com/satori/go.uuid"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
 )
 
 /**
  * Called by apps to create a new account. They will get a secret key and a code for peers to connect.
  */
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
-	db := Connect()
-	defer db.Close()
+	store := DefaultStore().WithContext(r.Context())
 
-	account := &Account{
-		Key:         uuid.NewV4().String(),
-		ConnectCode: ConnectCode(),
-	}
-	err := db.Insert(account)
+	account, device, err := CreateAccount(store, "", "")
 	if err != nil {
-		panic(err)
+		WriteInternalError(w, r, err, "CreateAccount")
+		return
 	}
 
 	accountResponse := &AccountResponse{
 		AccountId:   account.Id,
 		ConnectCode: account.ConnectCode,
-		AuthKey:     account.Key,
-	}
-	if err := json.NewEncoder(w).Encode(accountResponse); err != nil {
-		panic(err)
+		DisplayName: account.DisplayName,
+		DeviceId:    device.Id,
+		AuthKey:     device.Key,
+		PublicKeyId: account.PublicKeyId,
 	}
+	WriteJSON(w, r, accountResponse)
 }
 
+/**
+ * Change properties of the calling device, such as its push token, or the profile of the account.
+ */
 func SetPropsHandler(w http.ResponseWriter, r *http.Request) {
-	db := Connect()
-	defer db.Close()
+	store := DefaultStore().WithContext(r.Context())
 
-	canAccess, account := ValidateAuth(db, r, w)
+	canAccess, account, device := ValidateDeviceAuth(store, r, w)
 	if !canAccess {
 		return
 	}
@@ -48,44 +50,187 @@ func SetPropsHandler(w http.ResponseWriter, r *http.Request) {
 	var args SetPropsArguments
 	err := GetFromReq(w, r, &args)
 	if err != nil {
-		http.Error(w, "invalid request", http.StatusBadRequest)
+		WriteError(w, r, APIErrInvalidRequest)
+		return
+	}
+
+	keyChanged, err := SetProps(store, account, device, &args)
+	if err != nil {
+		WriteLogicError(w, r, err, "SetProps")
 		return
 	}
+	// Peers have to encrypt to the new key from now on; the push has them load it.
+	if keyChanged {
+		accountId := account.Id
+		RunInBackground(r.Context(), "push", func(ctx context.Context) {
+			err := NotifyPeers(DefaultStore().WithContext(ctx), accountId)
+			if err != nil {
+				Logger(ctx).Error("notifying peers of new public key failed", "error", err)
+			}
+		})
+	}
+
+	accountResponse := &AccountResponse{
+		AccountId:   account.Id,
+		ConnectCode: account.ConnectCode,
+		DisplayName: account.DisplayName,
+		DeviceId:    device.Id,
+		PublicKeyId: account.PublicKeyId,
+	}
+	WriteJSON(w, r, accountResponse)
+}
+
+/**
+ * Issue a new auth key for the calling device and revoke its current one. The new key is only ever
+ * returned in this response.
+ */
+func RotateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
 
-	if args.ApnsToken != nil {
-		account.ApnsToken = *args.ApnsToken
+	canAccess, account, device := ValidateDeviceAuth(store, r, w)
+	if !canAccess {
+		return
 	}
 
-	// Update the account
-	err = db.Update(account)
+	err := RotateAuthKey(store, device)
 	if err != nil {
-		http.Error(w, "error changing props", http.StatusInternalServerError)
+		WriteLogicError(w, r, err, "RotateAuthKey")
 		return
 	}
 
 	accountResponse := &AccountResponse{
 		AccountId:   account.Id,
 		ConnectCode: account.ConnectCode,
-		// We probably do not want to return the key again
-		AuthKey:     account.Key,
+		DisplayName: account.DisplayName,
+		DeviceId:    device.Id,
+		AuthKey:     device.Key,
+		PublicKeyId: account.PublicKeyId,
+	}
+	WriteJSON(w, r, accountResponse)
+}
+
+/**
+ * Called by a signed-in device to get a code that another device can use to join the account.
+ */
+func PairDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	canAccess, account := ValidateAuth(store, r, w)
+	if !canAccess {
+		return
 	}
-	if err := json.NewEncoder(w).Encode(accountResponse); err != nil {
-		panic(err)
+
+	pairing, err := CreatePairingCode(store, account)
+	if err != nil {
+		WriteLogicError(w, r, err, "CreatePairingCode")
+		return
 	}
+
+	pairingResponse := &PairingResponse{
+		PairingCode: pairing.Code,
+		ExpiresAt:   pairing.TimeExpires,
+	}
+	WriteJSON(w, r, pairingResponse)
+}
+
+/**
+ * Called by a new device with a pairing code from /devices/pair. Like /register, but joins the
+ * existing account; the new device gets its own key.
+ */
+func AddDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	var args AddDeviceArguments
+	err := GetFromReq(w, r, &args)
+	if err != nil {
+		WriteError(w, r, APIErrInvalidRequest)
+		return
+	}
+
+	account, device, err := RedeemPairingCode(store, args.PairingCode, args.DeviceName, args.Platform)
+	if err != nil {
+		WriteLogicError(w, r, err, "RedeemPairingCode")
+		return
+	}
+
+	accountResponse := &AccountResponse{
+		AccountId:   account.Id,
+		ConnectCode: account.ConnectCode,
+		DisplayName: account.DisplayName,
+		DeviceId:    device.Id,
+		AuthKey:     device.Key,
+		PublicKeyId: account.PublicKeyId,
+	}
+	WriteJSON(w, r, accountResponse)
+}
+
+func ListDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	canAccess, account, actorDevice := ValidateDeviceAuth(store, r, w)
+	if !canAccess {
+		return
+	}
+
+	devices, err := ListDevices(store, account.Id)
+	if err != nil {
+		WriteLogicError(w, r, err, "ListDevices")
+		return
+	}
+
+	devicesResponse := make([]DeviceResponse, 0, len(devices))
+	for _, device := range devices {
+		devicesResponse = append(devicesResponse, DeviceResponse{
+			DeviceId:     device.Id,
+			Name:         device.Name,
+			Platform:     device.Platform,
+			HasPushToken: device.PushToken != "",
+			AlertPushes:  device.AlertPushes,
+			TimeCreated:  device.TimeCreated,
+			Current:      device.Id == actorDevice.Id,
+		})
+	}
+	WriteJSON(w, r, devicesResponse)
+}
+
+/**
+ * Sign one of the account's devices out. A device may revoke itself.
+ */
+func RevokeDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	canAccess, account := ValidateAuth(store, r, w)
+	if !canAccess {
+		return
+	}
+
+	var args RevokeDeviceArguments
+	err := GetFromReq(w, r, &args)
+	if err != nil {
+		WriteError(w, r, APIErrInvalidRequest)
+		return
+	}
+
+	err = RevokeDevice(store, account, args.DeviceId)
+	if err != nil {
+		WriteLogicError(w, r, err, "RevokeDevice")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 /**
  * Called to connect to a peer. If you are already connected to someone, will unconnect.
  *
- * Argument includes a connection code. If there is no peer with this code, return status 400.
+ * Argument includes a connection code. If there is no peer with this code, return status 404.
  *
  * Otherwise, return a State update.
  */
 func ConnectHandler(w http.ResponseWriter, r *http.Request) {
-	db := Connect()
-	defer db.Close()
+	store := DefaultStore().WithContext(r.Context())
 
-	canAccess, account := ValidateAuth(db, r, w)
+	canAccess, account := ValidateAuth(store, r, w)
 	if !canAccess {
 		return
 	}
@@ -93,24 +238,34 @@ func ConnectHandler(w http.ResponseWriter, r *http.Request) {
 	var args ConnectArguments
 	err := GetFromReq(w, r, &args)
 	if err != nil {
-		http.Error(w, "invalid request", http.StatusBadRequest)
+		WriteError(w, r, APIErrInvalidRequest)
 		return
 	}
 
-	otherAccount := new(Account)
-	err = db.Model(otherAccount).
-		Where("connect_code = ?", args.ConnectCode).
-		Limit(1).
-		Select()
+	otherAccount, err := store.GetAccountByConnectCode(args.ConnectCode)
+	if err == ErrNotFound {
+		WriteError(w, r, APIErrInvalidConnectCode)
+		return
+	}
 	if err != nil {
-		http.Error(w, "invalid code", http.StatusBadRequest)
+		WriteInternalError(w, r, err, "Finding connect code")
 		return
 	}
 
-	err = LinkAccounts(db, account, otherAccount, PENDING)
+	// To whoever is blocked, this looks no different from a code that does not exist.
+	blocked, err := IsBlocked(store, account.Id, otherAccount.Id)
 	if err != nil {
-		log.Printf("LinkAccounts failed: %s", err)
-		http.Error(w, "could not link accounts", http.StatusBadRequest)
+		WriteLogicError(w, r, err, "IsBlocked")
+		return
+	}
+	if blocked {
+		WriteError(w, r, APIErrInvalidConnectCode)
+		return
+	}
+
+	err = LinkAccounts(store, account, otherAccount, PENDING)
+	if err != nil {
+		WriteLogicError(w, r, err, "LinkAccounts")
 		return
 	}
 
@@ -120,9 +275,12 @@ func ConnectHandler(w http.ResponseWriter, r *http.Request) {
 		ShouldFetch: false,
 		ShouldPeerFetch: false,
 	}
-	if err := json.NewEncoder(w).Encode(stateResponse); err != nil {
-		panic(err)
+	err = CompletePeerResponse(stateResponse, store, account)
+	if err != nil {
+		WriteLogicError(w, r, err, "GetProfile")
+		return
 	}
+	WriteJSON(w, r, stateResponse)
 }
 
 
@@ -130,25 +288,21 @@ func ConnectHandler(w http.ResponseWriter, r *http.Request) {
  * Called to disconnect from the current connection.
  */
 func DisconnectHandler(w http.ResponseWriter, r *http.Request) {
-	db := Connect()
-	defer db.Close()
+	store := DefaultStore().WithContext(r.Context())
 
-	canAccess, account := ValidateAuth(db, r, w)
+	canAccess, account := ValidateAuth(store, r, w)
 	if !canAccess {
 		return
 	}
 
-	err := UnlinkAnyConnection(db, account, 0)
+	err := UnlinkAnyConnection(store, account, 0)
 	if err != nil {
-		log.Printf("UnlinkAnyConnection failed: %s", err)
-		http.Error(w, "could not unlink connection", http.StatusBadRequest)
+		WriteLogicError(w, r, err, "UnlinkAnyConnection")
 		return
 	}
 
 	stateResponse := &StateResponse{}
-	if err := json.NewEncoder(w).Encode(stateResponse); err != nil {
-		panic(err)
-	}
+	WriteJSON(w, r, stateResponse)
 }
 
 
@@ -156,30 +310,45 @@ func DisconnectHandler(w http.ResponseWriter, r *http.Request) {
  * Return the current state of your account, including connected to who? Are there pending requests?
  */
 func QueryHandler(w http.ResponseWriter, r *http.Request) {
-	db := Connect()
-	defer db.Close()
+	store := DefaultStore().WithContext(r.Context())
 
-	canAccess, account := ValidateAuth(db, r, w)
+	canAccess, account := ValidateAuth(store, r, w)
 	if !canAccess {
 		return
 	}
 
-	connection, err := GetConnection(db, account.Id)
+	WriteBackStateResponse(w, r, store, account)
+}
+
+/**
+ * Write the current connection state of the account, as returned by /query.
+ */
+func WriteBackStateResponse(w http.ResponseWriter, r *http.Request, store Store, account *Account) {
+	stateResponse, err := BuildStateResponse(store, account)
 	if err != nil {
-		if isBadConn(err, false) {
-			panic(err);
-			return;
-		}
+		WriteInternalError(w, r, err, "BuildStateResponse")
+		return
+	}
+
+	WriteJSON(w, r, stateResponse)
+}
+
+/**
+ * The connection state of the account as the API reports it; an empty state if not connected.
+ */
+func BuildStateResponse(store Store, account *Account) (*StateResponse, error) {
+	connection, err := GetConnection(store, account.Id)
+	if err == ErrNoConnection {
 		stateResponse := &StateResponse{
 			PeerId: 0,
 			Status: "",
 			ShouldFetch: false,
 			ShouldPeerFetch: false,
 		}
-		if err := json.NewEncoder(w).Encode(stateResponse); err != nil {
-			panic(err)
-		}
-		return;
+		return stateResponse, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	peerId := connection.GetPeerId(account.Id)
@@ -198,33 +367,56 @@ func QueryHandler(w http.ResponseWriter, r *http.Request) {
 		PeerId: peerId,
 		Status: status,
 	}
-	err = CompleteFetchResponse(stateResponse, db, connection, account)
+	err = CompleteFetchResponse(stateResponse, store, connection, account)
 	if err != nil {
-		log.Printf("QueryPayload failed: %s", err)
-		http.Error(w, "could not query payload", http.StatusBadRequest)
-		return
+		return nil, err
 	}
-
-	if err := json.NewEncoder(w).Encode(stateResponse); err != nil {
-		panic(err)
+	err = CompletePeerResponse(stateResponse, store, account)
+	if err != nil {
+		return nil, err
 	}
+
+	return stateResponse, nil
 }
 
-func CompleteFetchResponse(response *StateResponse, db *pg.DB, connection *Connection, account *Account) error {
-	accountShouldFetch, peerShouldFetch, err := QueryPayload(db, connection.Id, account.Id)
+func CompleteFetchResponse(response *StateResponse, store Store, connection *Connection, account *Account) error {
+	incoming, peerShouldFetch, err := QueryPayload(store, connection.Id, account.Id)
 	if err != nil {
 		return err;
 	}
 
 	response.ShouldPeerFetch = peerShouldFetch;
-	response.ShouldFetch = accountShouldFetch;
+	response.ShouldFetch = incoming != nil
+	if incoming != nil {
+		response.Caption, err = PayloadCaption(incoming)
+		if err != nil {
+			return err
+		}
+		response.Kind = incoming.GetKind()
+		response.ContentType = incoming.ContentType
+	}
+	return nil
+}
+
+// The profile of the peer, if the account may see it; see CanSeeProfile.
+func CompletePeerResponse(response *StateResponse, store Store, account *Account) error {
+	canSee, err := CanSeeProfile(store, account, response.PeerId)
+	if err != nil || !canSee {
+		return err
+	}
+	profile, err := GetProfile(store, response.PeerId)
+	if err != nil {
+		return err
+	}
+
+	response.Peer = profile
 	return nil
 }
 
-func WriteBackConnectedResponse(w http.ResponseWriter, db *pg.DB, account *Account) {
-	connection, err := GetConnection(db, account.Id)
+func WriteBackConnectedResponse(w http.ResponseWriter, r *http.Request, store Store, account *Account) {
+	connection, err := GetConnection(store, account.Id)
 	if err != nil {
-		http.Error(w, "unexpectedly connection is missing", http.StatusBadRequest)
+		WriteLogicError(w, r, err, "GetConnection")
 		return
 	}
 
@@ -232,15 +424,17 @@ func WriteBackConnectedResponse(w http.ResponseWriter, db *pg.DB, account *Accou
 		PeerId: connection.GetPeerId(account.Id),
 		Status: "connected",
 	}
-	err = CompleteFetchResponse(stateResponse, db, connection, account)
+	err = CompleteFetchResponse(stateResponse, store, connection, account)
 	if err != nil {
-		log.Printf("QueryPayload failed: %s", err)
-		http.Error(w, "could not query payload", http.StatusBadRequest)
+		WriteLogicError(w, r, err, "QueryPayload")
 		return
 	}
-	if err := json.NewEncoder(w).Encode(stateResponse); err != nil {
-		panic(err)
+	err = CompletePeerResponse(stateResponse, store, account)
+	if err != nil {
+		WriteLogicError(w, r, err, "GetProfile")
+		return
 	}
+	WriteJSON(w, r, stateResponse)
 }
 
 /**
@@ -248,10 +442,9 @@ func WriteBackConnectedResponse(w http.ResponseWriter, db *pg.DB, account *Accou
  * TODO: Support "no"
  */
 func AcceptHandler(w http.ResponseWriter, r *http.Request) {
-	db := Connect()
-	defer db.Close()
+	store := DefaultStore().WithContext(r.Context())
 
-	canAccess, actorAccount := ValidateAuth(db, r, w)
+	canAccess, actorAccount := ValidateAuth(store, r, w)
 	if !canAccess {
 		return
 	}
@@ -259,14 +452,14 @@ func AcceptHandler(w http.ResponseWriter, r *http.Request) {
 	var args AcceptArguments
 	err := GetFromReq(w, r, &args)
 	if err != nil {
-		http.Error(w, "invalid request", http.StatusBadRequest)
+		WriteError(w, r, APIErrInvalidRequest)
 		return
 	}
 
 	// If there is a connection from this peer, accept it.
-	err = AcceptLink(db, actorAccount, args.PeerId)
+	err = AcceptLink(store, actorAccount, args.PeerId)
 	if err != nil {
-		http.Error(w, "failed to accept", http.StatusBadRequest)
+		WriteLogicError(w, r, err, "AcceptLink")
 		return
 	}
 
@@ -276,95 +469,408 @@ func AcceptHandler(w http.ResponseWriter, r *http.Request) {
 		ShouldFetch: false,
 		ShouldPeerFetch: false,
 	}
-	if err := json.NewEncoder(w).Encode(stateResponse); err != nil {
-		panic(err)
+	err = CompletePeerResponse(stateResponse, store, actorAccount)
+	if err != nil {
+		WriteLogicError(w, r, err, "GetProfile")
+		return
 	}
+	WriteJSON(w, r, stateResponse)
 }
 
-/**
- * Set a payload for the current connection. This is a multipart form request with the following keys:
+// How the sender encrypted a payload: sent with /set, and returned with /get. See Payload.
+const (
+	HeaderKeyId     = "X-Photobeam-Key-Id"
+	HeaderAlgorithm = "X-Photobeam-Algorithm"
+	HeaderNonce     = "X-Photobeam-Nonce" // Base64
+)
+
+// The caption of a payload, percent-encoded UTF-8, on /set and /get.
+const HeaderCaption = "X-Photobeam-Caption"
+
+// The kind of a payload, see payloadKind, on /set and /get. Its content type goes in Content-Type.
+const HeaderKind = "X-Photobeam-Kind"
 
- * file: the file to be uploaded
+/**
+ * Set a payload for the current connection. The body is the photo itself; iOS can only upload in
+ * the background like this. The caption, if any, is in the X-Photobeam-Caption header, the kind in
+ * X-Photobeam-Kind, and Content-Type says what the body is.
+ *
+ * Other clients can send a multipart form instead, with the keys:
+ *
+ * file: the photo, animation or video, or the still of a Live Photo
+ * video: the video of a Live Photo
+ * caption: the caption
+ * kind: the kind
+ *
+ * The content types of the files are those of their parts. Either a file or the caption may be
+ * left out, though not both.
  */
 func SetPictureHandler(w http.ResponseWriter, r *http.Request) {
-	db := Connect()
-	defer db.Close()
+	store := DefaultStore().WithContext(r.Context())
 
-	canAccess, actorAccount := ValidateAuth(db, r, w)
+	canAccess, actorAccount := ValidateAuth(store, r, w)
 	if !canAccess {
 		return
 	}
 
-	// This was a previous attempt when we uploaded via a form (the Moya code in the iOS client still does this).
-	// However, on iOS, to use an upload task in the background, we need to accept the files like this.
-	//err := r.ParseMultipartForm(1024 * 1024 * 5)
-	//if err != nil {
-	//	log.Println("failed to parse request")
-	//	http.Error(w, "failed to parse request", http.StatusBadRequest)
-	//	return
-	//}
-	//
-	//file, _, err := r.FormFile("file")
-	//if err != nil {
-	//	log.Println("failed to find file in request")
-	//	http.Error(w, "failed to find file", http.StatusBadRequest)
-	//	return
-	//}
-	//defer file.Close()
+	payload := &Payload{
+		Kind:      r.Header.Get(HeaderKind),
+		KeyId:     r.Header.Get(HeaderKeyId),
+		Algorithm: r.Header.Get(HeaderAlgorithm),
+	}
+	var err error
+	if caption := r.Header.Get(HeaderCaption); caption != "" {
+		caption, err = url.PathUnescape(caption)
+		if err != nil {
+			WriteError(w, r, APIErrInvalidCaption)
+			return
+		}
+		payload.Caption = []byte(caption)
+	}
+	if nonce := r.Header.Get(HeaderNonce); nonce != "" {
+		payload.Nonce, err = base64.StdEncoding.DecodeString(nonce)
+		if err != nil {
+			WriteError(w, r, APIErrInvalidRequest)
+			return
+		}
+	}
 
-	buf := bytes.NewBuffer(nil)
-	if _, err := io.Copy(buf, r.Body); err != nil {
-		http.Error(w, "failed to copy file", http.StatusInternalServerError)
+	// The limits per kind are up to RecordNewPayload; this only keeps us from reading forever.
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize())
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		err = readPayloadForm(r, payload)
+	} else {
+		payload.ContentType, err = normalizeContentType(r.Header.Get("Content-Type"))
+		// Clients from before kinds send whatever their HTTP library defaults to, say a form
+		// encoding; without a kind, only a content type which could be a photo or video counts.
+		if payload.Kind == "" && (err != nil || !isMediaContentType(payload.ContentType)) {
+			payload.ContentType, err = "", nil
+		}
+		if err == nil {
+			payload.Data, err = io.ReadAll(r.Body)
+		}
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		WriteError(w, r, APIErrPayloadTooLarge)
+		return
+	case err == ErrInvalidKind:
+		WriteError(w, r, APIErrInvalidKind)
+		return
+	case err != nil:
+		// The client went away or sent something broken.
+		WriteError(w, r, APIErrInvalidRequest)
 		return
 	}
 
-	peerId, err := RecordNewPayload(db, actorAccount.Id, buf.Bytes())
+	// Before storing it encrypts the caption.
+	alert := BeamAlert(actorAccount, payload)
+
+	peerId, err := RecordNewPayload(store, actorAccount.Id, payload)
 	if err != nil {
-		http.Error(w, "failed to record payload", http.StatusBadRequest)
+		WriteLogicError(w, r, err, "RecordNewPayload")
 		return
 	}
 
-	err = SendNotificationToAccountId(db, peerId)
+	// The uploader does not need to wait for APNs.
+	RunInBackground(r.Context(), "push", func(ctx context.Context) {
+		err := SendBeamNotification(DefaultStore().WithContext(ctx), peerId, payload.Kind, alert)
+		if err != nil {
+			Logger(ctx).Error("notifying peer of new payload failed", "peer_id", peerId, "error", err)
+		}
+	})
+
+	WriteBackConnectedResponse(w, r, store, actorAccount)
+}
+
+// The files, the caption and the kind from a multipart form; parts with other names are ignored.
+func readPayloadForm(r *http.Request, payload *Payload) error {
+	reader, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, "failed to find peer account record", http.StatusInternalServerError)
+		return err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch part.FormName() {
+		case "file":
+			payload.ContentType, err = normalizeContentType(part.Header.Get("Content-Type"))
+			if err == nil {
+				payload.Data, err = io.ReadAll(part)
+			}
+		case "video":
+			payload.VideoContentType, err = normalizeContentType(part.Header.Get("Content-Type"))
+			if err == nil {
+				payload.Video, err = io.ReadAll(part)
+			}
+		case "caption":
+			payload.Caption, err = io.ReadAll(part)
+		case "kind":
+			var kind []byte
+			kind, err = io.ReadAll(part)
+			payload.Kind = string(kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func GetPictureHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	canAccess, actorAccount := ValidateAuth(store, r, w)
+	if !canAccess {
 		return
 	}
 
-	WriteBackConnectedResponse(w, db, actorAccount)
+	payload, err := FetchPayload(store, actorAccount.Id)
+	if err != nil {
+		WriteLogicError(w, r, err, "FetchPayload")
+		return
+	}
+
+	if payload.KeyId != "" {
+		w.Header().Set(HeaderKeyId, payload.KeyId)
+		w.Header().Set(HeaderAlgorithm, payload.Algorithm)
+		if len(payload.Nonce) > 0 {
+			w.Header().Set(HeaderNonce, base64.StdEncoding.EncodeToString(payload.Nonce))
+		}
+	}
+	if len(payload.Caption) > 0 {
+		w.Header().Set(HeaderCaption, url.PathEscape(string(payload.Caption)))
+	}
+	w.Header().Set(HeaderKind, payload.GetKind())
+	w.Header().Set("Content-Type", payloadContentType(payload.ContentType))
+	w.Write(payload.Data)
 }
 
-func GetPictureHandler(w http.ResponseWriter, r *http.Request) {
-	db := Connect()
-	defer db.Close()
+/**
+ * The video of a Live Photo, which /get has the still of. Fetch both before /clear.
+ */
+func GetVideoHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
 
-	canAccess, actorAccount := ValidateAuth(db, r, w)
+	canAccess, actorAccount := ValidateAuth(store, r, w)
 	if !canAccess {
 		return
 	}
 
-	data, err := FetchPayload(db, actorAccount.Id)
+	payload, err := FetchPayload(store, actorAccount.Id)
 	if err != nil {
-		http.Error(w, "No payload available", http.StatusBadRequest)
+		WriteLogicError(w, r, err, "FetchPayload")
+		return
+	}
+	if payload.GetKind() != PayloadKindLivePhoto {
+		WriteError(w, r, APIErrNoPayload)
 		return
 	}
 
-	w.Write(data)
+	w.Header().Set("Content-Type", payloadContentType(payload.VideoContentType))
+	w.Write(payload.Video)
+}
+
+// What we tell the receiver a payload is; we do not guess if the sender did not say.
+func payloadContentType(contentType string) string {
+	if contentType == "" {
+		return "application/octet-stream"
+	}
+	return contentType
 }
 
 func ClearPictureHandler(w http.ResponseWriter, r *http.Request) {
-	db := Connect()
-	defer db.Close()
+	store := DefaultStore().WithContext(r.Context())
+
+	canAccess, actorAccount := ValidateAuth(store, r, w)
+	if !canAccess {
+		return
+	}
+
+	err := ClearPayload(store, actorAccount.Id)
+	if err != nil {
+		WriteLogicError(w, r, err, "ClearPayload")
+		return
+	}
+
+	WriteBackConnectedResponse(w, r, store, actorAccount)
+}
+
+/**
+ * Block an account: removes any connection with it, and prevents it from linking to you again.
+ */
+func BlockHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	canAccess, actorAccount := ValidateAuth(store, r, w)
+	if !canAccess {
+		return
+	}
+
+	var args BlockArguments
+	err := GetFromReq(w, r, &args)
+	if err != nil || args.AccountId == 0 {
+		WriteError(w, r, APIErrInvalidRequest)
+		return
+	}
+
+	err = BlockAccount(store, actorAccount, args.AccountId)
+	if err != nil {
+		WriteLogicError(w, r, err, "BlockAccount")
+		return
+	}
+
+	WriteBackStateResponse(w, r, store, actorAccount)
+}
+
+func UnblockHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	canAccess, actorAccount := ValidateAuth(store, r, w)
+	if !canAccess {
+		return
+	}
+
+	var args BlockArguments
+	err := GetFromReq(w, r, &args)
+	if err != nil || args.AccountId == 0 {
+		WriteError(w, r, APIErrInvalidRequest)
+		return
+	}
+
+	err = UnblockAccount(store, actorAccount, args.AccountId)
+	if err != nil {
+		WriteLogicError(w, r, err, "UnblockAccount")
+		return
+	}
+
+	WriteBackStateResponse(w, r, store, actorAccount)
+}
+
+/**
+ * Report the current peer, including the payload they sent if it is still on the server. Clients
+ * should call this before /clear, as a cleared payload can no longer be attached to the report.
+ */
+func ReportHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	canAccess, actorAccount := ValidateAuth(store, r, w)
+	if !canAccess {
+		return
+	}
+
+	var args ReportArguments
+	err := GetFromReq(w, r, &args)
+	if err != nil {
+		WriteError(w, r, APIErrInvalidRequest)
+		return
+	}
+
+	report, err := ReportPeer(store, actorAccount, args.Reason)
+	if err != nil {
+		WriteLogicError(w, r, err, "ReportPeer")
+		return
+	}
+
+	if args.Block {
+		err = BlockAccount(store, actorAccount, report.ReportedId)
+		if err != nil {
+			WriteLogicError(w, r, err, "BlockAccount")
+			return
+		}
+	}
+
+	WriteBackStateResponse(w, r, store, actorAccount)
+}
+
+/**
+ * Delete the account with all its devices, connections and photos. There is no undo.
+ */
+func DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	canAccess, actorAccount := ValidateAuth(store, r, w)
+	if !canAccess {
+		return
+	}
 
-	canAccess, actorAccount := ValidateAuth(db, r, w)
+	err := DeleteAccount(store, actorAccount)
+	if err != nil {
+		WriteLogicError(w, r, err, "DeleteAccount")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/**
+ * Download a zip archive of everything stored about the account.
+ */
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	canAccess, actorAccount := ValidateAuth(store, r, w)
 	if !canAccess {
 		return
 	}
 
-	err := ClearPayload(db, actorAccount.Id)
+	// Build the archive first, so we can still send a proper error if something fails.
+	buf := bytes.NewBuffer(nil)
+	err := ExportAccount(store, actorAccount, buf)
+	if err != nil {
+		WriteLogicError(w, r, err, "ExportAccount")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="photobeam-account-%d.zip"`, actorAccount.Id))
+	w.Write(buf.Bytes())
+}
+
+/**
+ * Return the avatar image of an account. Query parameter accountId; you can only load your own
+ * avatar, that of an account you are connected to, or that of an account asking to connect to you.
+ */
+func AvatarHandler(w http.ResponseWriter, r *http.Request) {
+	store := DefaultStore().WithContext(r.Context())
+
+	canAccess, actorAccount := ValidateAuth(store, r, w)
+	if !canAccess {
+		return
+	}
+
+	accountId, err := strconv.Atoi(r.URL.Query().Get("accountId"))
+	if err != nil {
+		WriteError(w, r, APIErrInvalidRequest)
+		return
+	}
+
+	canSee, err := CanSeeProfile(store, actorAccount, accountId)
+	if err != nil {
+		WriteLogicError(w, r, err, "CanSeeProfile")
+		return
+	}
+	if !canSee {
+		WriteError(w, r, APIErrNoAvatar)
+		return
+	}
+
+	avatar, err := GetAvatar(store, accountId)
+	if err == ErrNotFound {
+		WriteError(w, r, APIErrNoAvatar)
+		return
+	}
 	if err != nil {
-		http.Error(w, "No payload available", http.StatusBadRequest)
+		WriteInternalError(w, r, err, "GetAvatar")
 		return
 	}
 
-	WriteBackConnectedResponse(w, db, actorAccount)
+	w.Header().Set("Content-Type", avatar.ContentType)
+	w.Header().Set("ETag", `"`+avatar.Hash+`"`)
+	w.Write(avatar.Data)
 }
@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 /**
  * Represents the state of a connection. Returned by some API calls.
  *
@@ -10,21 +12,108 @@ type StateResponse struct {
 	Status      string `json:"status"`
 	ShouldFetch bool   `json:"shouldFetch"`
 	ShouldPeerFetch bool   `json:"shouldPeerFetch"`
+
+	// The caption of the payload waiting for the account, if there is one. The payload itself is
+	// empty for a text beam.
+	Caption string `json:"caption,omitempty"`
+
+	// What that payload is, so the app knows what it is about to download: its kind, and the
+	// content type the sender declared, if any. For a Live Photo, this is the type of the still.
+	Kind        string `json:"kind,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+
+	// Profile of the peer, so an invitee can see who is asking before accepting. Left out for
+	// whoever asked, until the request is accepted.
+	Peer *ProfileResponse `json:"peer,omitempty"`
+}
+
+/**
+ * What an account shows to its peer. The avatar itself is loaded from /avatar; AvatarHash changes
+ * whenever it does, and is empty if there is none.
+ */
+type ProfileResponse struct {
+	AccountId   int    `json:"accountId"`
+	DisplayName string `json:"displayName"`
+	AvatarHash  string `json:"avatarHash"`
+
+	// Encrypt payloads for this account to this key. Nil if the account has none.
+	PublicKey *PublicKeyResponse `json:"publicKey,omitempty"`
+}
+
+/**
+ * A public key of an account. KeyId changes whenever the key does; send it along with payloads
+ * encrypted to the key.
+ */
+type PublicKeyResponse struct {
+	KeyId     string `json:"keyId"`
+	Algorithm string `json:"algorithm"`
+	Key       []byte `json:"key"`
 }
 
 /**
  * Represents the state of the account/login. Returned by some API calls.
+ *
+ * AuthKey is only included when a new key was issued (/register, /rotate-key).
  */
 type AccountResponse struct {
 	AccountId   int    `json:"accountId"`
 	ConnectCode string `json:"connectCode"`
-	AuthKey     string `json:"authKey"`
+	DisplayName string `json:"displayName"`
+	DeviceId    int    `json:"deviceId"`
+	AuthKey     string `json:"authKey,omitempty"`
+	PublicKeyId string `json:"publicKeyId,omitempty"`
+}
+
+/**
+ * A code the signed-in device shows, to be entered or scanned on a new device.
+ */
+type PairingResponse struct {
+	PairingCode string    `json:"pairingCode"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+/**
+ * One entry of the device list. Current is set for the device making the request.
+ */
+type DeviceResponse struct {
+	DeviceId     int       `json:"deviceId"`
+	Name         string    `json:"name"`
+	Platform     string    `json:"platform"`
+	HasPushToken bool      `json:"hasPushToken"`
+	AlertPushes  bool      `json:"alertPushes"`
+	TimeCreated  time.Time `json:"timeCreated"`
+	Current      bool      `json:"current"`
 }
 
 // Arguments for various kinds of API calls.
 
 type SetPropsArguments struct {
-	ApnsToken *string `json:"apnsToken"`
+	// These apply to the device making the request.
+	ApnsToken  *string `json:"apnsToken"`
+	DeviceName *string `json:"deviceName"`
+	Platform   *string `json:"platform"`
+	// Whether the user allowed notifications; the device then gets an alert with the caption for
+	// a new photo.
+	AlertPushes *bool `json:"alertPushes"`
+
+	// The profile of the account. The avatar is a base64 encoded JPEG or PNG; empty to remove it.
+	DisplayName *string `json:"displayName"`
+	Avatar      *[]byte `json:"avatar"`
+
+	// The public key peers encrypt payloads to, base64 encoded; empty to remove it. The algorithm
+	// is x25519 (32 bytes) or p256 (an uncompressed point, 65 bytes).
+	PublicKey          *[]byte `json:"publicKey"`
+	PublicKeyAlgorithm *string `json:"publicKeyAlgorithm"`
+}
+
+type AddDeviceArguments struct {
+	PairingCode string `json:"pairingCode"`
+	DeviceName  string `json:"deviceName"`
+	Platform    string `json:"platform"`
+}
+
+type RevokeDeviceArguments struct {
+	DeviceId int `json:"deviceId"`
 }
 
 type ConnectArguments struct {
@@ -37,3 +126,28 @@ type AcceptArguments struct {
 	// Set this to false to reject the connection request instead
 	Accept bool `json:"accept"`
 }
+
+type BlockArguments struct {
+	AccountId int `json:"accountId"`
+}
+
+type ReportArguments struct {
+	Reason string `json:"reason"`
+
+	// Also block the reported account
+	Block bool `json:"block"`
+}
+
+/**
+ * Returned with every error status. Code is one of a fixed set (see apierrors.go), and is what
+ * clients should look at; RequestId helps us find the request in our logs.
+ */
+type ErrorResponse struct {
+	Error ErrorDetails `json:"error"`
+}
+
+type ErrorDetails struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestId string `json:"requestId"`
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"os"
+	"strings"
+	"sync"
+)
+
+/**
+ * Encryption of payloads at rest, so that the photos are not readable to whoever gets hold of
+ * the database or a backup of it.
+ *
+ * Every payload is encrypted with a data key of its own. The data key is stored next to it,
+ * encrypted ("wrapped") with the master key, which only the server has. Rotating the master key
+ * then means re-wrapping the data keys, not re-encrypting the photos. Report snapshots share the
+ * data key of the payload they copy.
+ *
+ * Both use AES-256-GCM, with the nonce in front of the ciphertext.
+ */
+
+var (
+	ErrMasterKeyInvalid = errors.New("master key must be 32 bytes, base64 encoded")
+	ErrUnknownMasterKey = errors.New("data key is wrapped with a master key which is not configured")
+	ErrDataKeyInvalid   = errors.New("data key or payload could not be decrypted")
+)
+
+const masterKeyLength = 32
+
+type MasterKey struct {
+	// Stored with every data key it wraps; derived from the key, so the same key always has
+	// the same id.
+	Id  string
+	key []byte
+}
+
+/**
+ * Parse a key as written by `openssl rand -base64 32`.
+ */
+func ParseMasterKey(text string) (*MasterKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil || len(key) != masterKeyLength {
+		return nil, ErrMasterKeyInvalid
+	}
+	sum := sha256.Sum256(append([]byte("photobeam-master-key:"), key...))
+	return &MasterKey{Id: hex.EncodeToString(sum[:8]), key: key}, nil
+}
+
+func LoadMasterKey(path string) (*MasterKey, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseMasterKey(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+var masterKeys struct {
+	sync.RWMutex
+	// New payloads are encrypted with this one; without it, they are stored as they are.
+	current *MasterKey
+	// By id. Includes the current key, and those which may still wrap data keys.
+	all map[string]*MasterKey
+}
+
+/**
+ * Encrypt new payloads with current, and keep being able to read those of the previous keys
+ * until rotate-master-key re-wrapped them. Nil turns encryption at rest off, for new payloads.
+ */
+func ConfigureMasterKeys(current *MasterKey, previous []*MasterKey) {
+	masterKeys.Lock()
+	defer masterKeys.Unlock()
+	masterKeys.current = current
+	masterKeys.all = map[string]*MasterKey{}
+	for _, key := range append(previous, current) {
+		if key != nil {
+			masterKeys.all[key.Id] = key
+		}
+	}
+}
+
+func CurrentMasterKey() *MasterKey {
+	masterKeys.RLock()
+	defer masterKeys.RUnlock()
+	return masterKeys.current
+}
+
+func getMasterKey(id string) (*MasterKey, error) {
+	masterKeys.RLock()
+	defer masterKeys.RUnlock()
+	key, found := masterKeys.all[id]
+	if !found {
+		return nil, ErrUnknownMasterKey
+	}
+	return key, nil
+}
+
+func aesSeal(key []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func aesOpen(key []byte, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrDataKeyInvalid
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrDataKeyInvalid
+	}
+	return plaintext, nil
+}
+
+func unwrapDataKey(dataKey []byte, masterKeyId string) ([]byte, error) {
+	master, err := getMasterKey(masterKeyId)
+	if err != nil {
+		return nil, err
+	}
+	return aesOpen(master.key, dataKey)
+}
+
+/**
+ * Encrypt the parts in place with a new data key, and wrap that with the master key. Leaves them
+ * as they are if there is no master key, or nothing to encrypt. Empty parts stay empty.
+ */
+func sealParts(master *MasterKey, parts ...*[]byte) (dataKey []byte, masterKeyId string, err error) {
+	empty := true
+	for _, part := range parts {
+		empty = empty && len(*part) == 0
+	}
+	if master == nil || empty {
+		return nil, "", nil
+	}
+
+	key := make([]byte, 32)
+	if _, err = rand.Read(key); err != nil {
+		return nil, "", err
+	}
+	for _, part := range parts {
+		if len(*part) == 0 {
+			continue
+		}
+		if *part, err = aesSeal(key, *part); err != nil {
+			return nil, "", err
+		}
+	}
+	dataKey, err = aesSeal(master.key, key)
+	if err != nil {
+		return nil, "", err
+	}
+	return dataKey, master.Id, nil
+}
+
+// Decrypt the parts in place. Nothing to do if they were stored without a master key.
+func openParts(dataKey []byte, masterKeyId string, parts ...*[]byte) error {
+	if masterKeyId == "" {
+		return nil
+	}
+	key, err := unwrapDataKey(dataKey, masterKeyId)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if len(*part) == 0 {
+			continue
+		}
+		if *part, err = aesOpen(key, *part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * Bring the parts to the master key: wrap their data key with it, or encrypt them if they were
+ * stored before there was a master key.
+ */
+func resealParts(master *MasterKey, dataKey []byte, masterKeyId string, parts ...*[]byte) ([]byte, string, error) {
+	if masterKeyId == "" {
+		return sealParts(master, parts...)
+	}
+	key, err := unwrapDataKey(dataKey, masterKeyId)
+	if err != nil {
+		return nil, "", err
+	}
+	dataKey, err = aesSeal(master.key, key)
+	if err != nil {
+		return nil, "", err
+	}
+	return dataKey, master.Id, nil
+}
+
+// What of a payload is encrypted at rest, all with its data key.
+func (payload *Payload) sealedParts() []*[]byte {
+	return []*[]byte{&payload.Data, &payload.Caption, &payload.Video}
+}
+
+func (report *Report) sealedParts() []*[]byte {
+	return []*[]byte{&report.PayloadData, &report.PayloadCaption, &report.PayloadVideo}
+}
+
+/**
+ * Encrypt the payload with the current master key, if there is one, before it is stored.
+ */
+func SealPayload(payload *Payload) (err error) {
+	payload.DataKey, payload.MasterKeyId, err = sealParts(CurrentMasterKey(), payload.sealedParts()...)
+	return err
+}
+
+/**
+ * Decrypt a payload loaded from the store. Leaves it as it is if it was stored without
+ * encryption. Do not save the payload afterwards.
+ */
+func OpenPayload(payload *Payload) error {
+	err := openParts(payload.DataKey, payload.MasterKeyId, payload.sealedParts()...)
+	if err != nil {
+		return err
+	}
+	payload.DataKey, payload.MasterKeyId = nil, ""
+	return nil
+}
+
+/**
+ * The caption of a payload loaded from the store, without decrypting the rest.
+ */
+func PayloadCaption(payload *Payload) (string, error) {
+	caption := payload.Caption
+	err := openParts(payload.DataKey, payload.MasterKeyId, &caption)
+	return string(caption), err
+}
+
+/**
+ * Decrypt the payload snapshot of a report loaded from the store.
+ */
+func OpenReportPayload(report *Report) error {
+	err := openParts(report.PayloadDataKey, report.PayloadMasterKeyId, report.sealedParts()...)
+	if err != nil {
+		return err
+	}
+	report.PayloadDataKey, report.PayloadMasterKeyId = nil, ""
+	return nil
+}
+
+type MasterKeyRotation struct {
+	Payloads int `json:"payloads"`
+	Reports  int `json:"reports"`
+}
+
+// How many payloads or reports rotate-master-key loads at once.
+const rotationBatchSize = 100
+
+/**
+ * Re-wrap the data keys of all payloads and report snapshots with the current master key, and
+ * encrypt those stored before there was one. Safe while the server runs: what changed in the
+ * meantime is skipped, and picked up by the next batch if it still needs it.
+ */
+func RotateMasterKey(store Store) (*MasterKeyRotation, error) {
+	master := CurrentMasterKey()
+	if master == nil {
+		return nil, errors.New("no master key is configured to rotate to")
+	}
+
+	rotation := &MasterKeyRotation{}
+	for {
+		payloads, err := store.ListPayloadsToSeal(master.Id, rotationBatchSize)
+		if err != nil {
+			return rotation, err
+		}
+		if len(payloads) == 0 {
+			break
+		}
+		saved := 0
+		for _, payload := range payloads {
+			previous := payload.MasterKeyId
+			payload.DataKey, payload.MasterKeyId, err = resealParts(master, payload.DataKey, payload.MasterKeyId, payload.sealedParts()...)
+			if err != nil {
+				return rotation, fmt.Errorf("payload %d of connection %d: %w", payload.FromId, payload.ConnectionId, err)
+			}
+			ok, err := store.ResealPayload(&payload, previous)
+			if err != nil {
+				return rotation, err
+			}
+			if ok {
+				saved++
+			}
+		}
+		if saved == 0 {
+			return rotation, errors.New("payloads keep changing under the rotation, try again")
+		}
+		rotation.Payloads += saved
+	}
+
+	for {
+		reports, err := store.ListReportsToSeal(master.Id, rotationBatchSize)
+		if err != nil {
+			return rotation, err
+		}
+		if len(reports) == 0 {
+			break
+		}
+		saved := 0
+		for _, report := range reports {
+			previous := report.PayloadMasterKeyId
+			report.PayloadDataKey, report.PayloadMasterKeyId, err = resealParts(master,
+				report.PayloadDataKey, report.PayloadMasterKeyId, report.sealedParts()...)
+			if err != nil {
+				return rotation, fmt.Errorf("report %d: %w", report.Id, err)
+			}
+			ok, err := store.ResealReport(&report, previous)
+			if err != nil {
+				return rotation, err
+			}
+			if ok {
+				saved++
+			}
+		}
+		if saved == 0 {
+			return rotation, errors.New("reports keep changing under the rotation, try again")
+		}
+		rotation.Reports += saved
+	}
+	return rotation, nil
+}
+
+// From --master-key or --master-key-file, and --previous-master-key-file.
+func configureMasterKeysFromFlags(c *cli.Context) error {
+	var current *MasterKey
+	var err error
+	switch {
+	case c.String("master-key") != "" && c.String("master-key-file") != "":
+		return errors.New("set either --master-key or --master-key-file")
+	case c.String("master-key") != "":
+		current, err = ParseMasterKey(c.String("master-key"))
+	case c.String("master-key-file") != "":
+		current, err = LoadMasterKey(c.String("master-key-file"))
+	}
+	if err != nil {
+		return err
+	}
+
+	var previous []*MasterKey
+	for _, path := range c.StringSlice("previous-master-key-file") {
+		key, err := LoadMasterKey(path)
+		if err != nil {
+			return err
+		}
+		previous = append(previous, key)
+	}
+	if current == nil && len(previous) > 0 {
+		return errors.New("--previous-master-key-file needs a current master key")
+	}
+	ConfigureMasterKeys(current, previous)
+	return nil
+}
+
+/**
+ * The second half of changing the master key, after the server was restarted with the new one
+ * and the old one as a previous key. Once this is done, the old key can go.
+ */
+var rotateMasterKeyCommand = &cli.Command{
+	Name:  "rotate-master-key",
+	Usage: "re-wrap the data keys of all payloads with the master key, and encrypt those stored without one",
+	Flags: []cli.Flag{jsonFlag},
+	Action: func(c *cli.Context) error {
+		store := OpenStore()
+		defer store.Close()
+		rotation, err := RotateMasterKey(store)
+		if err != nil {
+			// What was saved stays re-wrapped; running the command again picks up the rest.
+			if rotation != nil {
+				fmt.Fprintf(os.Stderr, "Stopped after re-wrapping %d payloads and %d report snapshots, the rotation is incomplete.\n",
+					rotation.Payloads, rotation.Reports)
+			}
+			return err
+		}
+		if c.Bool("json") {
+			return printJSON(rotation)
+		}
+		fmt.Printf("Re-wrapped %d payloads and %d report snapshots with master key %s.\n",
+			rotation.Payloads, rotation.Reports, CurrentMasterKey().Id)
+		return nil
+	},
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// Work which outlives the request that started it. Shutdown waits for it.
+var backgroundWork sync.WaitGroup
+
+/**
+ * Run fn after the response was sent, e.g. a push which the client does not need to wait for.
+ * fn gets a context which keeps the values of ctx (so it logs with the request id) but is not
+ * cancelled when the request ends.
+ */
+func RunInBackground(ctx context.Context, name string, fn func(ctx context.Context)) {
+	ctx = context.WithoutCancel(ctx)
+	backgroundWork.Add(1)
+	go func() {
+		defer backgroundWork.Done()
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				Logger(ctx).Error("panic in background work",
+					"work", name, "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+			}
+		}()
+		fn(ctx)
+	}()
+}
+
+/**
+ * Wait until all background work is done, or ctx ends.
+ */
+func WaitForBackground(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		backgroundWork.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,446 @@
+/**
+ * Package client talks to the v1 API of a photobeam server, as described by its openapi.json.
+ * Used by the integration tests and by bots; the apps have their own implementations.
+ */
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type Client struct {
+	// Where the server is, e.g. "https://beam.example.com". The /v1 prefix is added by the client.
+	BaseURL string
+
+	// The auth key of the device. Register and AddDevice set it, as does RotateKey.
+	AuthKey string
+
+	HTTPClient *http.Client
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+/**
+ * An error response from the server. Code is stable, see the OpenAPI document for the list.
+ */
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestId  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d): %s [request %s]", e.Code, e.StatusCode, e.Message, e.RequestId)
+}
+
+/**
+ * Returns the API error code if err came from the server, or "" otherwise.
+ */
+func ErrorCode(err error) string {
+	if apiErr, ok := err.(*Error); ok {
+		return apiErr.Code
+	}
+	return ""
+}
+
+func (c *Client) Register(ctx context.Context) (*AccountResponse, error) {
+	response := new(AccountResponse)
+	err := c.doJSON(ctx, http.MethodPost, "/register", nil, response)
+	if err != nil {
+		return nil, err
+	}
+	c.AuthKey = response.AuthKey
+	return response, nil
+}
+
+func (c *Client) SetProps(ctx context.Context, args SetPropsArguments) (*AccountResponse, error) {
+	response := new(AccountResponse)
+	err := c.doJSON(ctx, http.MethodPost, "/setprops", args, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *Client) Avatar(ctx context.Context, accountId int) ([]byte, error) {
+	return c.doRaw(ctx, http.MethodGet, "/avatar?accountId="+strconv.Itoa(accountId), nil)
+}
+
+func (c *Client) RotateKey(ctx context.Context) (*AccountResponse, error) {
+	response := new(AccountResponse)
+	err := c.doJSON(ctx, http.MethodPost, "/rotate-key", nil, response)
+	if err != nil {
+		return nil, err
+	}
+	c.AuthKey = response.AuthKey
+	return response, nil
+}
+
+func (c *Client) Devices(ctx context.Context) ([]DeviceResponse, error) {
+	var response []DeviceResponse
+	err := c.doJSON(ctx, http.MethodGet, "/devices", nil, &response)
+	return response, err
+}
+
+func (c *Client) PairDevice(ctx context.Context) (*PairingResponse, error) {
+	response := new(PairingResponse)
+	err := c.doJSON(ctx, http.MethodPost, "/devices/pair", nil, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *Client) AddDevice(ctx context.Context, args AddDeviceArguments) (*AccountResponse, error) {
+	response := new(AccountResponse)
+	err := c.doJSON(ctx, http.MethodPost, "/devices/add", args, response)
+	if err != nil {
+		return nil, err
+	}
+	c.AuthKey = response.AuthKey
+	return response, nil
+}
+
+func (c *Client) RevokeDevice(ctx context.Context, deviceId int) error {
+	return c.doJSON(ctx, http.MethodPost, "/devices/revoke", RevokeDeviceArguments{DeviceId: deviceId}, nil)
+}
+
+func (c *Client) Connect(ctx context.Context, connectCode string) (*StateResponse, error) {
+	return c.doState(ctx, http.MethodPost, "/connect", ConnectArguments{ConnectCode: connectCode})
+}
+
+func (c *Client) Disconnect(ctx context.Context) (*StateResponse, error) {
+	return c.doState(ctx, http.MethodPost, "/disconnect", nil)
+}
+
+func (c *Client) Query(ctx context.Context) (*StateResponse, error) {
+	return c.doState(ctx, http.MethodGet, "/query", nil)
+}
+
+func (c *Client) Accept(ctx context.Context, peerId int) (*StateResponse, error) {
+	return c.doState(ctx, http.MethodPost, "/accept", AcceptArguments{PeerId: peerId, Accept: true})
+}
+
+/**
+ * How a payload was encrypted to the public key of the peer. The zero value means it was not.
+ */
+type Encryption struct {
+	KeyId     string
+	Algorithm string
+	Nonce     []byte
+}
+
+// The headers which carry Encryption, the caption and the kind on /set and /get.
+const (
+	HeaderKeyId     = "X-Photobeam-Key-Id"
+	HeaderAlgorithm = "X-Photobeam-Algorithm"
+	HeaderNonce     = "X-Photobeam-Nonce"
+	HeaderCaption   = "X-Photobeam-Caption"
+	HeaderKind      = "X-Photobeam-Kind"
+)
+
+// The kinds of beams, see Beam.Kind.
+const (
+	KindPhoto     = "photo"
+	KindAnimation = "animation"
+	KindVideo     = "video"
+	KindLivePhoto = "livePhoto"
+	KindText      = "text"
+)
+
+/**
+ * What one peer sends the other: a photo, a caption, or both. A beam with only a caption is a
+ * text beam. The caption is not encrypted along with Data.
+ */
+type Beam struct {
+	Data    []byte
+	Caption string
+
+	// One of the kinds above; the server guesses it from the rest if it is empty. ContentType is
+	// the MIME type of Data, if known.
+	Kind        string
+	ContentType string
+
+	// The video of a Live Photo, Data being its still.
+	Video            []byte
+	VideoContentType string
+
+	Encryption Encryption
+}
+
+/**
+ * Upload a photo for the peer.
+ */
+func (c *Client) Set(ctx context.Context, data []byte) (*StateResponse, error) {
+	return c.SetBeam(ctx, Beam{Data: data})
+}
+
+/**
+ * Upload a photo which was encrypted to the public key of the peer (see StateResponse.Peer).
+ * Fails with stale_public_key if the peer has a different key by now.
+ */
+func (c *Client) SetEncrypted(ctx context.Context, data []byte, encryption Encryption) (*StateResponse, error) {
+	return c.SetBeam(ctx, Beam{Data: data, Encryption: encryption})
+}
+
+func (c *Client) SetBeam(ctx context.Context, beam Beam) (*StateResponse, error) {
+	header := http.Header{}
+	if beam.Caption != "" {
+		header.Set(HeaderCaption, url.PathEscape(beam.Caption))
+	}
+	if beam.Encryption.KeyId != "" {
+		header.Set(HeaderKeyId, beam.Encryption.KeyId)
+		header.Set(HeaderAlgorithm, beam.Encryption.Algorithm)
+	}
+	if len(beam.Encryption.Nonce) > 0 {
+		header.Set(HeaderNonce, base64.StdEncoding.EncodeToString(beam.Encryption.Nonce))
+	}
+	if beam.Kind != "" {
+		header.Set(HeaderKind, beam.Kind)
+	}
+
+	// Two files need a multipart form; one goes as the body.
+	data := beam.Data
+	if len(beam.Video) > 0 {
+		var form bytes.Buffer
+		writer := multipart.NewWriter(&form)
+		err := writeFormFile(writer, "file", beam.ContentType, beam.Data)
+		if err == nil {
+			err = writeFormFile(writer, "video", beam.VideoContentType, beam.Video)
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = form.Bytes()
+		header.Set("Content-Type", writer.FormDataContentType())
+	} else if beam.ContentType != "" {
+		header.Set("Content-Type", beam.ContentType)
+	}
+
+	response := new(StateResponse)
+	body, _, err := c.do(ctx, http.MethodPost, "/set", data, header)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(body, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+/**
+ * Download the photo the peer sent. Call Clear once it is stored safely.
+ */
+func (c *Client) Get(ctx context.Context) ([]byte, error) {
+	beam, err := c.GetBeam(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return beam.Data, nil
+}
+
+/**
+ * Like Get, along with how the peer encrypted the photo.
+ */
+func (c *Client) GetEncrypted(ctx context.Context) ([]byte, Encryption, error) {
+	beam, err := c.GetBeam(ctx)
+	if err != nil {
+		return nil, Encryption{}, err
+	}
+	return beam.Data, beam.Encryption, nil
+}
+
+func (c *Client) GetBeam(ctx context.Context) (*Beam, error) {
+	data, header, err := c.do(ctx, http.MethodGet, "/get", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	beam := &Beam{
+		Data: data,
+		Kind: header.Get(HeaderKind),
+		Encryption: Encryption{
+			KeyId:     header.Get(HeaderKeyId),
+			Algorithm: header.Get(HeaderAlgorithm),
+		},
+	}
+	beam.ContentType = declaredContentType(header)
+	if beam.Kind == KindLivePhoto {
+		beam.Video, header, err = c.do(ctx, http.MethodGet, "/get/video", nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		beam.VideoContentType = declaredContentType(header)
+	}
+	if caption := header.Get(HeaderCaption); caption != "" {
+		beam.Caption, err = url.PathUnescape(caption)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if nonce := header.Get(HeaderNonce); nonce != "" {
+		beam.Encryption.Nonce, err = base64.StdEncoding.DecodeString(nonce)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return beam, nil
+}
+
+func writeFormFile(writer *multipart.Writer, name string, contentType string, data []byte) error {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, name, name))
+	header.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(data)
+	return err
+}
+
+// The server answers with application/octet-stream if the sender did not say what it sent.
+func declaredContentType(header http.Header) string {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mediaType == "application/octet-stream" {
+		return ""
+	}
+	return mediaType
+}
+
+func (c *Client) Clear(ctx context.Context) (*StateResponse, error) {
+	return c.doState(ctx, http.MethodPost, "/clear", nil)
+}
+
+func (c *Client) Block(ctx context.Context, accountId int) (*StateResponse, error) {
+	return c.doState(ctx, http.MethodPost, "/block", BlockArguments{AccountId: accountId})
+}
+
+func (c *Client) Unblock(ctx context.Context, accountId int) (*StateResponse, error) {
+	return c.doState(ctx, http.MethodPost, "/unblock", BlockArguments{AccountId: accountId})
+}
+
+func (c *Client) Report(ctx context.Context, args ReportArguments) (*StateResponse, error) {
+	return c.doState(ctx, http.MethodPost, "/report", args)
+}
+
+func (c *Client) DeleteAccount(ctx context.Context) error {
+	return c.doJSON(ctx, http.MethodPost, "/delete-account", nil, nil)
+}
+
+/**
+ * Download the data export of the account, a zip archive.
+ */
+func (c *Client) Export(ctx context.Context) ([]byte, error) {
+	return c.doRaw(ctx, http.MethodGet, "/export", nil)
+}
+
+func (c *Client) doState(ctx context.Context, method string, path string, args interface{}) (*StateResponse, error) {
+	response := new(StateResponse)
+	err := c.doJSON(ctx, method, path, args, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+/**
+ * Send args as JSON (if not nil), and decode the response into response (if not nil).
+ */
+func (c *Client) doJSON(ctx context.Context, method string, path string, args interface{}, response interface{}) error {
+	var body []byte
+	if args != nil {
+		var err error
+		body, err = json.Marshal(args)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := c.doRaw(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(data, response)
+}
+
+func (c *Client) doRaw(ctx context.Context, method string, path string, body []byte) ([]byte, error) {
+	data, _, err := c.do(ctx, method, path, body, nil)
+	return data, err
+}
+
+/**
+ * Send the request with the extra headers, and return the body and headers of the response.
+ */
+func (c *Client) do(ctx context.Context, method string, path string, body []byte, header http.Header) ([]byte, http.Header, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, c.BaseURL+"/v1"+path, reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if c.AuthKey != "" {
+		req.Header.Set("Authorization", c.AuthKey)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if res.StatusCode >= 400 {
+		apiErr := &Error{StatusCode: res.StatusCode, Code: "unknown", Message: http.StatusText(res.StatusCode)}
+		var errorResponse ErrorResponse
+		if json.Unmarshal(data, &errorResponse) == nil && errorResponse.Error.Code != "" {
+			apiErr.Code = errorResponse.Error.Code
+			apiErr.Message = errorResponse.Error.Message
+			apiErr.RequestId = errorResponse.Error.RequestId
+		}
+		return nil, nil, apiErr
+	}
+	return data, res.Header, nil
+}
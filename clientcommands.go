@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/miracle2k/photobeam-server/client"
+	"github.com/urfave/cli/v2"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+/**
+ * What `client register` stores, so the other client commands can act as that device.
+ */
+type ClientCredentials struct {
+	Server      string `json:"server"`
+	AccountId   int    `json:"accountId"`
+	DeviceId    int    `json:"deviceId"`
+	ConnectCode string `json:"connectCode"`
+	AuthKey     string `json:"authKey"`
+}
+
+func defaultCredentialsPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "photobeam-client.json"
+	}
+	return filepath.Join(dir, "photobeam", "client.json")
+}
+
+func readCredentials(c *cli.Context) (*ClientCredentials, error) {
+	data, err := ioutil.ReadFile(c.String("credentials"))
+	if os.IsNotExist(err) {
+		return nil, errors.New("no credentials found, run `client register` first")
+	}
+	if err != nil {
+		return nil, err
+	}
+	credentials := new(ClientCredentials)
+	err = json.Unmarshal(data, credentials)
+	return credentials, err
+}
+
+func writeCredentials(c *cli.Context, credentials *ClientCredentials) error {
+	path := c.String("credentials")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(credentials, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+/**
+ * An API client for the stored credentials. The --server flag wins over the stored server.
+ */
+func apiClient(c *cli.Context) (*client.Client, error) {
+	credentials, err := readCredentials(c)
+	if err != nil {
+		return nil, err
+	}
+	server := credentials.Server
+	if c.IsSet("server") || server == "" {
+		server = c.String("server")
+	}
+	api := client.New(server)
+	api.AuthKey = credentials.AuthKey
+	return api, nil
+}
+
+func printState(c *cli.Context, state *client.StateResponse) error {
+	if c.Bool("json") {
+		return json.NewEncoder(os.Stdout).Encode(state)
+	}
+
+	switch state.Status {
+	case "":
+		fmt.Println("Not connected.")
+		return nil
+	case "pendingWithMe":
+		fmt.Printf("Account %d wants to connect, run `client accept`.\n", state.PeerId)
+	case "pendingWithPeer":
+		fmt.Printf("Waiting for account %d to accept.\n", state.PeerId)
+	default:
+		fmt.Printf("Connected to account %d.\n", state.PeerId)
+	}
+	if state.Peer != nil && state.Peer.DisplayName != "" {
+		fmt.Printf("  Peer name: %s\n", state.Peer.DisplayName)
+	}
+	if state.ShouldFetch {
+		fmt.Println("  There is a photo for you, run `client fetch`.")
+	}
+	if state.Kind != "" && state.ContentType != "" {
+		fmt.Printf("  Kind: %s (%s)\n", state.Kind, state.ContentType)
+	} else if state.Kind != "" {
+		fmt.Printf("  Kind: %s\n", state.Kind)
+	}
+	if state.Caption != "" {
+		fmt.Printf("  Caption: %s\n", state.Caption)
+	}
+	if state.ShouldPeerFetch {
+		fmt.Println("  Your peer has not fetched your last photo yet.")
+	}
+	return nil
+}
+
+/**
+ * Talks to a server like the apps do, for QA and for scripting things like a desk photo frame.
+ */
+var clientCommand = &cli.Command{
+	Name:  "client",
+	Usage: "act as a client of a photobeam server",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "server",
+			Value:   "http://localhost:10000",
+			EnvVars: []string{"PHOTOBEAM_SERVER"},
+			Usage:   "URL of the server",
+		},
+		&cli.StringFlag{
+			Name:      "credentials",
+			Value:     defaultCredentialsPath(),
+			EnvVars:   []string{"PHOTOBEAM_CREDENTIALS"},
+			TakesFile: true,
+			Usage:     "where to store the account credentials",
+		},
+		&cli.BoolFlag{Name: "json", Usage: "print responses as JSON"},
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:  "register",
+			Usage: "create a new account and store its credentials",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "force", Usage: "replace existing credentials"},
+			},
+			Action: func(c *cli.Context) error {
+				if _, err := os.Stat(c.String("credentials")); err == nil && !c.Bool("force") {
+					return fmt.Errorf("%s already exists, use --force to replace it", c.String("credentials"))
+				}
+
+				api := client.New(c.String("server"))
+				account, err := api.Register(context.Background())
+				if err != nil {
+					return err
+				}
+				err = writeCredentials(c, &ClientCredentials{
+					Server:      c.String("server"),
+					AccountId:   account.AccountId,
+					DeviceId:    account.DeviceId,
+					ConnectCode: account.ConnectCode,
+					AuthKey:     account.AuthKey,
+				})
+				if err != nil {
+					return err
+				}
+
+				if c.Bool("json") {
+					account.AuthKey = ""
+					return json.NewEncoder(os.Stdout).Encode(account)
+				}
+				fmt.Printf("Registered account %d, connect code: %s\n", account.AccountId, account.ConnectCode)
+				return nil
+			},
+		},
+		{
+			Name:      "connect",
+			Usage:     "ask the account with this connect code to connect",
+			ArgsUsage: "<code>",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return errors.New("expected a connect code")
+				}
+				api, err := apiClient(c)
+				if err != nil {
+					return err
+				}
+				state, err := api.Connect(context.Background(), c.Args().First())
+				if err != nil {
+					return err
+				}
+				return printState(c, state)
+			},
+		},
+		{
+			Name:      "accept",
+			Usage:     "accept the pending connection request",
+			ArgsUsage: "[peer account id]",
+			Action: func(c *cli.Context) error {
+				api, err := apiClient(c)
+				if err != nil {
+					return err
+				}
+
+				var peerId int
+				if c.NArg() > 0 {
+					peerId, err = strconv.Atoi(c.Args().First())
+					if err != nil {
+						return fmt.Errorf("invalid account id: %s", c.Args().First())
+					}
+				} else {
+					state, err := api.Query(context.Background())
+					if err != nil {
+						return err
+					}
+					if state.Status != "pendingWithMe" {
+						return errors.New("there is no pending request")
+					}
+					peerId = state.PeerId
+				}
+
+				state, err := api.Accept(context.Background(), peerId)
+				if err != nil {
+					return err
+				}
+				return printState(c, state)
+			},
+		},
+		{
+			Name:      "send",
+			Usage:     "send a photo, animation, video or Live Photo to the peer, or with only --caption a text beam",
+			ArgsUsage: "<file, or - for stdin>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "caption", Usage: "text to send with the photo"},
+				&cli.StringFlag{Name: "kind", Usage: "photo, animation, video or livePhoto (default: guessed by the server)"},
+				&cli.StringFlag{Name: "video", TakesFile: true, Usage: "the video of a Live Photo, the file being its still"},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() > 1 || c.NArg() == 0 && c.String("caption") == "" {
+					return errors.New("expected a file, or a caption")
+				}
+				var data []byte
+				var err error
+				if c.Args().First() == "-" {
+					data, err = ioutil.ReadAll(os.Stdin)
+				} else if c.NArg() == 1 {
+					data, err = ioutil.ReadFile(c.Args().First())
+				}
+				if err != nil {
+					return err
+				}
+				beam := client.Beam{
+					Data:        data,
+					Caption:     c.String("caption"),
+					Kind:        c.String("kind"),
+					ContentType: mime.TypeByExtension(filepath.Ext(c.Args().First())),
+				}
+				if video := c.String("video"); video != "" {
+					beam.Video, err = ioutil.ReadFile(video)
+					if err != nil {
+						return err
+					}
+					beam.VideoContentType = mime.TypeByExtension(filepath.Ext(video))
+				}
+
+				api, err := apiClient(c)
+				if err != nil {
+					return err
+				}
+				state, err := api.SetBeam(context.Background(), beam)
+				if err != nil {
+					return err
+				}
+				return printState(c, state)
+			},
+		},
+		{
+			Name:  "fetch",
+			Usage: "download the photo the peer sent, and clear it on the server",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "out", TakesFile: true, Usage: "file to write to (default: stdout)"},
+				&cli.BoolFlag{Name: "wait", Usage: "wait until there is a photo"},
+				&cli.DurationFlag{Name: "interval", Value: 30 * time.Second, Usage: "how often to check with --wait"},
+				&cli.BoolFlag{Name: "keep", Usage: "do not clear the photo on the server"},
+				&cli.StringFlag{Name: "video-out", TakesFile: true, Usage: "file to write the video of a Live Photo to"},
+			},
+			Action: func(c *cli.Context) error {
+				api, err := apiClient(c)
+				if err != nil {
+					return err
+				}
+				ctx := context.Background()
+
+				for c.Bool("wait") {
+					state, err := api.Query(ctx)
+					if err != nil {
+						return err
+					}
+					if state.ShouldFetch {
+						break
+					}
+					time.Sleep(c.Duration("interval"))
+				}
+
+				beam, err := api.GetBeam(ctx)
+				if err != nil {
+					return err
+				}
+				// Keeps stdout for the photo.
+				if beam.Caption != "" {
+					fmt.Fprintf(os.Stderr, "Caption: %s\n", beam.Caption)
+				}
+				if out := c.String("out"); out != "" && len(beam.Data) > 0 {
+					err = ioutil.WriteFile(out, beam.Data, 0644)
+				} else {
+					_, err = os.Stdout.Write(beam.Data)
+				}
+				if err != nil {
+					return err
+				}
+				if len(beam.Video) > 0 {
+					if out := c.String("video-out"); out != "" {
+						err = ioutil.WriteFile(out, beam.Video, 0644)
+					} else {
+						fmt.Fprintln(os.Stderr, "This is a Live Photo; pass --video-out to keep its video.")
+					}
+					if err != nil {
+						return err
+					}
+				}
+
+				if !c.Bool("keep") {
+					_, err = api.Clear(ctx)
+				}
+				return err
+			},
+		},
+		{
+			Name:  "status",
+			Usage: "show the connection state",
+			Action: func(c *cli.Context) error {
+				api, err := apiClient(c)
+				if err != nil {
+					return err
+				}
+				state, err := api.Query(context.Background())
+				if err != nil {
+					return err
+				}
+				return printState(c, state)
+			},
+		},
+	},
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"github.com/go-pg/pg/v10"
 	"github.com/go-pg/pg/v10/orm"
-	"github.com/go-pg/pg/v10/pgext"
 	"time"
 )
 
@@ -11,10 +11,64 @@ const PENDING = "pending";
 
 type Account struct {
 	Id          int
-	Key         string
-	ApnsToken   string
 	ConnectCode string
+	DisplayName string
 	TimeCreated string
+
+	// What peers encrypt payloads to, if the app supports it. Only the app has the private key.
+	// PublicKeyId changes with the key, so peers can tell when to fetch the new one.
+	PublicKey          []byte
+	PublicKeyAlgorithm string
+	PublicKeyId        string
+}
+
+/**
+ * Profile picture of an account, shown to its peer. Kept out of the accounts table so we do not
+ * load it with every request.
+ */
+type Avatar struct {
+	AccountId   int `pg:",pk"`
+	Data        []byte
+	ContentType string
+	Hash        string // Lets clients cache the image
+	TimeUpdated time.Time
+}
+
+/**
+ * A phone or tablet signed in to an account. Each device has its own credentials and push token.
+ */
+type Device struct {
+	Id        int
+	AccountId int
+	Name      string
+	Platform  string // ios
+
+	// We only store a hash of the auth key. The first few characters are kept in the clear, so we
+	// can look up the device for a key without comparing it against every row.
+	KeyPrefix string
+	KeyHash   string
+
+	PushToken   string
+	TimeCreated time.Time
+
+	// The user allowed notifications on this device, so it gets an alert for a new photo instead
+	// of a background push only.
+	AlertPushes bool
+
+	// The plaintext auth key, only known right after it was generated.
+	Key string `pg:"-"`
+}
+
+const PLATFORM_IOS = "ios"
+
+/**
+ * A short-lived code shown by a device that is already signed in, which a new device can redeem
+ * to join the same account.
+ */
+type DevicePairing struct {
+	Code        string `pg:",pk"`
+	AccountId   int
+	TimeExpires time.Time
 }
 
 type Connection struct {
@@ -42,22 +96,333 @@ type Payload struct {
 	// We store the photo itself here, but only because it is basically a temporary storage. It will
 	// be cleared out as soon as the image is fetched. Just make sure you do ExcludeColumn().
 	Data []byte
+
+	// Text sent with the photo, or instead of it, as UTF-8. Bytes only so it can be encrypted at
+	// rest along with Data.
+	Caption []byte
+
+	// What Data is, see payloadKind, and its MIME type as the sender declared it. Empty for
+	// payloads from before there were kinds, which are all photos.
+	Kind        string
+	ContentType string
+
+	// The video of a Live Photo, Data being its still.
+	Video            []byte
+	VideoContentType string
+
+	// Set if the sender encrypted Data to the public key of the peer, which then only passes it on.
+	// KeyId is the PublicKeyId the sender used; the algorithm and nonce mean something to the apps.
+	KeyId     string
+	Algorithm string
+	Nonce     []byte
+
+	// Set if the server encrypted Data at rest: the data key, wrapped with the master key of this
+	// id. See SealPayload.
+	DataKey     []byte
+	MasterKeyId string
+}
+
+/**
+ * BlockerId does not want to hear from BlockedId anymore: no connection requests, no payloads.
+ */
+type Block struct {
+	BlockerId   int `pg:",pk"`
+	BlockedId   int `pg:",pk"`
+	TimeCreated time.Time
+}
+
+/**
+ * An abuse report filed by one account against its peer. We snapshot the connection and the
+ * payload as they were at the time of the report, so moderators can review them even after
+ * the users have moved on.
+ */
+type Report struct {
+	Id         int
+	ReporterId int
+	ReportedId int
+	Reason     string
+
+	ConnectionId          int
+	ConnectionInitiatorId int
+	ConnectionInviteeId   int
+	ConnectionStatus      string
+
+	// Copy of the payload the reported account sent, if it was still available.
+	PayloadData        []byte
+	PayloadCaption     []byte
+	PayloadTimeCreated pg.NullTime
+	// See Payload.
+	PayloadKind             string
+	PayloadContentType      string
+	PayloadVideo            []byte
+	PayloadVideoContentType string
+	// The data key of the payload, if it was encrypted at rest.
+	PayloadDataKey     []byte
+	PayloadMasterKeyId string
+
+	TimeCreated  time.Time
+	TimeResolved pg.NullTime
 }
 
-// Do createdb & dropdb for a full reset
+/**
+ * Counts of what happened on a day, for the admin dashboard. We do not keep the payloads or
+ * connections themselves around for long enough to count them later.
+ */
+type DailyActivity struct {
+	Day           time.Time `pg:",pk,type:date"`
+	Registrations int
+	Connections   int
+	Beams         int
+}
+
+type SchemaMigration struct {
+	Version     int `pg:",pk"`
+	TimeApplied time.Time
+}
+
+/**
+ * Changes to deployed databases, from the schema the first release created (accounts, connections
+ * and payloads) on. A fresh database is created from the models instead, and starts out with all of
+ * these applied; so a migration must not depend on the models, and creates the tables it introduces
+ * itself, as they were then. Every statement is safe to run on a database which already has what it
+ * adds, as those created from the models before the migration was written do. Only ever append to
+ * this list.
+ */
+var migrations = []func(tx *pg.Tx) error{
+	// 1: Replace the plaintext auth keys with hashes; and blocks and reports, which came just before.
+	func(tx *pg.Tx) error {
+		err := execAll(tx,
+			`CREATE TABLE IF NOT EXISTS blocks (blocker_id bigint, blocked_id bigint, time_created timestamptz,
+				PRIMARY KEY (blocker_id, blocked_id))`,
+			`CREATE TABLE IF NOT EXISTS reports (id bigserial PRIMARY KEY, reporter_id bigint, reported_id bigint, reason text,
+				connection_id bigint, connection_initiator_id bigint, connection_invitee_id bigint, connection_status text,
+				payload_data bytea, payload_time_created timestamptz, time_created timestamptz, time_resolved timestamptz)`,
+			`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS key_prefix text, ADD COLUMN IF NOT EXISTS key_hash text`,
+		)
+		if err != nil {
+			return err
+		}
+
+		var accounts []struct {
+			Id  int
+			Key string
+		}
+		_, err = tx.Query(&accounts, `SELECT id, key FROM accounts WHERE key IS NOT NULL`)
+		if err != nil {
+			return err
+		}
+		for _, account := range accounts {
+			_, err = tx.Exec(`UPDATE accounts SET key_prefix = ?, key_hash = ? WHERE id = ?`,
+				AuthKeyPrefix(account.Key), HashAuthKey(account.Key), account.Id)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(`ALTER TABLE accounts DROP COLUMN IF EXISTS key`)
+		return err
+	},
+
+	// 2: Move the credentials and push token of each account to its first device.
+	func(tx *pg.Tx) error {
+		err := execAll(tx,
+			`CREATE TABLE IF NOT EXISTS devices (id bigserial PRIMARY KEY, account_id bigint, name text, platform text,
+				key_prefix text, key_hash text, push_token text, time_created timestamptz)`,
+			`CREATE TABLE IF NOT EXISTS device_pairings (code text PRIMARY KEY, account_id bigint, time_expires timestamptz)`,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO devices (account_id, platform, key_prefix, key_hash, push_token, time_created)
+			SELECT id, ?, key_prefix, key_hash, apns_token, now() FROM accounts WHERE key_hash IS NOT NULL`,
+			PLATFORM_IOS)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`ALTER TABLE accounts DROP COLUMN IF EXISTS key_prefix, DROP COLUMN IF EXISTS key_hash, DROP COLUMN IF EXISTS apns_token`)
+		return err
+	},
+
+	// 3: Profiles.
+	func(tx *pg.Tx) error {
+		return execAll(tx,
+			`CREATE TABLE IF NOT EXISTS avatars (account_id bigserial PRIMARY KEY, data bytea, content_type text, hash text,
+				time_updated timestamptz)`,
+			`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS display_name text`,
+		)
+	},
+
+	// 4: Public keys, and payloads encrypted to them.
+	func(tx *pg.Tx) error {
+		return execAll(tx,
+			`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS public_key bytea, ADD COLUMN IF NOT EXISTS public_key_algorithm text,
+				ADD COLUMN IF NOT EXISTS public_key_id text`,
+			`ALTER TABLE payloads ADD COLUMN IF NOT EXISTS key_id text, ADD COLUMN IF NOT EXISTS algorithm text,
+				ADD COLUMN IF NOT EXISTS nonce bytea`,
+		)
+	},
+
+	// 5: Encryption at rest.
+	func(tx *pg.Tx) error {
+		return execAll(tx,
+			`ALTER TABLE payloads ADD COLUMN IF NOT EXISTS data_key bytea, ADD COLUMN IF NOT EXISTS master_key_id text`,
+			`ALTER TABLE reports ADD COLUMN IF NOT EXISTS payload_data_key bytea, ADD COLUMN IF NOT EXISTS payload_master_key_id text`,
+		)
+	},
+
+	// 6: The daily activity, which databases from before it got from the models.
+	func(tx *pg.Tx) error {
+		return execAll(tx,
+			`CREATE TABLE IF NOT EXISTS daily_activities (day date PRIMARY KEY, registrations bigint, connections bigint,
+				beams bigint)`,
+		)
+	},
+
+	// 7: Captions, and alert pushes.
+	func(tx *pg.Tx) error {
+		return execAll(tx,
+			`ALTER TABLE payloads ADD COLUMN IF NOT EXISTS caption bytea`,
+			`ALTER TABLE reports ADD COLUMN IF NOT EXISTS payload_caption bytea`,
+			`ALTER TABLE devices ADD COLUMN IF NOT EXISTS alert_pushes boolean`,
+		)
+	},
+
+	// 8: Payload kinds, and the video of Live Photos.
+	func(tx *pg.Tx) error {
+		return execAll(tx,
+			`ALTER TABLE payloads ADD COLUMN IF NOT EXISTS kind text, ADD COLUMN IF NOT EXISTS content_type text,
+				ADD COLUMN IF NOT EXISTS video bytea, ADD COLUMN IF NOT EXISTS video_content_type text`,
+		)
+	},
+
+	// 9: The kind and video of reported payloads.
+	func(tx *pg.Tx) error {
+		return execAll(tx,
+			`ALTER TABLE reports ADD COLUMN IF NOT EXISTS payload_kind text, ADD COLUMN IF NOT EXISTS payload_content_type text,
+				ADD COLUMN IF NOT EXISTS payload_video bytea, ADD COLUMN IF NOT EXISTS payload_video_content_type text`,
+		)
+	},
+
+	// 10: Payloads which leaving a connection used to leave behind.
+	func(tx *pg.Tx) error {
+		return execAll(tx,
+			`DELETE FROM payloads WHERE connection_id NOT IN (SELECT id FROM connections)`,
+		)
+	},
+}
+
+func execAll(tx *pg.Tx, statements ...string) error {
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var indexes = []string{
+	`CREATE INDEX IF NOT EXISTS devices_key_prefix_idx ON devices (key_prefix)`,
+	`CREATE INDEX IF NOT EXISTS devices_account_id_idx ON devices (account_id)`,
+}
+
+// Do createdb & dropdb for a full reset. Running it again on an existing database applies pending
+// migrations.
 func CreateSchema(db *pg.DB) error {
+	var isExisting bool
+	_, err := db.QueryOne(pg.Scan(&isExisting), `SELECT to_regclass('accounts') IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	if isExisting {
+		err = Migrate(db)
+	} else {
+		err = createTables(db)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indexes {
+		_, err := db.Exec(index)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// All tables as the models have them now, for an empty database.
+func createTables(db *pg.DB) error {
 	models := []interface{}{
 		(*Account)(nil),
+		(*Avatar)(nil),
+		(*Device)(nil),
+		(*DevicePairing)(nil),
 		(*Connection)(nil),
 		(*Payload)(nil),
+		(*Block)(nil),
+		(*Report)(nil),
+		(*DailyActivity)(nil),
+		(*SchemaMigration)(nil),
 	}
 
-	for _, model := range models {
-		err := db.CreateTable(model, &orm.CreateTableOptions{
-			//Temp: true, // temp table
+	return db.RunInTransaction(db.Context(), func(tx *pg.Tx) error {
+		for _, model := range models {
+			err := tx.Model(model).CreateTable(&orm.CreateTableOptions{
+				//Temp: true, // temp table
+				IfNotExists: true,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		// Nothing to migrate in tables which are as the models are.
+		for version := 1; version <= len(migrations); version++ {
+			_, err := tx.Model(&SchemaMigration{Version: version, TimeApplied: time.Now()}).Insert()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/**
+ * Returns the number of the last migration which was applied to the database.
+ */
+func SchemaVersion(db *pg.DB) (int, error) {
+	var version int
+	_, err := db.QueryOne(pg.Scan(&version), `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`)
+	return version, err
+}
+
+/**
+ * Apply all migrations the database has not seen yet, each in its own transaction.
+ */
+func Migrate(db *pg.DB) error {
+	// Databases from before there were migrations do not have the table yet.
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version bigserial PRIMARY KEY, time_applied timestamptz)`)
+	if err != nil {
+		return err
+	}
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		migration := migrations[version]
+		err = db.RunInTransaction(db.Context(), func(tx *pg.Tx) error {
+			err := migration(tx)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Model(&SchemaMigration{Version: version + 1, TimeApplied: time.Now()}).Insert()
+			return err
 		})
 		if err != nil {
-			return err
+			return fmt.Errorf("migration %d failed: %s", version+1, err)
 		}
 	}
 	return nil
@@ -70,6 +435,7 @@ func Connect() *pg.DB {
 		Password: "",
 		Database: "photobeam",
 	})
-	db.AddQueryHook(pgext.DebugHook{})
+	db.AddQueryHook(queryTracingHook{})
+	db.AddQueryHook(queryLogHook{})
 	return db
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrInvalidPairingCode = errors.New("Invalid pairing code")
+	ErrLastDevice         = errors.New("Cannot revoke the last device of an account")
+	ErrNoSuchDevice       = errors.New("No such device")
+	ErrDeviceInvalid      = errors.New("Device name is too long or not text, or the platform is not a short word")
+)
+
+// How long a device pairing code can be redeemed.
+const pairingCodeLifetime = 10 * time.Minute
+
+// Names are shown in the list of devices; platforms are short words like "ios".
+const (
+	maxDeviceNameLength = 50
+	maxPlatformLength   = 20
+)
+
+/**
+ * Create a new account, along with the device that registered it.
+ */
+func CreateAccount(store Store, deviceName string, platform string) (*Account, *Device, error) {
+	account := &Account{
+		ConnectCode: ConnectCode(),
+	}
+	var device *Device
+	err := store.RunInTransaction(func(tx Store) error {
+		err := tx.InsertAccount(account)
+		if err != nil {
+			return err
+		}
+		device, err = CreateDevice(tx, account.Id, deviceName, platform)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	RecordActivity(store, ActivityRegistrations)
+	return account, device, nil
+}
+
+/**
+ * Add a device with new credentials to the account. The plaintext key is in device.Key.
+ */
+func CreateDevice(store Store, accountId int, name string, platform string) (*Device, error) {
+	if platform == "" {
+		// Our only client so far, which also does not tell us.
+		platform = PLATFORM_IOS
+	}
+
+	key, keyPrefix, keyHash := NewAuthKey()
+	device := &Device{
+		AccountId:   accountId,
+		Name:        name,
+		Platform:    platform,
+		KeyPrefix:   keyPrefix,
+		KeyHash:     keyHash,
+		TimeCreated: time.Now(),
+		Key:         key,
+	}
+	err := store.InsertDevice(device)
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+/**
+ * Create a code which lets another device join this account. The signed-in device shows it
+ * (e.g. as a QR code), the new device redeems it with RedeemPairingCode.
+ */
+func CreatePairingCode(store Store, account *Account) (*DevicePairing, error) {
+	// Clean up whatever has expired in the meantime.
+	err := store.DeleteExpiredPairings(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	pairing := &DevicePairing{
+		Code:        StringWithCharset(10, "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"),
+		AccountId:   account.Id,
+		TimeExpires: time.Now().Add(pairingCodeLifetime),
+	}
+	err = store.InsertPairing(pairing)
+	if err != nil {
+		return nil, err
+	}
+	return pairing, nil
+}
+
+/**
+ * Use up a pairing code, and create a new device for the account which issued it.
+ */
+func RedeemPairingCode(store Store, code string, deviceName string, platform string) (*Account, *Device, error) {
+	deviceName, err := checkDeviceName(deviceName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkPlatform(platform); err != nil {
+		return nil, nil, err
+	}
+
+	var account *Account
+	var device *Device
+	err = store.RunInTransaction(func(tx Store) error {
+		pairing, err := tx.TakePairing(code)
+		if err == ErrNotFound {
+			return ErrInvalidPairingCode
+		}
+		if err != nil {
+			return err
+		}
+		if pairing.TimeExpires.Before(time.Now()) {
+			return ErrInvalidPairingCode
+		}
+
+		account, err = tx.GetAccount(pairing.AccountId)
+		if err != nil {
+			return err
+		}
+
+		device, err = CreateDevice(tx, account.Id, deviceName, platform)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return account, device, nil
+}
+
+/**
+ * The name to store for a device: trimmed, and at most maxDeviceNameLength characters of text.
+ */
+func checkDeviceName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if !utf8.ValidString(name) || utf8.RuneCountInString(name) > maxDeviceNameLength ||
+		strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "", ErrDeviceInvalid
+	}
+	return name, nil
+}
+
+/**
+ * A platform is a short word of lowercase letters and digits, or empty if the device did not say.
+ */
+func checkPlatform(platform string) error {
+	if len(platform) > maxPlatformLength {
+		return ErrDeviceInvalid
+	}
+	for _, c := range platform {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return ErrDeviceInvalid
+		}
+	}
+	return nil
+}
+
+func ListDevices(store Store, accountId int) ([]Device, error) {
+	return store.ListDevices(accountId)
+}
+
+/**
+ * Sign a device out of the account. The last device cannot be revoked, as nobody could get back
+ * into the account afterwards.
+ */
+func RevokeDevice(store Store, account *Account, deviceId int) error {
+	return store.RunInTransaction(func(tx Store) error {
+		devices, err := tx.ListDevices(account.Id)
+		if err != nil {
+			return err
+		}
+		if len(devices) <= 1 {
+			return ErrLastDevice
+		}
+
+		deleted, err := tx.DeleteDevice(account.Id, deviceId)
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			return ErrNoSuchDevice
+		}
+		return nil
+	})
+}
@@ -0,0 +1,976 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/miracle2k/photobeam-server/client"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/**
+ * The whole server on a real listener, as the apps see it: all the middleware, a store of its
+ * own, and pushes going to a fake APNs server.
+ */
+type TestServer struct {
+	*httptest.Server
+	Store Store
+	APNs  *FakeAPNs
+}
+
+func StartTestServer(t *testing.T, store Store) *TestServer {
+	apns := StartFakeAPNs()
+	SetDefaultStore(store)
+	SetPushClient(apns.Client())
+	server := httptest.NewServer(NewAPIHandler())
+	t.Cleanup(func() {
+		server.Close()
+		WaitForBackground(context.Background())
+		SetPushClient(nil)
+		SetDefaultStore(nil)
+		apns.Close()
+	})
+	return &TestServer{Server: server, Store: store, APNs: apns}
+}
+
+/**
+ * The pushes the device got. Waits for the pushes still running in the background first.
+ */
+func (s *TestServer) PushesTo(deviceToken string) []FakeNotification {
+	WaitForBackground(context.Background())
+	var notifications []FakeNotification
+	for _, notification := range s.APNs.Notifications() {
+		if notification.DeviceToken == deviceToken {
+			notifications = append(notifications, notification)
+		}
+	}
+	return notifications
+}
+
+/**
+ * Register an account. Its device gets the push token "token-<name>".
+ */
+func (s *TestServer) Register(t *testing.T, name string) (*client.Client, *client.AccountResponse) {
+	c := client.New(s.URL)
+	account, err := c.Register(context.Background())
+	if err != nil {
+		t.Fatalf("registering %s: %v", name, err)
+	}
+	token := "token-" + name
+	if _, err := c.SetProps(context.Background(), client.SetPropsArguments{ApnsToken: &token, DisplayName: &name}); err != nil {
+		t.Fatalf("setting the props of %s: %v", name, err)
+	}
+	return c, account
+}
+
+/**
+ * Fail unless a call returned the state we want. The peer profile only has to belong to the peer,
+ * and whoever asked to connect must not see it until the request is accepted.
+ */
+func ExpectState(t *testing.T, step string, got *client.StateResponse, err error, want client.StateResponse) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", step, err)
+	}
+	if got.PeerId != want.PeerId || got.Status != want.Status || got.ShouldFetch != want.ShouldFetch || got.ShouldPeerFetch != want.ShouldPeerFetch {
+		t.Fatalf("%s: got %+v, want %+v", step, *got, want)
+	}
+	if want.Status == "pending" || want.Status == "pendingWithPeer" {
+		if got.Peer != nil {
+			t.Errorf("%s: got the profile %+v before being accepted", step, got.Peer)
+		}
+	} else if want.PeerId != 0 && (got.Peer == nil || got.Peer.AccountId != want.PeerId) {
+		t.Errorf("%s: got the profile %+v for peer %d", step, got.Peer, want.PeerId)
+	}
+}
+
+// Runs an end to end scenario on each kind of store.
+func runScenario(t *testing.T, scenario func(t *testing.T, server *TestServer)) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) { scenario(t, StartTestServer(t, store)) })
+	}
+}
+
+func TestBeamFlow(t *testing.T) {
+	runScenario(t, func(t *testing.T, server *TestServer) {
+		ctx := context.Background()
+		alice, aliceAccount := server.Register(t, "alice")
+		bob, bobAccount := server.Register(t, "bob")
+		photo := []byte("a photo of a cat")
+
+		state, err := alice.Query(ctx)
+		ExpectState(t, "query before connecting", state, err, client.StateResponse{})
+
+		state, err = alice.Connect(ctx, bobAccount.ConnectCode)
+		ExpectState(t, "connect", state, err, client.StateResponse{PeerId: bobAccount.AccountId, Status: "pending"})
+		state, err = alice.Query(ctx)
+		ExpectState(t, "query of the initiator", state, err, client.StateResponse{PeerId: bobAccount.AccountId, Status: "pendingWithPeer"})
+		state, err = bob.Query(ctx)
+		ExpectState(t, "query of the invitee", state, err, client.StateResponse{PeerId: aliceAccount.AccountId, Status: "pendingWithMe"})
+		for _, c := range []*client.Client{alice, bob} {
+			if _, err := c.Set(ctx, photo); client.ErrorCode(err) != "no_connection" {
+				t.Errorf("got %v for a photo over a request, want no_connection", err)
+			}
+		}
+
+		state, err = bob.Accept(ctx, aliceAccount.AccountId)
+		ExpectState(t, "accept", state, err, client.StateResponse{PeerId: aliceAccount.AccountId, Status: "connected"})
+		state, err = alice.Query(ctx)
+		ExpectState(t, "query after accepting", state, err, client.StateResponse{PeerId: bobAccount.AccountId, Status: "connected"})
+
+		state, err = alice.Set(ctx, photo)
+		ExpectState(t, "set", state, err, client.StateResponse{PeerId: bobAccount.AccountId, Status: "connected", ShouldPeerFetch: true})
+		if pushes := server.PushesTo("token-bob"); len(pushes) != 1 {
+			t.Errorf("bob got %d pushes, want 1", len(pushes))
+		}
+		if pushes := server.PushesTo("token-alice"); len(pushes) != 0 {
+			t.Errorf("alice got %d pushes for her own photo", len(pushes))
+		}
+		state, err = bob.Query(ctx)
+		ExpectState(t, "query with a photo waiting", state, err, client.StateResponse{PeerId: aliceAccount.AccountId, Status: "connected", ShouldFetch: true})
+
+		data, err := bob.Get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, photo) {
+			t.Errorf("got %q, want the photo alice sent", data)
+		}
+
+		state, err = bob.Clear(ctx)
+		ExpectState(t, "clear", state, err, client.StateResponse{PeerId: aliceAccount.AccountId, Status: "connected"})
+		state, err = alice.Query(ctx)
+		ExpectState(t, "query after clearing", state, err, client.StateResponse{PeerId: bobAccount.AccountId, Status: "connected"})
+		if _, err := bob.Get(ctx); client.ErrorCode(err) != "no_payload" {
+			t.Errorf("got %v for a cleared photo, want no_payload", err)
+		}
+
+		state, err = alice.Disconnect(ctx)
+		ExpectState(t, "disconnect", state, err, client.StateResponse{})
+		state, err = bob.Query(ctx)
+		ExpectState(t, "query of the peer after disconnecting", state, err, client.StateResponse{})
+		if _, err := alice.Set(ctx, photo); client.ErrorCode(err) == "" {
+			t.Errorf("set without a connection succeeded")
+		}
+	})
+}
+
+func TestRelinking(t *testing.T) {
+	runScenario(t, func(t *testing.T, server *TestServer) {
+		ctx := context.Background()
+		alice, aliceAccount := server.Register(t, "alice")
+		bob, bobAccount := server.Register(t, "bob")
+		carol, carolAccount := server.Register(t, "carol")
+
+		alice.Connect(ctx, bobAccount.ConnectCode)
+		bob.Accept(ctx, aliceAccount.AccountId)
+		state, err := alice.Set(ctx, []byte("for bob"))
+		ExpectState(t, "set for bob", state, err, client.StateResponse{PeerId: bobAccount.AccountId, Status: "connected", ShouldPeerFetch: true})
+
+		// Connecting to someone else leaves the current connection, and the photo with it.
+		state, err = alice.Connect(ctx, carolAccount.ConnectCode)
+		ExpectState(t, "connect to carol", state, err, client.StateResponse{PeerId: carolAccount.AccountId, Status: "pending"})
+		state, err = bob.Query(ctx)
+		ExpectState(t, "query of the one left", state, err, client.StateResponse{})
+		if _, err := bob.Get(ctx); client.ErrorCode(err) == "" {
+			t.Errorf("bob could still fetch the photo of a connection that is gone")
+		}
+		if payloads, _ := server.Store.ListAccountPayloads(aliceAccount.AccountId); len(payloads) != 0 {
+			t.Errorf("%d payloads of the connection that is gone are still stored", len(payloads))
+		}
+
+		state, err = carol.Accept(ctx, aliceAccount.AccountId)
+		ExpectState(t, "carol accepts", state, err, client.StateResponse{PeerId: aliceAccount.AccountId, Status: "connected"})
+		state, err = alice.Query(ctx)
+		ExpectState(t, "query with carol", state, err, client.StateResponse{PeerId: carolAccount.AccountId, Status: "connected"})
+
+		// Back to bob: a new connection, which starts without a photo.
+		state, err = bob.Connect(ctx, aliceAccount.ConnectCode)
+		ExpectState(t, "bob connects again", state, err, client.StateResponse{PeerId: aliceAccount.AccountId, Status: "pending"})
+		state, err = alice.Query(ctx)
+		ExpectState(t, "the live connection wins over the request", state, err, client.StateResponse{PeerId: carolAccount.AccountId, Status: "connected"})
+		state, err = alice.Accept(ctx, bobAccount.AccountId)
+		ExpectState(t, "alice accepts bob", state, err, client.StateResponse{PeerId: bobAccount.AccountId, Status: "connected"})
+		state, err = bob.Query(ctx)
+		ExpectState(t, "query of bob after relinking", state, err, client.StateResponse{PeerId: aliceAccount.AccountId, Status: "connected"})
+		state, err = carol.Query(ctx)
+		ExpectState(t, "query of carol after relinking", state, err, client.StateResponse{})
+	})
+}
+
+func TestPendingProfiles(t *testing.T) {
+	runScenario(t, func(t *testing.T, server *TestServer) {
+		ctx := context.Background()
+		alice, aliceAccount := server.Register(t, "alice")
+		bob, bobAccount := server.Register(t, "bob")
+		avatar := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 32)...)
+		for _, c := range []*client.Client{alice, bob} {
+			if _, err := c.SetProps(ctx, client.SetPropsArguments{Avatar: &avatar}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// A connect code is all alice needs to ask, so she sees nothing of bob until he accepts.
+		state, err := alice.Connect(ctx, bobAccount.ConnectCode)
+		ExpectState(t, "connect", state, err, client.StateResponse{PeerId: bobAccount.AccountId, Status: "pending"})
+		if _, err := alice.Avatar(ctx, bobAccount.AccountId); client.ErrorCode(err) != "no_avatar" {
+			t.Errorf("got %v for the avatar of the invitee, want no_avatar", err)
+		}
+
+		// Bob does see who is asking.
+		state, err = bob.Query(ctx)
+		ExpectState(t, "query of the invitee", state, err, client.StateResponse{PeerId: aliceAccount.AccountId, Status: "pendingWithMe"})
+		if state.Peer.DisplayName != "alice" {
+			t.Errorf("got the display name %q, want alice", state.Peer.DisplayName)
+		}
+		if data, err := bob.Avatar(ctx, aliceAccount.AccountId); err != nil || !bytes.Equal(data, avatar) {
+			t.Errorf("got %q, %v for the avatar of the initiator", data, err)
+		}
+
+		state, err = bob.Accept(ctx, aliceAccount.AccountId)
+		ExpectState(t, "accept", state, err, client.StateResponse{PeerId: aliceAccount.AccountId, Status: "connected"})
+		state, err = alice.Query(ctx)
+		ExpectState(t, "query after accepting", state, err, client.StateResponse{PeerId: bobAccount.AccountId, Status: "connected"})
+		if state.Peer.DisplayName != "bob" {
+			t.Errorf("got the display name %q, want bob", state.Peer.DisplayName)
+		}
+		if data, err := alice.Avatar(ctx, bobAccount.AccountId); err != nil || !bytes.Equal(data, avatar) {
+			t.Errorf("got %q, %v for the avatar of the peer", data, err)
+		}
+	})
+}
+
+func TestBlocking(t *testing.T) {
+	runScenario(t, func(t *testing.T, server *TestServer) {
+		ctx := context.Background()
+		alice, aliceAccount := server.Register(t, "alice")
+		bob, bobAccount := server.Register(t, "bob")
+
+		alice.Connect(ctx, bobAccount.ConnectCode)
+		bob.Accept(ctx, aliceAccount.AccountId)
+		if _, err := bob.Set(ctx, []byte("for alice")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Blocking ends the connection, along with the photo.
+		state, err := alice.Block(ctx, bobAccount.AccountId)
+		ExpectState(t, "block", state, err, client.StateResponse{})
+		state, err = bob.Query(ctx)
+		ExpectState(t, "query of the blocked account", state, err, client.StateResponse{})
+		if _, err := alice.Get(ctx); client.ErrorCode(err) == "" {
+			t.Errorf("alice could still fetch the photo of a blocked account")
+		}
+
+		// Neither side can link again, whoever asks; to them the code looks unknown.
+		if _, err := bob.Connect(ctx, aliceAccount.ConnectCode); client.ErrorCode(err) != "invalid_connect_code" {
+			t.Errorf("got %v connecting to the blocker, want invalid_connect_code", err)
+		}
+		if _, err := alice.Connect(ctx, bobAccount.ConnectCode); client.ErrorCode(err) != "invalid_connect_code" {
+			t.Errorf("got %v connecting to the blocked account, want invalid_connect_code", err)
+		}
+		if _, err := alice.Block(ctx, aliceAccount.AccountId); client.ErrorCode(err) != "cannot_block_self" {
+			t.Errorf("got %v blocking oneself, want cannot_block_self", err)
+		}
+
+		state, err = alice.Unblock(ctx, bobAccount.AccountId)
+		ExpectState(t, "unblock", state, err, client.StateResponse{})
+		state, err = bob.Connect(ctx, aliceAccount.ConnectCode)
+		ExpectState(t, "connect after unblocking", state, err, client.StateResponse{PeerId: aliceAccount.AccountId, Status: "pending"})
+	})
+}
+
+func TestReporting(t *testing.T) {
+	runScenario(t, func(t *testing.T, server *TestServer) {
+		ctx := context.Background()
+		alice, aliceAccount := server.Register(t, "alice")
+		bob, bobAccount := server.Register(t, "bob")
+
+		if _, err := alice.Report(ctx, client.ReportArguments{Reason: "spam"}); client.ErrorCode(err) != "no_connection" {
+			t.Errorf("got %v reporting without a peer, want no_connection", err)
+		}
+
+		alice.Connect(ctx, bobAccount.ConnectCode)
+		bob.Accept(ctx, aliceAccount.AccountId)
+		if _, err := bob.Set(ctx, []byte("something nasty")); err != nil {
+			t.Fatal(err)
+		}
+
+		// A report alone keeps the connection; the moderators get a copy of the photo.
+		state, err := alice.Report(ctx, client.ReportArguments{Reason: "spam"})
+		ExpectState(t, "report", state, err, client.StateResponse{PeerId: bobAccount.AccountId, Status: "connected", ShouldFetch: true})
+		reports, err := ListReports(server.Store, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reports) != 1 {
+			t.Fatalf("got %d reports, want 1", len(reports))
+		}
+		report, err := GetReport(server.Store, reports[0].Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.ReporterId != aliceAccount.AccountId || report.ReportedId != bobAccount.AccountId || report.Reason != "spam" ||
+			string(report.PayloadData) != "something nasty" {
+			t.Errorf("got the report %+v", report)
+		}
+
+		// With block, the connection ends as well.
+		state, err = alice.Report(ctx, client.ReportArguments{Reason: "still spam", Block: true})
+		ExpectState(t, "report and block", state, err, client.StateResponse{})
+		if blocked, err := IsBlocked(server.Store, aliceAccount.AccountId, bobAccount.AccountId); err != nil || !blocked {
+			t.Errorf("bob is not blocked: %v", err)
+		}
+		if reports, _ := ListReports(server.Store, false); len(reports) != 2 {
+			t.Errorf("got %d reports, want 2", len(reports))
+		}
+	})
+}
+
+func TestConcurrentConnects(t *testing.T) {
+	runScenario(t, func(t *testing.T, server *TestServer) {
+		ctx := context.Background()
+		target, targetAccount := server.Register(t, "target")
+
+		clients := make([]*client.Client, 8)
+		accounts := make([]*client.AccountResponse, len(clients))
+		for i := range clients {
+			clients[i], accounts[i] = server.Register(t, fmt.Sprintf("initiator%d", i))
+		}
+
+		var wg sync.WaitGroup
+		states := make([]*client.StateResponse, len(clients))
+		errs := make([]error, len(clients))
+		for i := range clients {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				states[i], errs[i] = clients[i].Connect(ctx, targetAccount.ConnectCode)
+			}(i)
+		}
+		wg.Wait()
+		for i := range clients {
+			ExpectState(t, fmt.Sprintf("connect of initiator %d", i), states[i], errs[i],
+				client.StateResponse{PeerId: targetAccount.AccountId, Status: "pending"})
+		}
+
+		// Every request is pending, and the target sees one of them.
+		for i := range clients {
+			state, err := clients[i].Query(ctx)
+			ExpectState(t, fmt.Sprintf("query of initiator %d", i), state, err,
+				client.StateResponse{PeerId: targetAccount.AccountId, Status: "pendingWithPeer"})
+		}
+		state, err := target.Query(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Status != "pendingWithMe" {
+			t.Fatalf("got %+v for the target, want a pending request", *state)
+		}
+
+		// Accepting one request turns down the others.
+		chosen := accounts[3]
+		state, err = target.Accept(ctx, chosen.AccountId)
+		ExpectState(t, "accept", state, err, client.StateResponse{PeerId: chosen.AccountId, Status: "connected"})
+		for i := range clients {
+			want := client.StateResponse{}
+			if accounts[i] == chosen {
+				want = client.StateResponse{PeerId: targetAccount.AccountId, Status: "connected"}
+			}
+			state, err := clients[i].Query(ctx)
+			ExpectState(t, fmt.Sprintf("query of initiator %d after accepting", i), state, err, want)
+		}
+	})
+}
+
+func TestPushes(t *testing.T) {
+	runScenario(t, func(t *testing.T, server *TestServer) {
+		ctx := context.Background()
+		alice, aliceAccount := server.Register(t, "alice")
+		bob, bobAccount := server.Register(t, "bob")
+		alice.Connect(ctx, bobAccount.ConnectCode)
+		bob.Accept(ctx, aliceAccount.AccountId)
+
+		bobToken := func() string {
+			devices, err := server.Store.ListDevices(bobAccount.AccountId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return devices[0].PushToken
+		}
+
+		if _, err := alice.Set(ctx, []byte("photo")); err != nil {
+			t.Fatal(err)
+		}
+		pushes := server.PushesTo("token-bob")
+		if len(pushes) != 1 {
+			t.Fatalf("got %d pushes, want 1", len(pushes))
+		}
+		if push := pushes[0]; push.Topic != "com.elsdoerfer.photobeam" || push.PushType != "background" ||
+			!strings.Contains(string(push.Payload), `"content-available":1`) {
+			t.Errorf("got push %+v %s, want a background push", push, push.Payload)
+		}
+
+		// A rejected push does not fail the upload, and the token is kept for the next one...
+		server.APNs.Reject("token-bob", http.StatusTooManyRequests, "TooManyRequests")
+		if _, err := alice.Set(ctx, []byte("photo")); err != nil {
+			t.Fatal(err)
+		}
+		if pushes := server.PushesTo("token-bob"); len(pushes) != 1 {
+			t.Errorf("got %d pushes, want the rejected one not to count", len(pushes))
+		}
+		if token := bobToken(); token != "token-bob" {
+			t.Errorf("got token %q after a 429", token)
+		}
+
+		// ...unless APNs says it is no longer registered.
+		server.APNs.Reject("token-bob", http.StatusGone, "Unregistered")
+		if _, err := alice.Set(ctx, []byte("photo")); err != nil {
+			t.Fatal(err)
+		}
+		WaitForBackground(ctx)
+		if token := bobToken(); token != "" {
+			t.Errorf("got token %q after a 410, want it forgotten", token)
+		}
+	})
+}
+
+func TestEncryptedPayloads(t *testing.T) {
+	runScenario(t, func(t *testing.T, server *TestServer) {
+		ctx := context.Background()
+		alice, aliceAccount := server.Register(t, "alice")
+		bob, bobAccount := server.Register(t, "bob")
+		alice.Connect(ctx, bobAccount.ConnectCode)
+		bob.Accept(ctx, aliceAccount.AccountId)
+
+		x25519, p256 := "x25519", "p256"
+		short := bytes.Repeat([]byte{1}, 16)
+		if _, err := bob.SetProps(ctx, client.SetPropsArguments{PublicKey: &short, PublicKeyAlgorithm: &x25519}); client.ErrorCode(err) != "invalid_public_key" {
+			t.Errorf("got %v for a key of the wrong length, want invalid_public_key", err)
+		}
+
+		// Publishing a key tells the peer, who finds it in the profile of the connection.
+		key := bytes.Repeat([]byte{2}, 32)
+		account, err := bob.SetProps(ctx, client.SetPropsArguments{PublicKey: &key, PublicKeyAlgorithm: &x25519})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account.PublicKeyId == "" {
+			t.Fatalf("got no key id for the published key")
+		}
+		if pushes := server.PushesTo("token-alice"); len(pushes) != 1 {
+			t.Errorf("alice got %d pushes for the new key, want 1", len(pushes))
+		}
+		state, err := alice.Query(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if peerKey := state.Peer.PublicKey; peerKey == nil || peerKey.KeyId != account.PublicKeyId ||
+			peerKey.Algorithm != x25519 || !bytes.Equal(peerKey.Key, key) {
+			t.Fatalf("got the peer key %+v", peerKey)
+		}
+
+		// The payload and how it was encrypted reach the peer as they were sent.
+		sealed := []byte("sealed photo")
+		encryption := client.Encryption{KeyId: account.PublicKeyId, Algorithm: "x25519-chacha20poly1305", Nonce: []byte("0123456789ab")}
+		state, err = alice.SetEncrypted(ctx, sealed, encryption)
+		ExpectState(t, "set encrypted", state, err, client.StateResponse{PeerId: bobAccount.AccountId, Status: "connected", ShouldPeerFetch: true})
+		data, got, err := bob.GetEncrypted(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, sealed) || got.KeyId != encryption.KeyId || got.Algorithm != encryption.Algorithm ||
+			!bytes.Equal(got.Nonce, encryption.Nonce) {
+			t.Errorf("got %q with %+v, want what alice sent", data, got)
+		}
+
+		// The caption of an encrypted photo stays out of the alert.
+		on := true
+		if _, err := bob.SetProps(ctx, client.SetPropsArguments{AlertPushes: &on}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := alice.SetBeam(ctx, client.Beam{Data: sealed, Caption: "a secret", Encryption: encryption}); err != nil {
+			t.Fatal(err)
+		}
+		pushes := server.PushesTo("token-bob")
+		if last := string(pushes[len(pushes)-1].Payload); strings.Contains(last, "a secret") || !strings.Contains(last, `"body":"Sent you a photo."`) {
+			t.Errorf("got the alert %s, want one without the caption", last)
+		}
+		if beam, err := bob.GetBeam(ctx); err != nil || beam.Caption != "a secret" {
+			t.Errorf("got %+v, %v, want the caption with the photo", beam, err)
+		}
+
+		// Once bob replaces the key, a payload for the old one is turned down.
+		newKey := bytes.Repeat([]byte{4}, 65)
+		if _, err := bob.SetProps(ctx, client.SetPropsArguments{PublicKey: &newKey, PublicKeyAlgorithm: &p256}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := alice.SetEncrypted(ctx, sealed, encryption); client.ErrorCode(err) != "stale_public_key" {
+			t.Errorf("got %v for a payload to the old key, want stale_public_key", err)
+		}
+		if _, err := alice.SetEncrypted(ctx, sealed, client.Encryption{KeyId: "abc"}); client.ErrorCode(err) != "invalid_request" {
+			t.Errorf("got %v for a key id without an algorithm, want invalid_request", err)
+		}
+
+		// Plain payloads still work, and come without the headers.
+		if _, err := alice.Set(ctx, []byte("plain")); err != nil {
+			t.Fatal(err)
+		}
+		if _, got, err := bob.GetEncrypted(ctx); err != nil || got.KeyId != "" || got.Algorithm != "" || got.Nonce != nil {
+			t.Errorf("got %+v, %v for a plain payload", got, err)
+		}
+	})
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	runScenario(t, func(t *testing.T, server *TestServer) {
+		ctx := context.Background()
+		alice, aliceAccount := server.Register(t, "alice")
+		bob, bobAccount := server.Register(t, "bob")
+		alice.Connect(ctx, bobAccount.ConnectCode)
+		bob.Accept(ctx, aliceAccount.AccountId)
+		connection, err := GetConnection(server.Store, aliceAccount.AccountId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored := func(fromId int) *Payload {
+			payload, err := server.Store.GetPayload(connection.Id, fromId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return payload
+		}
+
+		// Bob's photo was uploaded before there was a master key.
+		plain := []byte("from before the master key")
+		if _, err := bob.Set(ctx, plain); err != nil {
+			t.Fatal(err)
+		}
+
+		oldKey, _ := ParseMasterKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+		newKey, _ := ParseMasterKey("ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=")
+		ConfigureMasterKeys(oldKey, nil)
+		t.Cleanup(func() { ConfigureMasterKeys(nil, nil) })
+
+		photo := []byte("a photo of a cat")
+		if _, err := alice.SetBeam(ctx, client.Beam{Data: photo, Caption: "meow"}); err != nil {
+			t.Fatal(err)
+		}
+		if payload := stored(aliceAccount.AccountId); bytes.Contains(payload.Data, photo) || bytes.Contains(payload.Caption, []byte("meow")) ||
+			payload.MasterKeyId != oldKey.Id {
+			t.Fatalf("stored %q, %q with master key %q, want it encrypted with %s", payload.Data, payload.Caption, payload.MasterKeyId, oldKey.Id)
+		}
+		if state, err := bob.Query(ctx); err != nil || state.Caption != "meow" {
+			t.Errorf("got %+v, %v, want the caption decrypted", state, err)
+		}
+		if data, err := bob.Get(ctx); err != nil || !bytes.Equal(data, photo) {
+			t.Fatalf("got %q, %v, want the photo", data, err)
+		}
+
+		// The snapshot of a report is encrypted with the data key of the payload.
+		if _, err := bob.Report(ctx, client.ReportArguments{Reason: "spam"}); err != nil {
+			t.Fatal(err)
+		}
+		reports, _ := server.Store.ListReports(false)
+		if raw, _ := server.Store.GetReport(reports[0].Id); bytes.Contains(raw.PayloadData, photo) {
+			t.Errorf("the report snapshot is stored in plain")
+		}
+
+		// Rotate: the server runs with the new key and still reads the old one, until everything
+		// is re-wrapped.
+		ConfigureMasterKeys(newKey, []*MasterKey{oldKey})
+		rotation, err := RotateMasterKey(server.Store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rotation.Payloads != 2 || rotation.Reports != 1 {
+			t.Errorf("rotated %+v, want both payloads and the report", *rotation)
+		}
+		if payload := stored(bobAccount.AccountId); bytes.Equal(payload.Data, plain) || payload.MasterKeyId != newKey.Id {
+			t.Errorf("the plain payload was not encrypted: %+v", payload)
+		}
+
+		ConfigureMasterKeys(newKey, nil)
+		if data, err := bob.Get(ctx); err != nil || !bytes.Equal(data, photo) {
+			t.Errorf("got %q, %v after rotating, want the photo", data, err)
+		}
+		if data, err := alice.Get(ctx); err != nil || !bytes.Equal(data, plain) {
+			t.Errorf("got %q, %v after rotating, want bob's photo", data, err)
+		}
+		if report, err := GetReport(server.Store, reports[0].Id); err != nil || !bytes.Equal(report.PayloadData, photo) {
+			t.Errorf("got the report snapshot %q, %v after rotating", report.PayloadData, err)
+		}
+		if rotation, err := RotateMasterKey(server.Store); err != nil || *rotation != (MasterKeyRotation{}) {
+			t.Errorf("rotating again did %+v, %v, want nothing", rotation, err)
+		}
+
+		// Without the key, the payloads cannot be read.
+		ConfigureMasterKeys(oldKey, nil)
+		if _, err := bob.Get(ctx); client.ErrorCode(err) != "internal_error" {
+			t.Errorf("got %v with only the old key", err)
+		}
+	})
+}
+
+func TestCaptions(t *testing.T) {
+	runScenario(t, func(t *testing.T, server *TestServer) {
+		ctx := context.Background()
+		alice, aliceAccount := server.Register(t, "alice")
+		bob, bobAccount := server.Register(t, "bob")
+		alice.Connect(ctx, bobAccount.ConnectCode)
+		bob.Accept(ctx, aliceAccount.AccountId)
+
+		// A photo with a caption; anything but ASCII has to survive the header.
+		caption := "thinking of you ☀️, 100% & more"
+		if _, err := alice.SetBeam(ctx, client.Beam{Data: []byte("photo"), Caption: caption}); err != nil {
+			t.Fatal(err)
+		}
+		state, err := bob.Query(ctx)
+		if err != nil || !state.ShouldFetch || state.Caption != caption {
+			t.Fatalf("got %+v, %v, want the caption", state, err)
+		}
+		beam, err := bob.GetBeam(ctx)
+		if err != nil || string(beam.Data) != "photo" || beam.Caption != caption {
+			t.Fatalf("got %+v, %v, want the photo with its caption", beam, err)
+		}
+		if pushes := server.PushesTo("token-bob"); len(pushes) != 1 || pushes[0].PushType != "background" {
+			t.Errorf("got %+v, want one background push while alerts are off", pushes)
+		}
+
+		// A text beam, once bob allows alerts.
+		on := true
+		if _, err := bob.SetProps(ctx, client.SetPropsArguments{AlertPushes: &on}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := alice.SetBeam(ctx, client.Beam{Caption: "just words"}); err != nil {
+			t.Fatal(err)
+		}
+		beam, err = bob.GetBeam(ctx)
+		if err != nil || len(beam.Data) != 0 || beam.Caption != "just words" {
+			t.Errorf("got %+v, %v, want a text beam", beam, err)
+		}
+		pushes := server.PushesTo("token-bob")
+		if len(pushes) != 2 || pushes[1].PushType != "alert" ||
+			!strings.Contains(string(pushes[1].Payload), `"title":"alice"`) || !strings.Contains(string(pushes[1].Payload), `"body":"just words"`) {
+			t.Errorf("got %+v, want an alert with the caption", pushes)
+		}
+
+		// The same through a multipart form.
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		file, _ := form.CreateFormFile("file", "photo.jpg")
+		file.Write([]byte("form photo"))
+		form.WriteField("caption", "from a form")
+		form.Close()
+		request, _ := http.NewRequest(http.MethodPost, server.URL+"/v1/set", &body)
+		request.Header.Set("Content-Type", form.FormDataContentType())
+		request.Header.Set("Authorization", alice.AuthKey)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d for a multipart upload", response.StatusCode)
+		}
+		beam, err = bob.GetBeam(ctx)
+		if err != nil || string(beam.Data) != "form photo" || beam.Caption != "from a form" {
+			t.Errorf("got %+v, %v, want what the form had", beam, err)
+		}
+
+		if _, err := alice.SetBeam(ctx, client.Beam{}); client.ErrorCode(err) != "empty_payload" {
+			t.Errorf("got %v for an empty beam, want empty_payload", err)
+		}
+		if _, err := alice.SetBeam(ctx, client.Beam{Caption: strings.Repeat("ü", 1001)}); client.ErrorCode(err) != "invalid_caption" {
+			t.Errorf("got %v for a long caption, want invalid_caption", err)
+		}
+		if _, err := alice.SetBeam(ctx, client.Beam{Caption: strings.Repeat("ü", 1000)}); err != nil {
+			t.Errorf("got %v for a caption at the limit", err)
+		}
+	})
+}
+
+func TestPayloadKinds(t *testing.T) {
+	runScenario(t, func(t *testing.T, server *TestServer) {
+		ctx := context.Background()
+		alice, aliceAccount := server.Register(t, "alice")
+		bob, bobAccount := server.Register(t, "bob")
+		alice.Connect(ctx, bobAccount.ConnectCode)
+		bob.Accept(ctx, aliceAccount.AccountId)
+
+		// A video, with the kind guessed from its content type.
+		if _, err := alice.SetBeam(ctx, client.Beam{Data: []byte("a video"), ContentType: "video/mp4"}); err != nil {
+			t.Fatal(err)
+		}
+		state, err := bob.Query(ctx)
+		if err != nil || state.Kind != "video" || state.ContentType != "video/mp4" {
+			t.Fatalf("got %+v, %v, want a video", state, err)
+		}
+		beam, err := bob.GetBeam(ctx)
+		if err != nil || string(beam.Data) != "a video" || beam.Kind != "video" || beam.ContentType != "video/mp4" {
+			t.Errorf("got %+v, %v, want the video", beam, err)
+		}
+		if pushes := server.PushesTo("token-bob"); len(pushes) != 1 || !strings.Contains(string(pushes[0].Payload), `"kind":"video"`) {
+			t.Errorf("got %+v, want a push with the kind", pushes)
+		}
+		if _, err := bob.Clear(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		// A Live Photo, encrypted at rest, both parts of it.
+		key, _ := ParseMasterKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+		ConfigureMasterKeys(key, nil)
+		t.Cleanup(func() { ConfigureMasterKeys(nil, nil) })
+		live := client.Beam{
+			Data: []byte("the still"), ContentType: "image/heic",
+			Video: []byte("the video"), VideoContentType: "video/quicktime",
+		}
+		if _, err := alice.SetBeam(ctx, live); err != nil {
+			t.Fatal(err)
+		}
+		connection, _ := GetConnection(server.Store, aliceAccount.AccountId)
+		stored, err := server.Store.GetPayload(connection.Id, aliceAccount.AccountId)
+		if err != nil || stored.Kind != "livePhoto" || len(stored.Video) == 0 || bytes.Contains(stored.Video, live.Video) {
+			t.Errorf("got %+v, %v, want a Live Photo with the video sealed", stored, err)
+		}
+		state, err = bob.Query(ctx)
+		if err != nil || state.Kind != "livePhoto" || state.ContentType != "image/heic" {
+			t.Errorf("got %+v, %v, want a Live Photo", state, err)
+		}
+		beam, err = bob.GetBeam(ctx)
+		if err != nil || string(beam.Data) != "the still" || string(beam.Video) != "the video" || beam.VideoContentType != "video/quicktime" {
+			t.Errorf("got %+v, %v, want both parts", beam, err)
+		}
+
+		// A report keeps both parts, sealed like the payload.
+		if _, err := bob.Report(ctx, client.ReportArguments{Reason: "not nice"}); err != nil {
+			t.Fatal(err)
+		}
+		reports, err := ListReports(server.Store, false)
+		if err != nil || len(reports) != 1 {
+			t.Fatalf("got %+v, %v, want the report", reports, err)
+		}
+		report, err := server.Store.GetReport(reports[0].Id)
+		if err != nil || bytes.Contains(report.PayloadVideo, live.Video) {
+			t.Errorf("got %+v, %v, want the video sealed", report, err)
+		}
+		report, err = GetReport(server.Store, reports[0].Id)
+		if err != nil || report.PayloadKind != "livePhoto" || report.PayloadContentType != "image/heic" ||
+			string(report.PayloadVideo) != "the video" || report.PayloadVideoContentType != "video/quicktime" {
+			t.Errorf("got %+v, %v, want the Live Photo in the report", report, err)
+		}
+
+		// Only a Live Photo has a video to get.
+		if _, err := alice.SetBeam(ctx, client.Beam{Data: []byte("gif"), Kind: "animation", ContentType: "image/gif"}); err != nil {
+			t.Fatal(err)
+		}
+		request, _ := http.NewRequest(http.MethodGet, server.URL+"/v1/get/video", nil)
+		request.Header.Set("Authorization", bob.AuthKey)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusNotFound {
+			t.Errorf("got status %d for the video of an animation, want 404", response.StatusCode)
+		}
+
+		invalid := map[string]client.Beam{
+			"unknown kind":             {Data: []byte("x"), Kind: "hologram"},
+			"content type of the kind": {Data: []byte("x"), Kind: "photo", ContentType: "video/mp4"},
+			"video of a photo":         {Data: []byte("x"), Kind: "photo", Video: []byte("y")},
+			"Live Photo without video": {Data: []byte("x"), Kind: "livePhoto"},
+			"text with data":           {Data: []byte("x"), Kind: "text"},
+			"video which is not":       {Data: []byte("x"), Video: []byte("y"), VideoContentType: "image/png"},
+			"malformed content type":   {Data: []byte("x"), Kind: "photo", ContentType: "image/"},
+		}
+		for name, beam := range invalid {
+			if _, err := alice.SetBeam(ctx, beam); client.ErrorCode(err) != "invalid_kind" {
+				t.Errorf("%s: got %v, want invalid_kind", name, err)
+			}
+		}
+
+		// Older clients upload with whatever content type their HTTP library sets.
+		request, _ = http.NewRequest(http.MethodPost, server.URL+"/set", strings.NewReader("a photo"))
+		request.Header.Set("Authorization", alice.AuthKey)
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		response, err = http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("got status %d for a legacy upload, want 200", response.StatusCode)
+		}
+		state, err = bob.Query(ctx)
+		if err != nil || state.Kind != "photo" || state.ContentType != "" {
+			t.Errorf("got %+v, %v, want a photo without a content type", state, err)
+		}
+
+		// Small limits, so that the test need not upload megabytes.
+		UsePayloadKinds(t, map[string]payloadKind{PayloadKindPhoto: {mediaType: "image/", maxSize: 10}})
+		if _, err := alice.SetBeam(ctx, client.Beam{Data: make([]byte, 10)}); err != nil {
+			t.Errorf("got %v for a photo at the limit", err)
+		}
+		if _, err := alice.SetBeam(ctx, client.Beam{Data: make([]byte, 11)}); client.ErrorCode(err) != "payload_too_large" {
+			t.Errorf("got %v for a photo over the limit, want payload_too_large", err)
+		}
+		// Too large to even read.
+		if _, err := alice.SetBeam(ctx, client.Beam{Data: make([]byte, 1<<20)}); client.ErrorCode(err) != "payload_too_large" {
+			t.Errorf("got %v for a huge upload, want payload_too_large", err)
+		}
+	})
+}
+
+func TestAccountData(t *testing.T) {
+	runScenario(t, func(t *testing.T, server *TestServer) {
+		ctx := context.Background()
+		alice, aliceAccount := server.Register(t, "alice")
+		bob, bobAccount := server.Register(t, "bob")
+		carol, _ := server.Register(t, "carol")
+		_, daveAccount := server.Register(t, "dave")
+		avatar := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 32)...)
+		if _, err := alice.SetProps(ctx, client.SetPropsArguments{Avatar: &avatar}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Something of everything: a connection with a payload each way, a request, a block, a
+		// report and a pairing code.
+		alice.Connect(ctx, bobAccount.ConnectCode)
+		bob.Accept(ctx, aliceAccount.AccountId)
+		if _, err := alice.SetBeam(ctx, client.Beam{Data: []byte("for bob"), Caption: "hi bob"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bob.SetBeam(ctx, client.Beam{Data: []byte("for alice"), Kind: "livePhoto", ContentType: "image/jpeg",
+			Video: []byte("moving"), VideoContentType: "video/quicktime"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := carol.Connect(ctx, aliceAccount.ConnectCode); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := alice.Block(ctx, daveAccount.AccountId); err != nil {
+			t.Fatal(err)
+		}
+		report := &Report{ReporterId: aliceAccount.AccountId, ReportedId: daveAccount.AccountId, Reason: "spam", TimeCreated: time.Now()}
+		if err := server.Store.InsertReport(report); err != nil {
+			t.Fatal(err)
+		}
+		pairing, err := alice.PairDevice(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := alice.Export(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := map[string][]byte{}
+		for _, file := range archive.File {
+			reader, err := file.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[file.Name], err = io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		var export AccountExport
+		if err := json.Unmarshal(files["account.json"], &export); err != nil {
+			t.Fatal(err)
+		}
+		if export.AccountId != aliceAccount.AccountId || len(export.Devices) != 1 || len(export.Connections) != 2 ||
+			len(export.Blocked) != 1 || len(export.Reports) != 1 || !bytes.Equal(files[export.Avatar], avatar) {
+			t.Errorf("got the export %+v", export)
+		}
+		if len(export.Payloads) != 2 {
+			t.Fatalf("got %d payloads in the export, want 2", len(export.Payloads))
+		}
+		sent, received := export.Payloads[0], export.Payloads[1]
+		if !sent.Sent || sent.Caption != "hi bob" || string(files[sent.File]) != "for bob" {
+			t.Errorf("got the sent payload %+v", sent)
+		}
+		if received.Sent || received.Kind != "livePhoto" || string(files[received.File]) != "for alice" ||
+			string(files[received.Video]) != "moving" || !strings.HasSuffix(received.Video, ".mov") {
+			t.Errorf("got the received payload %+v", received)
+		}
+
+		pushesBefore := len(server.PushesTo("token-bob"))
+		if err := alice.DeleteAccount(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if pushes := server.PushesTo("token-bob"); len(pushes) != pushesBefore+1 {
+			t.Errorf("bob got %d pushes after the deletion, want 1", len(pushes)-pushesBefore)
+		}
+		state, err := bob.Query(ctx)
+		ExpectState(t, "query of the peer after the deletion", state, err, client.StateResponse{})
+		if _, err := alice.Query(ctx); client.ErrorCode(err) != "unauthorized" {
+			t.Errorf("got %v for the key of a deleted account, want unauthorized", err)
+		}
+
+		store, accountId := server.Store, aliceAccount.AccountId
+		if _, err := store.GetAccount(accountId); err != ErrNotFound {
+			t.Errorf("the account is still there: %v", err)
+		}
+		if devices, _ := store.ListDevices(accountId); len(devices) != 0 {
+			t.Errorf("%d devices are left", len(devices))
+		}
+		if _, err := store.TakePairing(pairing.PairingCode); err != ErrNotFound {
+			t.Errorf("the pairing code is still there: %v", err)
+		}
+		if connections, _ := store.ListConnections(accountId); len(connections) != 0 {
+			t.Errorf("%d connections are left", len(connections))
+		}
+		if payloads, _ := store.ListAccountPayloads(accountId); len(payloads) != 0 {
+			t.Errorf("%d payloads are left", len(payloads))
+		}
+		if blocks, _ := store.ListBlocks(accountId); len(blocks) != 0 {
+			t.Errorf("%d blocks are left", len(blocks))
+		}
+		if reports, _ := store.ListReportsFiledBy(accountId); len(reports) != 0 {
+			t.Errorf("%d reports are left", len(reports))
+		}
+		if _, err := store.GetAvatar(accountId); err != ErrNotFound {
+			t.Errorf("the avatar is still there: %v", err)
+		}
+	})
+}
+
+func TestLoadTest(t *testing.T) {
+	server := StartTestServer(t, NewMemoryStore())
+	report := RunLoadTest(context.Background(), LoadTestOptions{
+		Server: server.URL, Pairs: 3, Cycles: 4, MinSize: 10, MaxSize: 1000,
+	})
+
+	if len(report.Errors) != 0 {
+		t.Errorf("got errors %v", report.Errors)
+	}
+	if report.Cycles != 12 || report.BytesSent < 120 {
+		t.Errorf("got %d cycles with %d bytes, want 12 with at least 120", report.Cycles, report.BytesSent)
+	}
+	counts := map[string]int{}
+	for _, operation := range report.Operations {
+		counts[operation.Name] = operation.Count
+		if operation.Count > 0 && (operation.P50 <= 0 || operation.P50 > operation.P99 || operation.P99 > operation.Max) {
+			t.Errorf("got latencies %+v for %s", *operation, operation.Name)
+		}
+	}
+	want := map[string]int{"register": 6, "connect": 3, "accept": 3, "set": 12, "query": 12, "get": 12, "clear": 12}
+	for name, count := range want {
+		if counts[name] != count {
+			t.Errorf("got %d requests for %s, want %d", counts[name], name, count)
+		}
+	}
+}
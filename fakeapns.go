@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/sideshow/apns2"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+/**
+ * A push as the fake APNs server received it.
+ */
+type FakeNotification struct {
+	DeviceToken string
+	Topic       string
+	PushType    string
+	ApnsId      string
+	Payload     json.RawMessage
+}
+
+/**
+ * A local stand-in for the APNs HTTP/2 API. It accepts every push, unless told to reject the
+ * pushes to a device, and keeps what it got. For the tests, and for test-apns --fake.
+ */
+type FakeAPNs struct {
+	server *httptest.Server
+
+	mu            sync.Mutex
+	notifications []FakeNotification
+	rejections    map[string]fakeRejection
+	lastId        int
+}
+
+// The errors test-apns --fake can answer with, by the reason APNs gives.
+var FakeAPNsErrors = map[string]int{
+	"BadDeviceToken":      http.StatusBadRequest,
+	"Unregistered":        http.StatusGone,
+	"TooManyRequests":     http.StatusTooManyRequests,
+	"InternalServerError": http.StatusInternalServerError,
+}
+
+type fakeRejection struct {
+	status int
+	reason string
+}
+
+func StartFakeAPNs() *FakeAPNs {
+	fake := &FakeAPNs{rejections: map[string]fakeRejection{}}
+	fake.server = httptest.NewUnstartedServer(http.HandlerFunc(fake.serve))
+	fake.server.EnableHTTP2 = true
+	fake.server.StartTLS()
+	return fake
+}
+
+func (f *FakeAPNs) Close() {
+	f.server.Close()
+}
+
+func (f *FakeAPNs) URL() string {
+	return f.server.URL
+}
+
+/**
+ * An APNs client which talks to the fake, and trusts its certificate.
+ */
+func (f *FakeAPNs) Client() *apns2.Client {
+	client := apns2.NewClient(tls.Certificate{})
+	client.Host = f.server.URL
+	client.HTTPClient = f.server.Client()
+	return client
+}
+
+/**
+ * Answer pushes to the device with an error from now on, e.g. 410 "Unregistered" or 429
+ * "TooManyRequests". An empty token rejects the pushes to every device. A status of 0 goes back
+ * to accepting them.
+ */
+func (f *FakeAPNs) Reject(deviceToken string, status int, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if status == 0 {
+		delete(f.rejections, deviceToken)
+		return
+	}
+	f.rejections[deviceToken] = fakeRejection{status, reason}
+}
+
+/**
+ * The pushes which were accepted, oldest first.
+ */
+func (f *FakeAPNs) Notifications() []FakeNotification {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeNotification{}, f.notifications...)
+}
+
+func (f *FakeAPNs) serve(w http.ResponseWriter, r *http.Request) {
+	deviceToken, found := strings.CutPrefix(r.URL.Path, "/3/device/")
+	if r.Method != http.MethodPost || !found {
+		f.reply(w, "", http.StatusNotFound, "BadPath")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil || !json.Valid(body) {
+		f.reply(w, "", http.StatusBadRequest, "PayloadEmpty")
+		return
+	}
+
+	f.mu.Lock()
+	f.lastId++
+	apnsId := r.Header.Get("apns-id")
+	if apnsId == "" {
+		apnsId = fmt.Sprintf("00000000-0000-0000-0000-%012d", f.lastId)
+	}
+	rejection, rejected := f.rejections[deviceToken]
+	if !rejected {
+		rejection, rejected = f.rejections[""]
+	}
+	if !rejected {
+		f.notifications = append(f.notifications, FakeNotification{
+			DeviceToken: deviceToken,
+			Topic:       r.Header.Get("apns-topic"),
+			PushType:    r.Header.Get("apns-push-type"),
+			ApnsId:      apnsId,
+			Payload:     body,
+		})
+	}
+	f.mu.Unlock()
+
+	if rejected {
+		f.reply(w, apnsId, rejection.status, rejection.reason)
+		return
+	}
+	f.reply(w, apnsId, http.StatusOK, "")
+}
+
+// Like APNs: the id in a header, and the reason as JSON for errors.
+func (f *FakeAPNs) reply(w http.ResponseWriter, apnsId string, status int, reason string) {
+	if apnsId != "" {
+		w.Header().Set("apns-id", apnsId)
+	}
+	if status == http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"reason": reason})
+}
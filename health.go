@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Set once we got the signal to stop; from then on we report not ready, so no new traffic comes in.
+var shuttingDown atomic.Bool
+
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+/**
+ * The process is up and serving. Says nothing about whether requests would succeed.
+ */
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, r, &HealthResponse{Status: "ok"})
+}
+
+/**
+ * Whether we can serve requests: the database is reachable and migrated, and pushes can be sent.
+ * Answers 503 if not, listing which checks fail. Why they fail goes to the log only, as anyone can
+ * ask.
+ */
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"database":   "ok",
+		"migrations": "ok",
+		"push":       "ok",
+	}
+	ready := true
+	fail := func(check string, problem string) {
+		Logger(r.Context()).Warn("not ready", "check", check, "problem", problem)
+		checks[check] = "failing"
+		ready = false
+	}
+
+	if shuttingDown.Load() {
+		fail("shutdown", "shutting down")
+	}
+
+	version, latest, err := DefaultStore().WithContext(r.Context()).SchemaVersion()
+	if err != nil {
+		fail("database", err.Error())
+		checks["migrations"] = "unknown"
+	} else if version != latest {
+		fail("migrations", fmt.Sprintf("at version %d of %d, run createdb", version, latest))
+	}
+
+	if _, err := PushClient(); err != nil {
+		fail("push", err.Error())
+	}
+
+	response := &HealthResponse{Status: "ok", Checks: checks}
+	if !ready {
+		response.Status = "unavailable"
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	WriteJSON(w, r, response)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miracle2k/photobeam-server/client"
+	"github.com/urfave/cli/v2"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+type LoadTestOptions struct {
+	Server string
+	Pairs  int
+	// Cycles per pair; 0 to run until Duration is over.
+	Cycles   int
+	Duration time.Duration
+	// Photos are random bytes, between these sizes.
+	MinSize int
+	MaxSize int
+	// How long a pair waits between cycles.
+	Pause   time.Duration
+	Timeout time.Duration
+}
+
+/**
+ * How one kind of request fared. Latencies are of all requests, failed ones included.
+ */
+type LoadTestOperation struct {
+	Name   string        `json:"name"`
+	Count  int           `json:"count"`
+	Errors int           `json:"errors"`
+	P50    time.Duration `json:"p50"`
+	P90    time.Duration `json:"p90"`
+	P99    time.Duration `json:"p99"`
+	Max    time.Duration `json:"max"`
+
+	latencies []time.Duration
+}
+
+type LoadTestReport struct {
+	Pairs             int           `json:"pairs"`
+	Cycles            int           `json:"cycles"`
+	Duration          time.Duration `json:"duration"`
+	BytesSent         int64         `json:"bytesSent"`
+	CyclesPerSecond   float64       `json:"cyclesPerSecond"`
+	RequestsPerSecond float64       `json:"requestsPerSecond"`
+
+	Operations []*LoadTestOperation `json:"operations"`
+	// By "operation: error code", e.g. "get: no_payload".
+	Errors map[string]int `json:"errors"`
+}
+
+// Collects the measurements of all pairs.
+type loadTestRecorder struct {
+	sync.Mutex
+	operations map[string]*LoadTestOperation
+	errors     map[string]int
+	cycles     int
+	bytesSent  int64
+}
+
+// Operations in the order the report lists them.
+var loadTestOperations = []string{"register", "connect", "accept", "set", "query", "get", "clear"}
+
+/**
+ * Time a request, and count it as failed if it returns an error. Requests cut off because the
+ * test is over do not count.
+ */
+func (r *loadTestRecorder) measure(ctx context.Context, operation string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	elapsed := time.Since(start)
+	if err != nil && ctx.Err() != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	stats := r.operations[operation]
+	stats.Count++
+	stats.latencies = append(stats.latencies, elapsed)
+	if err != nil {
+		stats.Errors++
+		r.errors[operation+": "+loadTestErrorKind(err)]++
+	}
+	return err
+}
+
+// The API error code, or what kind of failure it was if the server did not answer with one.
+func loadTestErrorKind(err error) string {
+	if code := client.ErrorCode(err); code != "" {
+		return code
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	if errors.Is(err, errLoadTestMismatch) {
+		return "mismatch"
+	}
+	if errors.Is(err, errLoadTestMissing) {
+		return "missing"
+	}
+	return "transport"
+}
+
+var (
+	errLoadTestMismatch = errors.New("got a different photo than was sent")
+	errLoadTestMissing  = errors.New("the receiver was not told about the photo")
+)
+
+/**
+ * Register Pairs pairs of accounts against the server, connect each, and have them beam photos at
+ * each other: one sets a photo, the other queries, gets and clears it, then they swap. All pairs
+ * run at once.
+ */
+func RunLoadTest(ctx context.Context, options LoadTestOptions) *LoadTestReport {
+	recorder := &loadTestRecorder{operations: map[string]*LoadTestOperation{}, errors: map[string]int{}}
+	for _, name := range loadTestOperations {
+		recorder.operations[name] = &LoadTestOperation{Name: name}
+	}
+
+	// The default client keeps only two idle connections per host, which would have most
+	// requests open a new one.
+	httpClient := &http.Client{
+		Timeout:   options.Timeout,
+		Transport: &http.Transport{MaxIdleConnsPerHost: 2 * options.Pairs},
+	}
+
+	if options.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Duration)
+		defer cancel()
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < options.Pairs; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			runLoadTestPair(ctx, options, httpClient, recorder, rand.New(rand.NewSource(seed)))
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	report := &LoadTestReport{
+		Pairs:     options.Pairs,
+		Cycles:    recorder.cycles,
+		Duration:  elapsed,
+		BytesSent: recorder.bytesSent,
+		Errors:    recorder.errors,
+	}
+	requests := 0
+	for _, name := range loadTestOperations {
+		stats := recorder.operations[name]
+		sort.Slice(stats.latencies, func(i, j int) bool { return stats.latencies[i] < stats.latencies[j] })
+		stats.P50 = percentile(stats.latencies, 50)
+		stats.P90 = percentile(stats.latencies, 90)
+		stats.P99 = percentile(stats.latencies, 99)
+		stats.Max = percentile(stats.latencies, 100)
+		requests += stats.Count
+		report.Operations = append(report.Operations, stats)
+	}
+	report.CyclesPerSecond = float64(report.Cycles) / elapsed.Seconds()
+	report.RequestsPerSecond = float64(requests) / elapsed.Seconds()
+	return report
+}
+
+// Of sorted latencies; the nearest rank.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (len(sorted)*p + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func runLoadTestPair(ctx context.Context, options LoadTestOptions, httpClient *http.Client, recorder *loadTestRecorder, random *rand.Rand) {
+	clients := [2]*client.Client{}
+	accounts := [2]*client.AccountResponse{}
+	for i := range clients {
+		clients[i] = client.New(options.Server)
+		clients[i].HTTPClient = httpClient
+		err := recorder.measure(ctx, "register", func() (err error) {
+			accounts[i], err = clients[i].Register(ctx)
+			return err
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	err := recorder.measure(ctx, "connect", func() error {
+		_, err := clients[0].Connect(ctx, accounts[1].ConnectCode)
+		return err
+	})
+	if err != nil {
+		return
+	}
+	err = recorder.measure(ctx, "accept", func() error {
+		_, err := clients[1].Accept(ctx, accounts[0].AccountId)
+		return err
+	})
+	if err != nil {
+		return
+	}
+
+	for cycle := 0; options.Cycles == 0 || cycle < options.Cycles; cycle++ {
+		if ctx.Err() != nil {
+			return
+		}
+		sender, receiver := clients[cycle%2], clients[(cycle+1)%2]
+		if runLoadTestCycle(ctx, options, sender, receiver, recorder, random) {
+			recorder.Lock()
+			recorder.cycles++
+			recorder.Unlock()
+		}
+		if options.Pause > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(options.Pause):
+			}
+		}
+	}
+}
+
+// Returns whether the photo made it across.
+func runLoadTestCycle(ctx context.Context, options LoadTestOptions, sender *client.Client, receiver *client.Client, recorder *loadTestRecorder, random *rand.Rand) bool {
+	size := options.MinSize
+	if options.MaxSize > options.MinSize {
+		size += random.Intn(options.MaxSize - options.MinSize + 1)
+	}
+	photo := make([]byte, size)
+	random.Read(photo)
+
+	err := recorder.measure(ctx, "set", func() error {
+		_, err := sender.Set(ctx, photo)
+		return err
+	})
+	if err != nil {
+		return false
+	}
+	recorder.Lock()
+	recorder.bytesSent += int64(size)
+	recorder.Unlock()
+
+	err = recorder.measure(ctx, "query", func() error {
+		state, err := receiver.Query(ctx)
+		if err == nil && !state.ShouldFetch {
+			return errLoadTestMissing
+		}
+		return err
+	})
+	if err != nil {
+		return false
+	}
+	err = recorder.measure(ctx, "get", func() error {
+		data, err := receiver.Get(ctx)
+		if err == nil && !bytes.Equal(data, photo) {
+			return errLoadTestMismatch
+		}
+		return err
+	})
+	if err != nil {
+		return false
+	}
+	err = recorder.measure(ctx, "clear", func() error {
+		_, err := receiver.Clear(ctx)
+		return err
+	})
+	return err == nil
+}
+
+func printLoadTestReport(report *LoadTestReport) {
+	fmt.Printf("%d pairs, %d cycles in %s: %.1f cycles/s, %.1f requests/s, %.1f MB sent\n\n",
+		report.Pairs, report.Cycles, report.Duration.Round(time.Millisecond), report.CyclesPerSecond, report.RequestsPerSecond,
+		float64(report.BytesSent)/1e6)
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "operation\tcount\terrors\tp50\tp90\tp99\tmax\t")
+	for _, stats := range report.Operations {
+		fmt.Fprintf(table, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t\n", stats.Name, stats.Count, stats.Errors,
+			stats.P50.Round(time.Microsecond), stats.P90.Round(time.Microsecond),
+			stats.P99.Round(time.Microsecond), stats.Max.Round(time.Microsecond))
+	}
+	table.Flush()
+
+	if len(report.Errors) > 0 {
+		fmt.Println("\nErrors:")
+		kinds := make([]string, 0, len(report.Errors))
+		for kind := range report.Errors {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			fmt.Printf("  %-30s %d\n", kind, report.Errors[kind])
+		}
+	}
+}
+
+/**
+ * Finds out how many pairs a server can take. Every pair registers two new accounts, so do not
+ * point this at production.
+ */
+var loadtestCommand = &cli.Command{
+	Name:  "loadtest",
+	Usage: "simulate many pairs beaming photos against a server",
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "server", Value: "http://localhost:10000", EnvVars: []string{"PHOTOBEAM_SERVER"}, Usage: "URL of the server"},
+		&cli.IntFlag{Name: "pairs", Value: 10, Usage: "how many pairs beam at once"},
+		&cli.IntFlag{Name: "cycles", Value: 10, Usage: "photos each pair sends; 0 to run for --duration"},
+		&cli.DurationFlag{Name: "duration", Usage: "stop after this long"},
+		&cli.IntFlag{Name: "min-size", Value: 100 * 1024, Usage: "smallest photo, in bytes"},
+		&cli.IntFlag{Name: "max-size", Value: 2 * 1024 * 1024, Usage: "largest photo, in bytes"},
+		&cli.DurationFlag{Name: "pause", Usage: "how long each pair waits between photos"},
+		&cli.DurationFlag{Name: "timeout", Value: 30 * time.Second, Usage: "for each request"},
+		jsonFlag,
+	},
+	Action: func(c *cli.Context) error {
+		options := LoadTestOptions{
+			Server:   c.String("server"),
+			Pairs:    c.Int("pairs"),
+			Cycles:   c.Int("cycles"),
+			Duration: c.Duration("duration"),
+			MinSize:  c.Int("min-size"),
+			MaxSize:  c.Int("max-size"),
+			Pause:    c.Duration("pause"),
+			Timeout:  c.Duration("timeout"),
+		}
+		if options.Pairs < 1 || options.MinSize < 0 || options.MaxSize < options.MinSize {
+			return errors.New("need at least one pair, and --min-size no larger than --max-size")
+		}
+		if options.Cycles == 0 && options.Duration == 0 {
+			return errors.New("with --cycles 0, set a --duration")
+		}
+
+		report := RunLoadTest(c.Context, options)
+		if c.Bool("json") {
+			return printJSON(report)
+		}
+		printLoadTestReport(report)
+		return nil
+	},
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-pg/pg/v10"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/**
+ * Send all logging, including what still goes through the log package, to a leveled slog handler.
+ * Format is "json" (for production, one object per line) or "text".
+ */
+func SetupLogging(w io.Writer, level string, format string) error {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+/**
+ * The logger to use while serving a request: its lines carry the request id and trace id, and the
+ * account once the request is authenticated. Logic code gets the context from store.Context().
+ */
+func Logger(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		logger = logger.With("trace_id", span.TraceID().String())
+	}
+	info := requestInfoFrom(ctx)
+	if info == nil {
+		return logger
+	}
+	logger = logger.With("request_id", info.id)
+	if accountId := info.accountId.Load(); accountId != 0 {
+		logger = logger.With("account_id", accountId)
+	}
+	return logger
+}
+
+/**
+ * Log every request once it was answered, with how it went.
+ */
+func logRequest(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		Logger(r.Context()).Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remote_addr", r.RemoteAddr,
+			"status", status,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
+
+/**
+ * Logs every query at debug level, tagged with the request it was made for. The parameters stay
+ * out, as they are as private as what users send us.
+ */
+type queryLogHook struct{}
+
+func (queryLogHook) BeforeQuery(ctx context.Context, event *pg.QueryEvent) (context.Context, error) {
+	return ctx, nil
+}
+
+func (queryLogHook) AfterQuery(ctx context.Context, event *pg.QueryEvent) error {
+	logger := Logger(ctx)
+	if !logger.Enabled(ctx, slog.LevelDebug) {
+		return nil
+	}
+	attrs := []interface{}{"duration_ms", time.Since(event.StartTime).Milliseconds()}
+	if query, err := event.UnformattedQuery(); err == nil {
+		attrs = append(attrs, "query", string(query))
+	}
+	if event.Err != nil {
+		attrs = append(attrs, "error", event.Err)
+	}
+	logger.Debug("query", attrs...)
+	return nil
+}
@@ -2,41 +2,82 @@ package main
 
 import (
 	"errors"
-	"fmt"
-	"github.com/go-pg/pg/v10"
-	"github.com/go-pg/pg/v10/orm"
+	"go.opentelemetry.io/otel/attribute"
 	"time"
+	"unicode/utf8"
 )
 
+// Errors the functions here return for situations the client can run into; anything else means
+// something went wrong on our side.
+var (
+	ErrNoConnection      = errors.New("User has no connection")
+	ErrNoPendingRequest  = errors.New("No pending connection request from this account")
+	ErrBlocked           = errors.New("Account is blocked")
+	ErrNoPayload         = errors.New("No payload available")
+	ErrPayloadFetched    = errors.New("Payload already fetched")
+	ErrStalePublicKey    = errors.New("Payload is encrypted to a key the peer no longer has")
+	ErrInvalidEncryption = errors.New("Invalid encryption parameters")
+	ErrCaptionInvalid    = errors.New("Caption is too long, or not UTF-8")
+	ErrEmptyPayload      = errors.New("Payload has neither data nor a caption")
+	ErrInvalidKind       = errors.New("Payload kind is unknown, or its parts do not fit it")
+	ErrPayloadTooLarge   = errors.New("Payload is larger than its kind allows")
+)
+
+// Longest algorithm name and nonce a payload may declare. They are opaque to us, but we keep them.
+const (
+	maxAlgorithmLength = 64
+	maxNonceLength     = 64
+)
+
+// In characters. Enough for a note, and it still fits into an alert push.
+const maxCaptionLength = 1000
+
 /**
  * Find the current connection for this account.
+ *
+ * An invitee can have several pending requests besides a live connection; the live one wins,
+ * otherwise the most recent request.
  */
-func GetConnection(db *pg.DB, accountId int) (*Connection, error) {
+func GetConnection(store Store, accountId int) (*Connection, error) {
 	// Find a connection for this user.
-	connection := new(Connection)
-	err := db.Model(connection).Where("invitee_id = ?0 OR initiator_id = ?0", accountId).Select()
+	connections, err := store.ListConnections(accountId)
 	if err != nil {
-		return nil, errors.New("User has no connection")
+		return nil, err
+	}
+
+	// They come oldest first.
+	var connection *Connection
+	for i := range connections {
+		if connection == nil || connection.Status == PENDING || connections[i].Status != PENDING {
+			connection = &connections[i]
+		}
+	}
+	if connection == nil {
+		return nil, ErrNoConnection
 	}
 	return connection, nil
 }
 
 
 
-func UnlinkAnyConnection(db *pg.DB, account *Account, connectionIdToKeep int) error {
-	var query *orm.Query;
-	if connectionIdToKeep != 0 {
-		query = db.Model(new(Connection)).Where("(invitee_id = ?0 OR initiator_id = ?0) AND id != ?1", account.Id, connectionIdToKeep)
-	} else {
-		query = db.Model(new(Connection)).Where("invitee_id = ?0 OR initiator_id = ?0", account.Id)
-	}
-	_, err := query.Delete()
+func UnlinkAnyConnection(store Store, account *Account, connectionIdToKeep int) error {
+	connections, err := store.ListConnections(account.Id)
 	if err != nil {
-		panic(fmt.Sprintf("failed to delete %s", err))
+		return err
+	}
+	for _, connection := range connections {
+		if connection.Id == connectionIdToKeep {
+			continue
+		}
+		_, err = store.DeletePayloads(connection.Id)
+		if err != nil {
+			return err
+		}
+		err = store.DeleteConnection(connection.Id)
+		if err != nil {
+			return err
+		}
 	}
-
-	// TODO: Delete all payloads
-
 	return nil;
 }
 
@@ -44,11 +85,11 @@ func UnlinkAnyConnection(db *pg.DB, account *Account, connectionIdToKeep int) er
 /**
  * Create a pending connection to the target, and leave any current connections.
  */
-func LinkAccounts(db *pg.DB, initiator *Account, target *Account, Status string) error {
+func LinkAccounts(store Store, initiator *Account, target *Account, Status string) error {
 	// Initiator closes all their connections immediately.
-	err := UnlinkAnyConnection(db, initiator, 0)
+	err := UnlinkAnyConnection(store, initiator, 0)
 	if err != nil {
-		panic(fmt.Sprintf("failed to delete %s", err))
+		return err
 	}
 
 	// Create a new pending connection
@@ -58,7 +99,7 @@ func LinkAccounts(db *pg.DB, initiator *Account, target *Account, Status string)
 		Status:      Status,
 	}
 
-	err = db.Insert(connection)
+	err = store.InsertConnection(connection)
 	if err != nil {
 		return err
 	}
@@ -68,138 +109,210 @@ func LinkAccounts(db *pg.DB, initiator *Account, target *Account, Status string)
 /**
  * Accept a pending connection request, break any existing connection.
  */
-func AcceptLink(db *pg.DB, acceptor *Account, peerId int) error {
+func AcceptLink(store Store, acceptor *Account, peerId int) error {
+	blocked, err := IsBlocked(store, acceptor.Id, peerId)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return ErrBlocked
+	}
+
 	// Find such a connection
-	connection := new(Connection)
-	err := db.Model(connection).Where("invitee_id = ?0 AND initiator_id = ?1", acceptor.Id, peerId).Select()
+	connections, err := store.ListConnections(acceptor.Id)
 	if err != nil {
 		return err
 	}
+	var connection *Connection
+	for i := range connections {
+		if connections[i].InviteeId == acceptor.Id && connections[i].InitiatorId == peerId {
+			connection = &connections[i]
+		}
+	}
+	if connection == nil {
+		return ErrNoPendingRequest
+	}
 
 	// Set this connection to complete
 	connection.Status = "live"
 
 	// Update the connection
-	err = db.Update(connection)
+	err = store.UpdateConnection(connection)
 	if err != nil {
 		return err
 	}
 
 	// Delete all other connections by the acceptor.
-	err = UnlinkAnyConnection(db, acceptor, connection.Id)
+	err = UnlinkAnyConnection(store, acceptor, connection.Id)
 	if err != nil {
 		return err
 	}
 
-
+	RecordActivity(store, ActivityConnections)
 	return nil
 }
 
 /**
- * A user sets a new payload for the partner.
+ * A user sets a new payload for the partner. The caller fills in Data, Caption or both and, if the
+ * sender encrypted Data, KeyId, Algorithm and Nonce; the rest is up to us. A payload with only a
+ * caption is a text beam. Kind and the content types are optional, see checkPayloadKind.
  */
-func RecordNewPayload(db *pg.DB, senderId int, data []byte) (int, error) {
+func RecordNewPayload(store Store, senderId int, payload *Payload) (peerId int, err error) {
+	store, span := startSpan(store, "payload.store",
+		attribute.Int("photobeam.payload_size", len(payload.Data)+len(payload.Video)),
+		attribute.String("photobeam.payload_kind", payload.Kind),
+		attribute.Bool("photobeam.payload_encrypted", payload.KeyId != ""))
+	defer func() { endSpan(span, err) }()
+
+	if len(payload.Data) == 0 && len(payload.Caption) == 0 {
+		return 0, ErrEmptyPayload
+	}
+	if !utf8.Valid(payload.Caption) || utf8.RuneCount(payload.Caption) > maxCaptionLength {
+		return 0, ErrCaptionInvalid
+	}
+	if err := checkPayloadKind(payload); err != nil {
+		return 0, err
+	}
+
+	// An encrypted payload needs the key and the algorithm, and data to go with them; a plain one
+	// neither, nor a nonce.
+	encrypted := payload.KeyId != ""
+	if encrypted != (payload.Algorithm != "") || !encrypted && len(payload.Nonce) > 0 || encrypted && len(payload.Data) == 0 ||
+		len(payload.Algorithm) > maxAlgorithmLength || len(payload.Nonce) > maxNonceLength {
+		return 0, ErrInvalidEncryption
+	}
+
 	// Find a connection for this user.
-	connection, err := GetConnection(db, senderId)
+	connection, err := GetConnection(store, senderId)
 	if err != nil {
 		return 0, err
 	}
+	// Nothing goes over a request until it is accepted.
+	if connection.Status != "live" {
+		return 0, ErrNoConnection
+	}
+	peerId = connection.GetPeerId(senderId)
 
-	// replace any existing one (or change pk)
-	var query *orm.Query;
-	query = db.Model(new(Payload)).Where("connection_id = ?0 AND from_id = ?1", connection.Id, senderId)
-	_, err = query.Delete()
+	blocked, err := IsBlocked(store, senderId, peerId)
 	if err != nil {
-		panic(fmt.Sprintf("failed to delete %s", err))
+		return 0, err
+	}
+	if blocked {
+		return 0, ErrBlocked
 	}
 
-	// Create a new payload record
-	payload := &Payload{
-		ConnectionId: connection.Id,
-		FromId:       senderId,
-		TimeCreated:  time.Now(),
-		Fetched:      false,
-		Data:         data,
+	// The peer could not decrypt a payload for a key it replaced since.
+	if payload.KeyId != "" {
+		peer, err := store.GetAccount(peerId)
+		if err != nil {
+			return 0, err
+		}
+		if peer.PublicKeyId != payload.KeyId {
+			return 0, ErrStalePublicKey
+		}
 	}
 
-	err = db.Insert(payload)
+	// Replaces any existing payload
+	payload.ConnectionId = connection.Id
+	payload.FromId = senderId
+	payload.TimeCreated = time.Now()
+	payload.Fetched = false
+	size := len(payload.Data) + len(payload.Video)
+
+	err = SealPayload(payload)
+	if err != nil {
+		return 0, err
+	}
+	err = store.PutPayload(payload)
 	if err != nil {
 		return 0, err
 	}
+	payloadUploadBytes.Observe(float64(size))
 
-	return connection.GetPeerId(senderId), nil
+	RecordActivity(store, ActivityBeams)
+	return peerId, nil
 }
 
 /**
  * Check if there is a payload waiting for either user in this connection.
- * Return is: (accountHas, peerHas)
+ * Return is: (the one waiting for the account, or nil; whether the peer has one waiting)
  */
-func QueryPayload(db *pg.DB, connectionId int, accountId int) (bool, bool, error) {
-	var payloads []Payload
-	err := db.Model(&payloads).
-		Where("connection_id = ? AND fetched IS NULL", connectionId).
-		Limit(2).
-		Select();
-
+func QueryPayload(store Store, connectionId int, accountId int) (*Payload, bool, error) {
+	stored, err := store.ListPayloads(connectionId)
 	if err != nil {
-		return false, false, err
+		return nil, false, err
 	}
 
-	if len(payloads) == 0 {
-		return false, false, nil
-	} else if len(payloads) == 1 {
-		if payloads[0].FromId == accountId {
-			return false, true, nil
-		}  else {
-			return true, false, nil
+	var incoming *Payload
+	peerHas := false
+	for i, payload := range stored {
+		if payload.Fetched {
+			continue
+		}
+		if payload.FromId == accountId {
+			peerHas = true
+		} else {
+			incoming = &stored[i]
 		}
-	} else {
-		return true, true, nil
 	}
+	return incoming, peerHas, nil
 }
 
 /**
- * Get the payload for this user to download.
+ * Get the payload for this user to download, with how it was encrypted, if it was.
  */
-func FetchPayload(db *pg.DB, fetcherId int) ([]byte, error) {
+func FetchPayload(store Store, fetcherId int) (payload *Payload, err error) {
+	store, span := startSpan(store, "payload.fetch")
+	defer func() { endSpan(span, err) }()
+
 	// Find a connection for this user.
-	connection, err := GetConnection(db, fetcherId)
+	connection, err := GetConnection(store, fetcherId)
 	if err != nil {
-		return nil, errors.New("User has no connection")
+		return nil, err
 	}
 
 	peerId := connection.GetPeerId(fetcherId)
 
 	// Find a payload
-	payload := new(Payload)
-	err = db.Model(payload).Where("connection_id = ?0 AND from_id = ?1", connection.Id, peerId).Select()
+	payload, err = store.GetPayload(connection.Id, peerId)
+	if err == ErrNotFound {
+		return nil, ErrNoPayload
+	}
 	if err != nil {
-		return nil, errors.New("No payload available")
+		return nil, err
 	}
 
 	if payload.Fetched {
-		return nil, errors.New("Payload already fetched")
+		return nil, ErrPayloadFetched
 	}
 
-	return payload.Data, nil
+	err = OpenPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
 }
 
 /**
  * Once a client has the payload safely in their hands, mark it as fetched
  */
-func ClearPayload(db *pg.DB, fetcherId int) error {
+func ClearPayload(store Store, fetcherId int) (err error) {
+	store, span := startSpan(store, "payload.clear")
+	defer func() { endSpan(span, err) }()
+
 	// Find a connection for this user.
-	connection := new(Connection)
-	err := db.Model(connection).Where("invitee_id = ?0 OR initiator_id = ?0", fetcherId).Select()
+	connection, err := GetConnection(store, fetcherId)
 	if err != nil {
-		return errors.New("User has no connection")
+		return err
 	}
 
 	peerId := connection.GetPeerId(fetcherId)
 
 	// Find a payload
-	payload := new(Payload)
-	err = db.Model(payload).Where("connection_id = ?0 AND from_id = ?1", connection.Id, peerId).Select()
+	payload, err := store.GetPayload(connection.Id, peerId)
+	if err == ErrNotFound {
+		return ErrNoPayload
+	}
 	if err != nil {
 		return err
 	}
@@ -209,9 +322,9 @@ func ClearPayload(db *pg.DB, fetcherId int) error {
 	}
 
 	payload.Fetched = true
-	payload.Data = nil
+	payload.Data, payload.Caption, payload.Video, payload.DataKey, payload.MasterKeyId = nil, nil, nil, nil, ""
 
-	err = db.Update(payload)
+	err = store.UpdatePayload(payload)
 	if err != nil {
 		return err
 	}
@@ -1,54 +1,205 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"github.com/sideshow/apns2"
 	"github.com/urfave/cli/v2" // imports as package "cli"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-func logRequest(handler http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
-		handler.ServeHTTP(w, r)
-	})
-}
+/**
+ * Serve until SIGTERM (or Ctrl-C), then shut down gracefully. Returns an error if a listener
+ * failed, or if the shutdown did not finish in time.
+ */
+func handleRequests(adminAddr string, adminToken string, metricsAddr string, shutdownTimeout time.Duration) error {
+	servers := map[string]*http.Server{
+		"api": {Addr: ":10000", Handler: NewAPIHandler()},
+	}
+	if metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", NewMetricsHandler(DefaultStore()))
+		servers["metrics"] = &http.Server{Addr: metricsAddr, Handler: mux}
+	}
+	if adminToken != "" {
+		servers["admin"] = &http.Server{Addr: adminAddr, Handler: withRequestId(logRequest(withRecovery(NewAdminRouter(adminToken))))}
+	} else {
+		slog.Warn("no admin token set, not starting the admin API")
+	}
+
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancel()
+
+	// The server is no use with one of its listeners gone, so that stops it too.
+	failed := make(chan error, len(servers))
+	for name, server := range servers {
+		go func(name string, server *http.Server) {
+			slog.Info("listening", "listener", name, "addr", server.Addr)
+			err := server.ListenAndServe()
+			if err != http.ErrServerClosed {
+				failed <- fmt.Errorf("%s listener: %w", name, err)
+			}
+		}(name, server)
+	}
+
+	var result error
+	select {
+	case <-stop.Done():
+		slog.Info("shutting down", "timeout", shutdownTimeout.String())
+	case result = <-failed:
+		slog.Error("listener failed, shutting down", "error", result)
+	}
+	shuttingDown.Store(true)
 
-func handleRequests() {
-	http.HandleFunc("/register", RegisterHandler)
-	http.HandleFunc("/setprops", SetPropsHandler)
-	http.HandleFunc("/connect", ConnectHandler)
-	http.HandleFunc("/disconnect", DisconnectHandler)
-	http.HandleFunc("/query", QueryHandler)
-	http.HandleFunc("/accept", AcceptHandler)
-	http.HandleFunc("/set", SetPictureHandler)
-	http.HandleFunc("/get", GetPictureHandler)
-	http.HandleFunc("/clear", ClearPictureHandler)
+	// Stop accepting connections and let in-flight requests finish, then the background work they
+	// started. Whatever is not done by the deadline is cut off.
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	for name, server := range servers {
+		if err := server.Shutdown(ctx); err != nil && result == nil {
+			result = fmt.Errorf("%s listener did not shut down cleanly: %w", name, err)
+		}
+	}
+	if err := WaitForBackground(ctx); err != nil && result == nil {
+		result = fmt.Errorf("background work did not finish: %w", err)
+	}
+	DefaultStore().Close()
 
-	log.Print("Running on port :10000")
-	log.Fatal(http.ListenAndServe(":10000", logRequest(http.DefaultServeMux)))
+	slog.Info("stopped")
+	return result
 }
 
+// Flushes the spans which were not exported yet; set by SetupTracing.
+var shutdownTracing func(context.Context) error
+
 func main() {
 	app := &cli.App{
 		Name:  "photobeam-server",
 		Usage: "go beam!",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "log-level",
+				Value:   "info",
+				EnvVars: []string{"PHOTOBEAM_LOG_LEVEL"},
+				Usage:   "debug (includes all queries), info, warn or error",
+			},
+			&cli.StringFlag{
+				Name:    "log-format",
+				Value:   "json",
+				EnvVars: []string{"PHOTOBEAM_LOG_FORMAT"},
+				Usage:   "json or text",
+			},
+			&cli.StringFlag{
+				Name:    "trace-exporter",
+				Value:   "none",
+				EnvVars: []string{"PHOTOBEAM_TRACE_EXPORTER"},
+				Usage:   "none, stdout or otlp (set OTEL_EXPORTER_OTLP_ENDPOINT)",
+			},
+			&cli.StringFlag{
+				Name:    "apns-url",
+				Value:   apns2.HostDevelopment,
+				EnvVars: []string{"PHOTOBEAM_APNS_URL"},
+				Usage:   "where to send pushes; " + apns2.HostProduction + " for App Store builds",
+			},
+			&cli.StringFlag{
+				Name:    "database",
+				Value:   "postgres",
+				EnvVars: []string{"PHOTOBEAM_DATABASE"},
+				Usage:   "postgres, or sqlite for a file in --data-dir",
+			},
+			&cli.StringFlag{
+				Name:    "data-dir",
+				Value:   "./data",
+				EnvVars: []string{"PHOTOBEAM_DATA_DIR"},
+				Usage:   "where the sqlite database is kept",
+			},
+			&cli.StringFlag{
+				Name:    "master-key",
+				EnvVars: []string{"PHOTOBEAM_MASTER_KEY"},
+				Usage:   "encrypt payloads at rest with this key (32 bytes, base64 encoded); better use --master-key-file",
+			},
+			&cli.StringFlag{
+				Name:    "master-key-file",
+				EnvVars: []string{"PHOTOBEAM_MASTER_KEY_FILE"},
+				Usage:   "read the master key from this file",
+			},
+			&cli.StringSliceFlag{
+				Name:    "previous-master-key-file",
+				EnvVars: []string{"PHOTOBEAM_PREVIOUS_MASTER_KEY_FILES"},
+				Usage:   "older master keys, for payloads rotate-master-key has not re-wrapped yet",
+			},
+		},
+		Before: func(c *cli.Context) error {
+			err := SetupLogging(os.Stderr, c.String("log-level"), c.String("log-format"))
+			if err != nil {
+				return err
+			}
+			ConfigurePush(c.String("apns-url"))
+			err = ConfigureStore(c.String("database"), c.String("data-dir"))
+			if err != nil {
+				return err
+			}
+			err = configureMasterKeysFromFlags(c)
+			if err != nil {
+				return err
+			}
+			shutdownTracing, err = SetupTracing(c.Context, c.String("trace-exporter"))
+			return err
+		},
+		After: func(c *cli.Context) error {
+			if shutdownTracing == nil {
+				return nil
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return shutdownTracing(ctx)
+		},
 		Commands: []*cli.Command{
 			{
 				Name:  "run",
 				Usage: "run the server",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "admin-addr",
+						Value:   "127.0.0.1:10001",
+						EnvVars: []string{"PHOTOBEAM_ADMIN_ADDR"},
+						Usage:   "where to serve the admin API and dashboard",
+					},
+					&cli.StringFlag{
+						Name:    "admin-token",
+						EnvVars: []string{"PHOTOBEAM_ADMIN_TOKEN"},
+						Usage:   "secret for the admin API; without it, the admin API is off",
+					},
+					&cli.StringFlag{
+						Name:    "metrics-addr",
+						Value:   "127.0.0.1:10002",
+						EnvVars: []string{"PHOTOBEAM_METRICS_ADDR"},
+						Usage:   "where to serve /metrics for Prometheus; empty to turn it off",
+					},
+					&cli.DurationFlag{
+						Name:    "shutdown-timeout",
+						Value:   30 * time.Second,
+						EnvVars: []string{"PHOTOBEAM_SHUTDOWN_TIMEOUT"},
+						Usage:   "how long to wait for requests and pushes to finish on SIGTERM",
+					},
+				},
 				Action: func(c *cli.Context) error {
-					handleRequests()
-					return nil
+					return handleRequests(c.String("admin-addr"), c.String("admin-token"), c.String("metrics-addr"), c.Duration("shutdown-timeout"))
 				},
 			},
 			{
 				Name:  "createdb",
-				Usage: "create the database",
+				Usage: "create the database, or migrate an existing one",
 				Action: func(c *cli.Context) error {
-					db := Connect()
-					CreateSchema(db)
-					return nil
+					store := OpenStore()
+					defer store.Close()
+					return store.CreateSchema()
 				},
 			},
 			{
@@ -56,17 +207,51 @@ func main() {
 				Usage: "test push notification service",
 				Flags: []cli.Flag{
 					&cli.IntFlag{Name: "account"},
+					&cli.BoolFlag{Name: "fake", Usage: "send to a local fake APNs server, and print what it got"},
+					&cli.StringFlag{
+						Name:  "fake-error",
+						Usage: "with --fake, reject the pushes: BadDeviceToken, Unregistered (the tokens are forgotten, as they would be for real), TooManyRequests or InternalServerError",
+					},
 				},
 				Action: func(c *cli.Context) error {
+					var fake *FakeAPNs
+					if c.Bool("fake") {
+						fake = StartFakeAPNs()
+						defer fake.Close()
+						if reason := c.String("fake-error"); reason != "" {
+							status, found := FakeAPNsErrors[reason]
+							if !found {
+								return fmt.Errorf("unknown APNs error %q", reason)
+							}
+							fake.Reject("", status, reason)
+						}
+						SetPushClient(fake.Client())
+					}
+
 					accountId := c.Int("account")
-					db := Connect()
-					err := SendNotificationToAccountId(db, accountId)
+					store := OpenStore()
+					defer store.Close()
+					err := SendNotificationToAccountId(store, accountId)
 					if err != nil {
-						log.Println("Error: ", err)
+						slog.Error("push failed", "account_id", accountId, "error", err)
+					}
+
+					if fake != nil {
+						notifications := fake.Notifications()
+						fmt.Printf("The fake APNs server got %d push(es)\n", len(notifications))
+						for _, notification := range notifications {
+							fmt.Printf("%s  %s  %s  %s\n", notification.DeviceToken, notification.Topic, notification.PushType, notification.Payload)
+						}
 					}
 					return nil
 				},
 			},
+			accountsCommand,
+			statsCommand,
+			clientCommand,
+			loadtestCommand,
+			rotateMasterKeyCommand,
+			reportsCommand,
 		},
 	}
 	err := app.Run(os.Args)
@@ -2,89 +2,448 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/go-pg/pg/v10"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
-func IntMin(a, b int) int {
-	if a < b {
-		return a
+/**
+ * Serve the handlers from an empty in-memory store for the rest of the test.
+ */
+func UseMemoryStore(t *testing.T) Store {
+	store := NewMemoryStore()
+	SetDefaultStore(store)
+	t.Cleanup(func() { SetDefaultStore(nil) })
+	return store
+}
+
+/**
+ * Accept only the given kinds, with their limits, for the rest of the test.
+ */
+func UsePayloadKinds(t *testing.T, kinds map[string]payloadKind) {
+	payloadKindsOverride.Store(&kinds)
+	t.Cleanup(func() { payloadKindsOverride.Store(nil) })
+}
+
+func TestRegisterHandler(t *testing.T) {
+	UseMemoryStore(t)
+
+	req, err := http.NewRequest("GET", "/register", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(RegisterHandler)
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	var response AccountResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.AccountId == 0 || response.DeviceId == 0 || response.AuthKey == "" || response.ConnectCode == "" {
+		t.Errorf("handler returned an incomplete account: %v", rr.Body.String())
 	}
-	return b
 }
 
-func TestIntMinBasic(t *testing.T) {
-	ans := IntMin(2, -2)
-	if ans != -2 {
+/**
+ * Insert an account with a single device; the device's plaintext key is in device.Key.
+ */
+func CreateTestAccount(store Store, connectCode string) (*Account, *Device) {
+	account, device, err := CreateAccount(store, "test", PLATFORM_IOS)
+	if err != nil {
+		panic(err)
+	}
+	account.ConnectCode = connectCode
+	err = store.UpdateAccount(account)
+	if err != nil {
+		panic(err)
+	}
+	return account, device
+}
 
-		t.Errorf("IntMin(2, -2) = %d; want -2", ans)
+func TestAuthKeyHashing(t *testing.T) {
+	key, prefix, hash := NewAuthKey()
+	if prefix != key[:authKeyPrefixLength] {
+		t.Errorf("prefix %q is not the start of key %q", prefix, key)
+	}
+	if hash != HashAuthKey(key) {
+		t.Errorf("hash does not match the key")
+	}
+	if strings.Contains(hash, key) {
+		t.Errorf("hash contains the plaintext key")
+	}
+
+	otherKey, _, otherHash := NewAuthKey()
+	if otherKey == key || otherHash == hash {
+		t.Errorf("two generated keys are the same")
 	}
 }
 
-func TestIntMinTableDriven(t *testing.T) {
+func TestRouter(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	router := NewRouter()
+	router.HandleRoutes("/v1", []Route{
+		{Method: http.MethodGet, Path: "/query", Handler: ok},
+		{Method: http.MethodPost, Path: "/set", Handler: ok},
+	})
+	router.HandleRoutesAnyMethod("", []Route{
+		{Method: http.MethodPost, Path: "/set", Handler: ok},
+	})
+
 	var tests = []struct {
-		a, b int
-		want int
+		method, path string
+		want         int
 	}{
-		{0, 1, 0},
-		{1, 0, 0},
-		{2, -2, -2},
-		{0, -1, -1},
-		{-1, 0, -1},
+		{"GET", "/v1/query", http.StatusOK},
+		{"HEAD", "/v1/query", http.StatusOK},
+		{"POST", "/v1/query", http.StatusMethodNotAllowed},
+		{"POST", "/v1/set", http.StatusOK},
+		{"GET", "/v1/set", http.StatusMethodNotAllowed},
+		{"GET", "/set", http.StatusOK},
+		{"POST", "/set", http.StatusOK},
+		{"GET", "/v1/unknown", http.StatusNotFound},
+		{"GET", "/v2/query", http.StatusNotFound},
 	}
 
 	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, nil))
+			if rr.Code != tt.want {
+				t.Errorf("got %d, want %d", rr.Code, tt.want)
+			}
+			if rr.Code == http.StatusMethodNotAllowed && rr.Header().Get("Allow") == "" {
+				t.Errorf("405 response without Allow header")
+			}
+		})
+	}
+}
 
-		testname := fmt.Sprintf("%d,%d", tt.a, tt.b)
-		t.Run(testname, func(t *testing.T) {
-			ans := IntMin(tt.a, tt.b)
-			if ans != tt.want {
-				t.Errorf("got %d, want %d", ans, tt.want)
+func TestLegacyRoutes(t *testing.T) {
+	UseMemoryStore(t)
+	router := NewAPIRouter()
+
+	// What the iOS app shipped with answers without a prefix and to any method; nothing newer does.
+	for _, path := range []string{"/query", "/set", "/get", "/clear"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, path, nil))
+		if rr.Code == http.StatusNotFound || rr.Code == http.StatusMethodNotAllowed {
+			t.Errorf("POST %s: got %d, want the handler of /v1%s", path, rr.Code, path)
+		}
+	}
+	for _, path := range []string{"/devices", "/devices/pair", "/block", "/report", "/delete-account", "/export", "/get/video"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, path, nil))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("POST %s: got %d, want 404", path, rr.Code)
+		}
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	var tests = []struct {
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{ErrNoPayload, http.StatusNotFound, "no_payload"},
+		{ErrNoConnection, http.StatusConflict, "no_connection"},
+		{errors.New("pg: database is on fire"), http.StatusInternalServerError, "internal_error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.wantCode, func(t *testing.T) {
+			handler := withRequestId(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				WriteLogicError(w, r, tt.err, "Testing")
+			}))
+			req := httptest.NewRequest("GET", "/v1/get", nil)
+			req.Header.Set("X-Request-Id", "req-1")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rr.Code, tt.wantStatus)
+			}
+			var response ErrorResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Error.Code != tt.wantCode {
+				t.Errorf("got code %q, want %q", response.Error.Code, tt.wantCode)
+			}
+			if response.Error.RequestId != "req-1" {
+				t.Errorf("got request id %q, want %q", response.Error.RequestId, "req-1")
+			}
+			if strings.Contains(response.Error.Message, "fire") {
+				t.Errorf("internal error text leaked to the client: %q", response.Error.Message)
 			}
 		})
 	}
 }
 
-func TestRegisterHandler(t *testing.T) {
-	req, err := http.NewRequest("GET", "/register", nil)
-	if err != nil {
+func TestRecovery(t *testing.T) {
+	handler := withRequestId(withRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var account *Account
+		fmt.Fprint(w, account.Id)
+	})))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/query", nil))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+	var response ErrorResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
 		t.Fatal(err)
 	}
+	if response.Error.Code != "internal_error" || response.Error.RequestId == "" {
+		t.Errorf("unexpected error response: %+v", response.Error)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	handler := withAdminAuth("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	var tests = []struct {
+		name  string
+		setup func(r *http.Request)
+		want  int
+	}{
+		{"no credentials", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized},
+		{"bearer token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, http.StatusNoContent},
+		{"basic auth", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/stats", nil)
+			tt.setup(req)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("got status %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
 
+	// What a form on another site could send with the credentials the browser cached.
+	UseMemoryStore(t)
+	account, _ := CreateTestAccount(DefaultStore(), "code1")
+	admin := NewAdminRouter("secret")
+	req := httptest.NewRequest("POST", "/api/account/delete", strings.NewReader(fmt.Sprintf(`{"accountId": %d}`, account.Id)))
+	req.Header.Set("Content-Type", "text/plain")
+	req.SetBasicAuth("admin", "secret")
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(RegisterHandler)
+	admin.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("basic auth on an action: got status %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+	if _, err := DefaultStore().GetAccount(account.Id); err != nil {
+		t.Errorf("the account was deleted: %v", err)
+	}
 
-	handler.ServeHTTP(rr, req)
+	// Without a token configured, nothing gets in.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	rr = httptest.NewRecorder()
+	withAdminAuth("", handler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("empty token: got status %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+}
 
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusOK)
+func TestAdminResolveReportHandler(t *testing.T) {
+	UseMemoryStore(t)
+	admin := NewAdminRouter("secret")
+
+	req := httptest.NewRequest("POST", "/api/report/resolve", strings.NewReader(`{"reportId": 42}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	rr := httptest.NewRecorder()
+	admin.ServeHTTP(rr, req)
+	ExpectAPIError(t, "resolve a report which does not exist", rr, APIErrNoSuchReport)
+}
+
+func TestDashboardTemplate(t *testing.T) {
+	var page bytes.Buffer
+	err := dashboardTemplate.Execute(&page, map[string]interface{}{
+		"Stats":    &AdminStats{Accounts: 42},
+		"Activity": []DailyActivity{{Day: time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC), Beams: 7}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(page.String(), "2020-05-01") || !strings.Contains(page.String(), "42") {
+		t.Errorf("dashboard is missing data:\n%s", page.String())
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	router := NewRouter()
+	router.Handle("GET", "/v1/query", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler := withMetrics(router, router)
+
+	// Other tests serve requests too; only count ours.
+	matched := httpRequestsTotal.WithLabelValues("/v1/query", "GET", "200")
+	unmatched := httpRequestsTotal.WithLabelValues("unmatched", "GET", "404")
+	matchedBefore, unmatchedBefore := testutil.ToFloat64(matched), testutil.ToFloat64(unmatched)
+
+	for _, path := range []string{"/v1/query", "/v1/query", "/random/1", "/random/2"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	if count := testutil.ToFloat64(matched) - matchedBefore; count != 2 {
+		t.Errorf("got %v requests for /v1/query, want 2", count)
+	}
+	if count := testutil.ToFloat64(unmatched) - unmatchedBefore; count != 2 {
+		t.Errorf("got %v unmatched requests, want 2", count)
+	}
+}
+
+func TestRequestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	// The global provider only takes effect once per process, so swap the tracer itself.
+	previous := tracer
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	defer func() { tracer = previous }()
+
+	router := NewRouter()
+	router.Handle("GET", "/v1/query", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetRequestAccount(r.Context(), 42)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	withTracing(router, router).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/query", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "GET /v1/query" {
+		t.Errorf("got span %q", span.Name())
+	}
+	if span.Status().Code != codes.Error {
+		t.Errorf("got status %v for a 500, want error", span.Status().Code)
+	}
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	if got := attributes["photobeam.account_id"].AsInt64(); got != 42 {
+		t.Errorf("got account id %d, want 42", got)
+	}
+	if got := attributes["http.response.status_code"].AsInt64(); got != 500 {
+		t.Errorf("got status code %d, want 500", got)
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	var output bytes.Buffer
+	if err := SetupLogging(&output, "info", "json"); err != nil {
+		t.Fatal(err)
+	}
+	defer slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	handler := withRequestId(logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetRequestAccount(r.Context(), 42)
+		Logger(r.Context()).Info("inside")
+		w.WriteHeader(http.StatusTeapot)
+	})))
+	req := httptest.NewRequest("GET", "/v1/query", nil)
+	req.Header.Set("X-Request-Id", "abc")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2:\n%s", len(lines), output.String())
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["msg"] != "request" || entry["request_id"] != "abc" || entry["account_id"] != 42.0 || entry["status"] != 418.0 {
+		t.Errorf("unexpected request log line: %s", lines[1])
+	}
+}
+
+func TestQueryLogging(t *testing.T) {
+	var output bytes.Buffer
+	if err := SetupLogging(&output, "debug", "json"); err != nil {
+		t.Fatal(err)
+	}
+	defer slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	event := &pg.QueryEvent{
+		StartTime: time.Now(),
+		Query:     "UPDATE payloads SET caption = ? WHERE id = ?",
+		Params:    []interface{}{"for your eyes only", 1},
+	}
+	if err := (queryLogHook{}).AfterQuery(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if logged := output.String(); !strings.Contains(logged, "SET caption = ?") || strings.Contains(logged, "for your eyes only") {
+		t.Errorf("got %s, want the query without its parameters", logged)
+	}
+}
+
+func TestBackgroundWork(t *testing.T) {
+	release := make(chan struct{})
+	RunInBackground(context.Background(), "test", func(ctx context.Context) {
+		<-release
+	})
+	RunInBackground(context.Background(), "panics", func(ctx context.Context) {
+		panic("oops")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := WaitForBackground(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v while work was still running, want a timeout", err)
 	}
 
-	expected := `{"alive": true}`
-	if rr.Body.String() != expected {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			rr.Body.String(), expected)
+	close(release)
+	if err := WaitForBackground(context.Background()); err != nil {
+		t.Errorf("got %v after the work finished", err)
 	}
 }
 
-func RunConnectHandler(from *Account, to *Account) (string, error) {
+func RunConnectHandler(from *Device, to *Account) (string, error) {
 	buf := new(bytes.Buffer)
 	json.NewEncoder(buf).Encode(ConnectArguments{
 		ConnectCode: to.ConnectCode,
 	})
 
-	req, err := http.NewRequest("GET", "/connect", buf)
+	req, err := http.NewRequest("POST", "/v1/connect", buf)
 	if err != nil {
 		return "", err
 	}
 	req.Header.Set("Authorization", from.Key)
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(ConnectHandler)
+	handler := NewAPIRouter()
 
 	handler.ServeHTTP(rr, req)
 
@@ -97,43 +456,262 @@ func RunConnectHandler(from *Account, to *Account) (string, error) {
 }
 
 func TestConnectHandler(t *testing.T) {
-	db := Connect()
-	defer db.Close()
+	store := UseMemoryStore(t)
 
 	// Create a set of accounts
-	account1 := &Account{
-		Key:         "key1",
-		ConnectCode: "code1",
+	account1, device1 := CreateTestAccount(store, "code1")
+	account2, _ := CreateTestAccount(store, "code2")
+	account3, _ := CreateTestAccount(store, "code3")
+	account4, _ := CreateTestAccount(store, "code4")
+
+	// Prelink certain accounts
+	LinkAccounts(store, account1, account2, "live")
+	LinkAccounts(store, account3, account4, "live")
+
+	// Connection request 1 to 3
+	body, err := RunConnectHandler(device1, account3)
+	if err != nil {
+		t.Fatal(err)
 	}
-	account2 := &Account{
-		Key:         "key2",
-		ConnectCode: "code2",
+	var state StateResponse
+	if err := json.Unmarshal([]byte(body), &state); err != nil {
+		t.Fatal(err)
 	}
-	account3 := &Account{
-		Key:         "key3",
-		ConnectCode: "code3",
+	if state.PeerId != account3.Id || state.Status != PENDING {
+		t.Errorf("handler returned unexpected state: %v", body)
 	}
-	account4 := &Account{
-		Key:         "key4",
-		ConnectCode: "code4",
+
+	// Result: 1 loses its pair, 3 does not.
+	if _, err := GetConnection(store, account2.Id); err != ErrNoConnection {
+		t.Errorf("account 2 is still connected: %v", err)
 	}
-	err := db.Insert(account1, account2, account3, account4)
+	connection, err := GetConnection(store, account3.Id)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+	if connection.GetPeerId(account3.Id) != account4.Id {
+		t.Errorf("account 3 is connected to %d, want %d", connection.GetPeerId(account3.Id), account4.Id)
 	}
+}
 
-	// Prelink certain accounts
-	LinkAccounts(db, account1, account2, "live")
-	LinkAccounts(db, account3, account4, "live")
+/**
+ * Call the API as the given device, or without credentials if it is nil. A non-nil body is sent as
+ * JSON.
+ */
+func RunHandler(from *Device, method string, path string, body interface{}) *httptest.ResponseRecorder {
+	buf := new(bytes.Buffer)
+	if body != nil {
+		json.NewEncoder(buf).Encode(body)
+	}
+	req := httptest.NewRequest(method, path, buf)
+	if from != nil {
+		req.Header.Set("Authorization", from.Key)
+	}
 
-	// Connection request 1 to 3
-	body, err := RunConnectHandler(account1, account3)
-	expected := `{"alive": true}`
-	if body != expected {
-		t.Errorf("handler returned unexpected body: got %v want %v", body, expected)
+	rr := httptest.NewRecorder()
+	NewAPIRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestSetPropsHandler(t *testing.T) {
+	store := UseMemoryStore(t)
+	account, device := CreateTestAccount(store, "code1")
+
+	// A bad avatar fails the whole request, including the fields before it.
+	name, token, notAnImage := "alice", "token-alice", []byte("not an image")
+	rr := RunHandler(device, http.MethodPost, "/v1/setprops", SetPropsArguments{ApnsToken: &token, DisplayName: &name, Avatar: &notAnImage})
+	if rr.Code != APIErrInvalidAvatar.Status {
+		t.Fatalf("got %d for an invalid avatar: %s", rr.Code, rr.Body.String())
+	}
+	stored, err := store.GetAccount(account.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err := store.ListDevices(account.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.DisplayName != "" || devices[0].PushToken != "" {
+		t.Errorf("a failed request saved the name %q and the token %q", stored.DisplayName, devices[0].PushToken)
 	}
 
-	// Result: 1 loses its pair, 3 does not.
+	avatar := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 32)...)
+	rr = RunHandler(device, http.MethodPost, "/v1/setprops", SetPropsArguments{ApnsToken: &token, DisplayName: &name, Avatar: &avatar})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rr.Code, rr.Body.String())
+	}
+	stored, err = store.GetAccount(account.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err = store.ListDevices(account.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.DisplayName != name || devices[0].PushToken != token {
+		t.Errorf("got the name %q and the token %q", stored.DisplayName, devices[0].PushToken)
+	}
+	if _, err := store.GetAvatar(account.Id); err != nil {
+		t.Errorf("the avatar was not saved: %v", err)
+	}
 
-	// connection between 2 and 3 is removed
+	longName, badPlatform := strings.Repeat("ü", 51), "iOS"
+	rr = RunHandler(device, http.MethodPost, "/v1/setprops", SetPropsArguments{DeviceName: &longName})
+	ExpectAPIError(t, "a long device name", rr, APIErrInvalidDevice)
+	rr = RunHandler(device, http.MethodPost, "/v1/setprops", SetPropsArguments{Platform: &badPlatform})
+	ExpectAPIError(t, "a platform in capitals", rr, APIErrInvalidDevice)
+}
+
+// Fail unless the response is the given API error.
+func ExpectAPIError(t *testing.T, step string, rr *httptest.ResponseRecorder, want *APIError) {
+	t.Helper()
+	var response ErrorResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("%s: %v", step, err)
+	}
+	if rr.Code != want.Status || response.Error.Code != want.Code {
+		t.Errorf("%s: got %d %q, want %d %q", step, rr.Code, response.Error.Code, want.Status, want.Code)
+	}
+}
+
+func TestAddDeviceHandler(t *testing.T) {
+	store := UseMemoryStore(t)
+	account, device := CreateTestAccount(store, "code1")
+
+	rr := RunHandler(device, http.MethodPost, "/v1/devices/pair", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rr.Code, rr.Body.String())
+	}
+	var pairing PairingResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &pairing); err != nil {
+		t.Fatal(err)
+	}
+
+	// A bad name or platform is refused before the code is used up.
+	invalid := map[string]AddDeviceArguments{
+		"long name":           {PairingCode: pairing.PairingCode, DeviceName: strings.Repeat("i", 51)},
+		"control characters":  {PairingCode: pairing.PairingCode, DeviceName: "i\x00pad"},
+		"platform with space": {PairingCode: pairing.PairingCode, Platform: "iPadOS 17"},
+		"long platform":       {PairingCode: pairing.PairingCode, Platform: strings.Repeat("x", 21)},
+	}
+	for name, args := range invalid {
+		rr = RunHandler(nil, http.MethodPost, "/v1/devices/add", args)
+		ExpectAPIError(t, name, rr, APIErrInvalidDevice)
+	}
+
+	rr = RunHandler(nil, http.MethodPost, "/v1/devices/add", AddDeviceArguments{PairingCode: pairing.PairingCode, DeviceName: "ipad"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rr.Code, rr.Body.String())
+	}
+	var added AccountResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &added); err != nil {
+		t.Fatal(err)
+	}
+	if added.AccountId != account.Id || added.DeviceId == device.Id || added.AuthKey == "" {
+		t.Errorf("got %+v, want a new device of account %d", added, account.Id)
+	}
+
+	// The new device is signed in with a key of its own.
+	rr = RunHandler(&Device{Key: added.AuthKey}, http.MethodGet, "/v1/devices", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("listing the devices with the new key: got %d", rr.Code)
+	}
+	var devices []DeviceResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &devices); err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Errorf("got %d devices, want 2", len(devices))
+	}
+
+	rr = RunHandler(nil, http.MethodPost, "/v1/devices/add", AddDeviceArguments{PairingCode: pairing.PairingCode})
+	ExpectAPIError(t, "redeeming a code twice", rr, APIErrInvalidPairingCode)
+
+	expired := &DevicePairing{Code: "EXPIRED", AccountId: account.Id, TimeExpires: time.Now().Add(-time.Minute)}
+	if err := store.InsertPairing(expired); err != nil {
+		t.Fatal(err)
+	}
+	rr = RunHandler(nil, http.MethodPost, "/v1/devices/add", AddDeviceArguments{PairingCode: expired.Code})
+	ExpectAPIError(t, "redeeming an expired code", rr, APIErrInvalidPairingCode)
+
+	rr = RunHandler(nil, http.MethodPost, "/v1/devices/add", AddDeviceArguments{PairingCode: "UNKNOWN"})
+	ExpectAPIError(t, "redeeming an unknown code", rr, APIErrInvalidPairingCode)
+}
+
+func TestRevokeDeviceHandler(t *testing.T) {
+	store := UseMemoryStore(t)
+	account, phone := CreateTestAccount(store, "code1")
+	_, other := CreateTestAccount(store, "code2")
+	ipad, err := CreateDevice(store, account.Id, "ipad", PLATFORM_IOS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := RunHandler(phone, http.MethodPost, "/v1/devices/revoke", RevokeDeviceArguments{DeviceId: other.Id})
+	ExpectAPIError(t, "revoking the device of another account", rr, APIErrNoSuchDevice)
+
+	rr = RunHandler(phone, http.MethodPost, "/v1/devices/revoke", RevokeDeviceArguments{DeviceId: ipad.Id})
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = RunHandler(ipad, http.MethodGet, "/v1/query", nil)
+	ExpectAPIError(t, "querying with a revoked key", rr, APIErrUnauthorized)
+
+	rr = RunHandler(phone, http.MethodPost, "/v1/devices/revoke", RevokeDeviceArguments{DeviceId: phone.Id})
+	ExpectAPIError(t, "revoking the last device", rr, APIErrLastDevice)
+	rr = RunHandler(phone, http.MethodGet, "/v1/query", nil)
+	if rr.Code != http.StatusOK {
+		t.Errorf("the last device was signed out: got %d", rr.Code)
+	}
+}
+
+// A store which cannot count activity.
+type noActivityStore struct {
+	Store
+}
+
+func (noActivityStore) IncrementActivity(time.Time, string) error {
+	return errors.New("the table is gone")
+}
+
+func TestActivityIsBestEffort(t *testing.T) {
+	store := noActivityStore{NewMemoryStore()}
+
+	alice, _, err := CreateAccount(store, "iPhone", "ios")
+	if err != nil {
+		t.Fatalf("registering: %v", err)
+	}
+	bob, _, err := CreateAccount(store, "iPhone", "ios")
+	if err != nil {
+		t.Fatalf("registering: %v", err)
+	}
+	if err := LinkAccounts(store, alice, bob, "pending"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AcceptLink(store, bob, alice.Id); err != nil {
+		t.Errorf("accepting: %v", err)
+	}
+	if _, err := RecordNewPayload(store, alice.Id, &Payload{Data: []byte("a photo")}); err != nil {
+		t.Errorf("sending: %v", err)
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	UseMemoryStore(t)
+	// Without a push client, loading the certificate fails.
+	SetPushClient(nil)
+
+	rr := httptest.NewRecorder()
+	ReadyzHandler(rr, httptest.NewRequest("GET", "/readyz", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want 503", rr.Code)
+	}
+	var response HealthResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"database": "ok", "migrations": "ok", "push": "failing"}
+	if fmt.Sprint(response.Checks) != fmt.Sprint(want) || strings.Contains(rr.Body.String(), "cert") {
+		t.Errorf("got %s, want only which check fails", rr.Body.String())
+	}
 }
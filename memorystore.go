@@ -0,0 +1,675 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type payloadKey struct {
+	connectionId int
+	fromId       int
+}
+
+type blockKey struct {
+	blockerId int
+	blockedId int
+}
+
+type memoryData struct {
+	accounts    map[int]Account
+	devices     map[int]Device
+	pairings    map[string]DevicePairing
+	connections map[int]Connection
+	payloads    map[payloadKey]Payload
+	blocks      map[blockKey]Block
+	avatars     map[int]Avatar
+	reports     map[int]Report
+	activity    map[string]DailyActivity // By day, as 2006-01-02
+
+	// The last id handed out, per table.
+	lastAccountId, lastDeviceId, lastConnectionId, lastReportId int
+}
+
+func (data *memoryData) clone() *memoryData {
+	copied := *data
+	copied.accounts = maps.Clone(data.accounts)
+	copied.devices = maps.Clone(data.devices)
+	copied.pairings = maps.Clone(data.pairings)
+	copied.connections = maps.Clone(data.connections)
+	copied.payloads = maps.Clone(data.payloads)
+	copied.blocks = maps.Clone(data.blocks)
+	copied.avatars = maps.Clone(data.avatars)
+	copied.reports = maps.Clone(data.reports)
+	copied.activity = maps.Clone(data.activity)
+	return &copied
+}
+
+/**
+ * A Store which keeps everything in maps, for tests. Safe to use from several goroutines; a
+ * transaction holds the lock until it is done, and is undone from a copy if it fails.
+ */
+type memoryStore struct {
+	mu   *sync.Mutex
+	data *memoryData
+	inTx bool // The lock is held by the transaction already
+	ctx  context.Context
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{
+		mu: new(sync.Mutex),
+		data: &memoryData{
+			accounts:    map[int]Account{},
+			devices:     map[int]Device{},
+			pairings:    map[string]DevicePairing{},
+			connections: map[int]Connection{},
+			payloads:    map[payloadKey]Payload{},
+			blocks:      map[blockKey]Block{},
+			avatars:     map[int]Avatar{},
+			reports:     map[int]Report{},
+			activity:    map[string]DailyActivity{},
+		},
+		ctx: context.Background(),
+	}
+}
+
+// Use as defer s.lock()().
+func (s *memoryStore) lock() func() {
+	if s.inTx {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+func (s *memoryStore) Context() context.Context {
+	return s.ctx
+}
+
+func (s *memoryStore) WithContext(ctx context.Context) Store {
+	return &memoryStore{mu: s.mu, data: s.data, inTx: s.inTx, ctx: ctx}
+}
+
+func (s *memoryStore) RunInTransaction(fn func(tx Store) error) error {
+	if s.inTx {
+		return fn(s)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := s.data.clone()
+	err := fn(&memoryStore{mu: s.mu, data: s.data, inTx: true, ctx: s.ctx})
+	if err != nil {
+		*s.data = *snapshot
+	}
+	return err
+}
+
+func (s *memoryStore) CreateSchema() error {
+	return nil
+}
+
+func (s *memoryStore) SchemaVersion() (int, int, error) {
+	return 0, 0, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) InsertAccount(account *Account) error {
+	defer s.lock()()
+	s.data.lastAccountId++
+	account.Id = s.data.lastAccountId
+	s.data.accounts[account.Id] = *account
+	return nil
+}
+
+func (s *memoryStore) GetAccount(accountId int) (*Account, error) {
+	defer s.lock()()
+	account, ok := s.data.accounts[accountId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &account, nil
+}
+
+func (s *memoryStore) GetAccountByConnectCode(connectCode string) (*Account, error) {
+	defer s.lock()()
+	for _, account := range s.data.accounts {
+		if account.ConnectCode == connectCode {
+			return &account, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryStore) UpdateAccount(account *Account) error {
+	defer s.lock()()
+	stored, ok := s.data.accounts[account.Id]
+	if !ok {
+		return nil
+	}
+	stored.ConnectCode = account.ConnectCode
+	stored.DisplayName = account.DisplayName
+	stored.PublicKey = account.PublicKey
+	stored.PublicKeyAlgorithm = account.PublicKeyAlgorithm
+	stored.PublicKeyId = account.PublicKeyId
+	s.data.accounts[account.Id] = stored
+	return nil
+}
+
+func (s *memoryStore) SearchAccounts(search string, limit int) ([]Account, error) {
+	defer s.lock()()
+	id, err := strconv.Atoi(search)
+	if err != nil {
+		id = -1
+	}
+	accounts := []Account{}
+	for _, account := range s.data.accounts {
+		if search == "" || account.Id == id || account.ConnectCode == search ||
+			strings.Contains(strings.ToLower(account.DisplayName), strings.ToLower(search)) {
+			accounts = append(accounts, account)
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Id > accounts[j].Id })
+	if len(accounts) > limit {
+		accounts = accounts[:limit]
+	}
+	return accounts, nil
+}
+
+func (s *memoryStore) DeleteAccount(accountId int) error {
+	defer s.lock()()
+	for id, connection := range s.data.connections {
+		if connection.InitiatorId == accountId || connection.InviteeId == accountId {
+			s.deletePayloads(id)
+			delete(s.data.connections, id)
+		}
+	}
+	for key := range s.data.payloads {
+		if key.fromId == accountId {
+			delete(s.data.payloads, key)
+		}
+	}
+	for key := range s.data.blocks {
+		if key.blockerId == accountId || key.blockedId == accountId {
+			delete(s.data.blocks, key)
+		}
+	}
+	for id, report := range s.data.reports {
+		if report.ReporterId == accountId {
+			delete(s.data.reports, id)
+		} else if report.ReportedId == accountId {
+			report.PayloadData, report.PayloadCaption, report.PayloadVideo = nil, nil, nil
+			report.PayloadDataKey, report.PayloadMasterKeyId = nil, ""
+			s.data.reports[id] = report
+		}
+	}
+	for code, pairing := range s.data.pairings {
+		if pairing.AccountId == accountId {
+			delete(s.data.pairings, code)
+		}
+	}
+	for id, device := range s.data.devices {
+		if device.AccountId == accountId {
+			delete(s.data.devices, id)
+		}
+	}
+	delete(s.data.avatars, accountId)
+	delete(s.data.accounts, accountId)
+	return nil
+}
+
+func (s *memoryStore) InsertDevice(device *Device) error {
+	defer s.lock()()
+	s.data.lastDeviceId++
+	device.Id = s.data.lastDeviceId
+	stored := *device
+	stored.Key = ""
+	s.data.devices[device.Id] = stored
+	return nil
+}
+
+func (s *memoryStore) UpdateDevice(device *Device) error {
+	defer s.lock()()
+	if _, ok := s.data.devices[device.Id]; ok {
+		stored := *device
+		stored.Key = ""
+		s.data.devices[device.Id] = stored
+	}
+	return nil
+}
+
+func (s *memoryStore) ListDevices(accountId int) ([]Device, error) {
+	defer s.lock()()
+	devices := []Device{}
+	for _, device := range s.data.devices {
+		if device.AccountId == accountId {
+			devices = append(devices, device)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Id < devices[j].Id })
+	return devices, nil
+}
+
+func (s *memoryStore) FindDevicesByKeyPrefix(keyPrefix string) ([]Device, error) {
+	defer s.lock()()
+	devices := []Device{}
+	for _, device := range s.data.devices {
+		if device.KeyPrefix == keyPrefix {
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+func (s *memoryStore) DeleteDevice(accountId int, deviceId int) (bool, error) {
+	defer s.lock()()
+	device, ok := s.data.devices[deviceId]
+	if !ok || device.AccountId != accountId {
+		return false, nil
+	}
+	delete(s.data.devices, deviceId)
+	return true, nil
+}
+
+func (s *memoryStore) ResetPushTokens(accountId int) (int, error) {
+	defer s.lock()()
+	count := 0
+	for id, device := range s.data.devices {
+		if device.AccountId == accountId && device.PushToken != "" {
+			device.PushToken = ""
+			s.data.devices[id] = device
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) InsertPairing(pairing *DevicePairing) error {
+	defer s.lock()()
+	s.data.pairings[pairing.Code] = *pairing
+	return nil
+}
+
+func (s *memoryStore) TakePairing(code string) (*DevicePairing, error) {
+	defer s.lock()()
+	pairing, ok := s.data.pairings[code]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	delete(s.data.pairings, code)
+	return &pairing, nil
+}
+
+func (s *memoryStore) DeleteExpiredPairings(now time.Time) error {
+	defer s.lock()()
+	for code, pairing := range s.data.pairings {
+		if pairing.TimeExpires.Before(now) {
+			delete(s.data.pairings, code)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) InsertConnection(connection *Connection) error {
+	defer s.lock()()
+	s.data.lastConnectionId++
+	connection.Id = s.data.lastConnectionId
+	s.data.connections[connection.Id] = *connection
+	return nil
+}
+
+func (s *memoryStore) UpdateConnection(connection *Connection) error {
+	defer s.lock()()
+	stored, ok := s.data.connections[connection.Id]
+	if ok {
+		stored.Status = connection.Status
+		s.data.connections[connection.Id] = stored
+	}
+	return nil
+}
+
+func (s *memoryStore) ListConnections(accountId int) ([]Connection, error) {
+	defer s.lock()()
+	connections := []Connection{}
+	for _, connection := range s.data.connections {
+		if connection.InitiatorId == accountId || connection.InviteeId == accountId {
+			connections = append(connections, connection)
+		}
+	}
+	sort.Slice(connections, func(i, j int) bool { return connections[i].Id < connections[j].Id })
+	return connections, nil
+}
+
+func (s *memoryStore) DeleteConnection(connectionId int) error {
+	defer s.lock()()
+	delete(s.data.connections, connectionId)
+	return nil
+}
+
+func (s *memoryStore) PutPayload(payload *Payload) error {
+	defer s.lock()()
+	s.data.payloads[payloadKey{payload.ConnectionId, payload.FromId}] = *payload
+	return nil
+}
+
+func (s *memoryStore) GetPayload(connectionId int, fromId int) (*Payload, error) {
+	defer s.lock()()
+	payload, ok := s.data.payloads[payloadKey{connectionId, fromId}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &payload, nil
+}
+
+func (s *memoryStore) ListPayloads(connectionId int) ([]Payload, error) {
+	defer s.lock()()
+	payloads := []Payload{}
+	for key, payload := range s.data.payloads {
+		if key.connectionId == connectionId {
+			payloads = append(payloads, payload)
+		}
+	}
+	sort.Slice(payloads, func(i, j int) bool { return payloads[i].TimeCreated.Before(payloads[j].TimeCreated) })
+	return payloads, nil
+}
+
+func (s *memoryStore) ListAccountPayloads(accountId int) ([]Payload, error) {
+	defer s.lock()()
+	payloads := []Payload{}
+	for key, payload := range s.data.payloads {
+		connection, ok := s.data.connections[key.connectionId]
+		if key.fromId == accountId || ok && (connection.InitiatorId == accountId || connection.InviteeId == accountId) {
+			payloads = append(payloads, payload)
+		}
+	}
+	sort.Slice(payloads, func(i, j int) bool { return payloads[i].TimeCreated.Before(payloads[j].TimeCreated) })
+	return payloads, nil
+}
+
+func (s *memoryStore) UpdatePayload(payload *Payload) error {
+	defer s.lock()()
+	key := payloadKey{payload.ConnectionId, payload.FromId}
+	if _, ok := s.data.payloads[key]; ok {
+		s.data.payloads[key] = *payload
+	}
+	return nil
+}
+
+func (s *memoryStore) DeletePayloads(connectionId int) (int, error) {
+	defer s.lock()()
+	return s.deletePayloads(connectionId), nil
+}
+
+func (s *memoryStore) ListPayloadsToSeal(masterKeyId string, limit int) ([]Payload, error) {
+	defer s.lock()()
+	payloads := []Payload{}
+	for _, payload := range s.data.payloads {
+		if (len(payload.Data) > 0 || len(payload.Caption) > 0 || len(payload.Video) > 0) && payload.MasterKeyId != masterKeyId {
+			payloads = append(payloads, payload)
+		}
+	}
+	sort.Slice(payloads, func(i, j int) bool {
+		if payloads[i].ConnectionId != payloads[j].ConnectionId {
+			return payloads[i].ConnectionId < payloads[j].ConnectionId
+		}
+		return payloads[i].FromId < payloads[j].FromId
+	})
+	if len(payloads) > limit {
+		payloads = payloads[:limit]
+	}
+	return payloads, nil
+}
+
+func (s *memoryStore) ResealPayload(payload *Payload, previousMasterKeyId string) (bool, error) {
+	defer s.lock()()
+	key := payloadKey{payload.ConnectionId, payload.FromId}
+	stored, ok := s.data.payloads[key]
+	if !ok || !stored.TimeCreated.Equal(payload.TimeCreated) || stored.Fetched || stored.MasterKeyId != previousMasterKeyId {
+		return false, nil
+	}
+	stored.Data, stored.Caption, stored.Video = payload.Data, payload.Caption, payload.Video
+	stored.DataKey, stored.MasterKeyId = payload.DataKey, payload.MasterKeyId
+	s.data.payloads[key] = stored
+	return true, nil
+}
+
+// The lock must be held.
+func (s *memoryStore) deletePayloads(connectionId int) int {
+	count := 0
+	for key := range s.data.payloads {
+		if key.connectionId == connectionId {
+			delete(s.data.payloads, key)
+			count++
+		}
+	}
+	return count
+}
+
+func (s *memoryStore) InsertBlock(block *Block) error {
+	defer s.lock()()
+	key := blockKey{block.BlockerId, block.BlockedId}
+	if _, ok := s.data.blocks[key]; !ok {
+		s.data.blocks[key] = *block
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteBlock(blockerId int, blockedId int) error {
+	defer s.lock()()
+	delete(s.data.blocks, blockKey{blockerId, blockedId})
+	return nil
+}
+
+func (s *memoryStore) ListBlocks(accountId int) ([]Block, error) {
+	defer s.lock()()
+	blocks := []Block{}
+	for key, block := range s.data.blocks {
+		if key.blockerId == accountId || key.blockedId == accountId {
+			blocks = append(blocks, block)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].BlockerId != blocks[j].BlockerId {
+			return blocks[i].BlockerId < blocks[j].BlockerId
+		}
+		return blocks[i].BlockedId < blocks[j].BlockedId
+	})
+	return blocks, nil
+}
+
+func (s *memoryStore) PutAvatar(avatar *Avatar) error {
+	defer s.lock()()
+	s.data.avatars[avatar.AccountId] = *avatar
+	return nil
+}
+
+func (s *memoryStore) GetAvatar(accountId int) (*Avatar, error) {
+	defer s.lock()()
+	avatar, ok := s.data.avatars[accountId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &avatar, nil
+}
+
+func (s *memoryStore) GetAvatarHash(accountId int) (string, error) {
+	defer s.lock()()
+	return s.data.avatars[accountId].Hash, nil
+}
+
+func (s *memoryStore) DeleteAvatar(accountId int) error {
+	defer s.lock()()
+	delete(s.data.avatars, accountId)
+	return nil
+}
+
+func (s *memoryStore) InsertReport(report *Report) error {
+	defer s.lock()()
+	s.data.lastReportId++
+	report.Id = s.data.lastReportId
+	s.data.reports[report.Id] = *report
+	return nil
+}
+
+func (s *memoryStore) GetReport(reportId int) (*Report, error) {
+	defer s.lock()()
+	report, ok := s.data.reports[reportId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &report, nil
+}
+
+// The lock must be held.
+func (s *memoryStore) listReports(include func(report *Report) bool) []Report {
+	reports := []Report{}
+	for _, report := range s.data.reports {
+		if include(&report) {
+			report.PayloadData, report.PayloadCaption, report.PayloadVideo = nil, nil, nil
+			reports = append(reports, report)
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Id < reports[j].Id })
+	return reports
+}
+
+func (s *memoryStore) ListReports(includeResolved bool) ([]Report, error) {
+	defer s.lock()()
+	return s.listReports(func(report *Report) bool {
+		return includeResolved || report.TimeResolved.IsZero()
+	}), nil
+}
+
+func (s *memoryStore) ListReportsFiledBy(reporterId int) ([]Report, error) {
+	defer s.lock()()
+	return s.listReports(func(report *Report) bool {
+		return report.ReporterId == reporterId
+	}), nil
+}
+
+func (s *memoryStore) CountReports(accountId int) (int, int, error) {
+	defer s.lock()()
+	filed, against := 0, 0
+	for _, report := range s.data.reports {
+		if report.ReporterId == accountId {
+			filed++
+		}
+		if report.ReportedId == accountId {
+			against++
+		}
+	}
+	return filed, against, nil
+}
+
+func (s *memoryStore) ListReportsToSeal(masterKeyId string, limit int) ([]Report, error) {
+	defer s.lock()()
+	reports := []Report{}
+	for _, report := range s.data.reports {
+		if (len(report.PayloadData) > 0 || len(report.PayloadCaption) > 0 || len(report.PayloadVideo) > 0) && report.PayloadMasterKeyId != masterKeyId {
+			reports = append(reports, report)
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Id < reports[j].Id })
+	if len(reports) > limit {
+		reports = reports[:limit]
+	}
+	return reports, nil
+}
+
+func (s *memoryStore) ResealReport(report *Report, previousMasterKeyId string) (bool, error) {
+	defer s.lock()()
+	stored, ok := s.data.reports[report.Id]
+	if !ok || stored.PayloadData == nil && stored.PayloadCaption == nil && stored.PayloadVideo == nil || stored.PayloadMasterKeyId != previousMasterKeyId {
+		return false, nil
+	}
+	stored.PayloadData, stored.PayloadCaption, stored.PayloadVideo = report.PayloadData, report.PayloadCaption, report.PayloadVideo
+	stored.PayloadDataKey, stored.PayloadMasterKeyId = report.PayloadDataKey, report.PayloadMasterKeyId
+	s.data.reports[report.Id] = stored
+	return true, nil
+}
+
+func (s *memoryStore) ResolveReport(reportId int, now time.Time) error {
+	defer s.lock()()
+	report, ok := s.data.reports[reportId]
+	if !ok {
+		return ErrNotFound
+	}
+	report.TimeResolved.Time = now
+	report.PayloadData, report.PayloadCaption, report.PayloadVideo = nil, nil, nil
+	report.PayloadDataKey, report.PayloadMasterKeyId = nil, ""
+	s.data.reports[reportId] = report
+	return nil
+}
+
+func (s *memoryStore) IncrementActivity(day time.Time, column string) error {
+	defer s.lock()()
+	key := day.Format("2006-01-02")
+	activity, ok := s.data.activity[key]
+	if !ok {
+		activity.Day, _ = time.Parse("2006-01-02", key)
+	}
+	switch column {
+	case ActivityRegistrations:
+		activity.Registrations++
+	case ActivityConnections:
+		activity.Connections++
+	case ActivityBeams:
+		activity.Beams++
+	}
+	s.data.activity[key] = activity
+	return nil
+}
+
+func (s *memoryStore) ListActivity(since time.Time) ([]DailyActivity, error) {
+	defer s.lock()()
+	sinceKey := since.Format("2006-01-02")
+	activity := []DailyActivity{}
+	for key, day := range s.data.activity {
+		if key >= sinceKey {
+			activity = append(activity, day)
+		}
+	}
+	sort.Slice(activity, func(i, j int) bool { return activity[i].Day.After(activity[j].Day) })
+	return activity, nil
+}
+
+func (s *memoryStore) Stats() (*AdminStats, error) {
+	defer s.lock()()
+	stats := &AdminStats{
+		Accounts: len(s.data.accounts),
+		Devices:  len(s.data.devices),
+		Blocks:   len(s.data.blocks),
+	}
+	for _, device := range s.data.devices {
+		if device.PushToken != "" {
+			stats.DevicesWithPush++
+		}
+	}
+	for _, connection := range s.data.connections {
+		if connection.Status == PENDING {
+			stats.ConnectionsPending++
+		} else {
+			stats.ConnectionsLive++
+		}
+	}
+	for _, payload := range s.data.payloads {
+		if payload.Data != nil {
+			stats.PayloadsWaiting++
+		}
+		stats.PayloadBytes += len(payload.Data) + len(payload.Video)
+	}
+	for _, report := range s.data.reports {
+		if report.TimeResolved.IsZero() {
+			stats.OpenReports++
+		}
+	}
+	return stats, nil
+}
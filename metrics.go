@@ -0,0 +1,144 @@
+package main
+
+import (
+	"github.com/go-pg/pg/v10"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "photobeam_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "photobeam_http_request_duration_seconds",
+		Help:    "How long it took to answer HTTP requests, by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	payloadUploadBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "photobeam_payload_upload_bytes",
+		Help:    "Size of the payloads clients upload.",
+		Buckets: prometheus.ExponentialBuckets(16*1024, 2, 14), // 16 KB to 128 MB, past the largest video
+	})
+
+	// Use rate(photobeam_events_total{event="beams"}[1h]) for beams per hour.
+	eventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "photobeam_events_total",
+		Help: "Registrations, accepted connections and beams.",
+	}, []string{"event"})
+
+	pushNotificationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "photobeam_push_notifications_total",
+		Help: "Push notifications we tried to send, by result and the reason APNs gave.",
+	}, []string{"result", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequestsTotal,
+		httpRequestDuration,
+		payloadUploadBytes,
+		eventsTotal,
+		pushNotificationsTotal,
+	)
+}
+
+/**
+ * Count requests and their latency, by route.
+ */
+func withMetrics(router *Router, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(recorder, r)
+
+		route := router.RouteLabel(r.URL.Path)
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+/**
+ * Reports the state of the database on every scrape: the stats of the connection pool (on
+ * Postgres), and how many connections between accounts there are.
+ */
+type dbCollector struct {
+	store Store
+
+	poolHits        *prometheus.Desc
+	poolMisses      *prometheus.Desc
+	poolTimeouts    *prometheus.Desc
+	poolConns       *prometheus.Desc
+	poolIdleConns   *prometheus.Desc
+	poolStaleConns  *prometheus.Desc
+	connections     *prometheus.Desc
+	pendingPayloads *prometheus.Desc
+}
+
+func newDBCollector(store Store) *dbCollector {
+	return &dbCollector{
+		store:           store,
+		poolHits:        prometheus.NewDesc("photobeam_db_pool_hits_total", "Times a free connection was found in the pool.", nil, nil),
+		poolMisses:      prometheus.NewDesc("photobeam_db_pool_misses_total", "Times a free connection was not found in the pool.", nil, nil),
+		poolTimeouts:    prometheus.NewDesc("photobeam_db_pool_timeouts_total", "Times a wait for a connection timed out.", nil, nil),
+		poolConns:       prometheus.NewDesc("photobeam_db_pool_connections", "Connections in the pool.", nil, nil),
+		poolIdleConns:   prometheus.NewDesc("photobeam_db_pool_idle_connections", "Idle connections in the pool.", nil, nil),
+		poolStaleConns:  prometheus.NewDesc("photobeam_db_pool_stale_connections_total", "Stale connections removed from the pool.", nil, nil),
+		connections:     prometheus.NewDesc("photobeam_connections", "Connections between accounts, by status.", []string{"status"}, nil),
+		pendingPayloads: prometheus.NewDesc("photobeam_pending_payloads", "Payloads which were not cleared yet.", nil, nil),
+	}
+}
+
+func (collector *dbCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collector.poolHits
+	ch <- collector.poolMisses
+	ch <- collector.poolTimeouts
+	ch <- collector.poolConns
+	ch <- collector.poolIdleConns
+	ch <- collector.poolStaleConns
+	ch <- collector.connections
+	ch <- collector.pendingPayloads
+}
+
+func (collector *dbCollector) Collect(ch chan<- prometheus.Metric) {
+	if pool, ok := collector.store.(interface{ PoolStats() *pg.PoolStats }); ok {
+		stats := pool.PoolStats()
+		ch <- prometheus.MustNewConstMetric(collector.poolHits, prometheus.CounterValue, float64(stats.Hits))
+		ch <- prometheus.MustNewConstMetric(collector.poolMisses, prometheus.CounterValue, float64(stats.Misses))
+		ch <- prometheus.MustNewConstMetric(collector.poolTimeouts, prometheus.CounterValue, float64(stats.Timeouts))
+		ch <- prometheus.MustNewConstMetric(collector.poolConns, prometheus.GaugeValue, float64(stats.TotalConns))
+		ch <- prometheus.MustNewConstMetric(collector.poolIdleConns, prometheus.GaugeValue, float64(stats.IdleConns))
+		ch <- prometheus.MustNewConstMetric(collector.poolStaleConns, prometheus.CounterValue, float64(stats.StaleConns))
+	}
+
+	stats, err := collector.store.Stats()
+	if err != nil {
+		slog.Warn("collecting database metrics failed", "error", err)
+		return
+	}
+	// Only pending and live exist; report both even when there are none.
+	ch <- prometheus.MustNewConstMetric(collector.connections, prometheus.GaugeValue, float64(stats.ConnectionsPending), PENDING)
+	ch <- prometheus.MustNewConstMetric(collector.connections, prometheus.GaugeValue, float64(stats.ConnectionsLive), "live")
+	ch <- prometheus.MustNewConstMetric(collector.pendingPayloads, prometheus.GaugeValue, float64(stats.PayloadsWaiting))
+}
+
+/**
+ * The handler for /metrics, including the stats of the given store.
+ */
+func NewMetricsHandler(store Store) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newDBCollector(store))
+	gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+	return promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+type requestInfoKey struct{}
+
+/**
+ * What we know about the request being served, for its log lines.
+ */
+type requestInfo struct {
+	id        string
+	accountId atomic.Int64 // Set once the request is authenticated
+}
+
+/**
+ * Give every request an id, which is returned in the X-Request-Id header and in error responses,
+ * so a client report can be matched to our logs. A proxy in front of us may already have set one.
+ */
+func withRequestId(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get("X-Request-Id")
+		if requestId == "" || len(requestId) > 64 {
+			b := make([]byte, 8)
+			cryptorand.Read(b)
+			requestId = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-Id", requestId)
+		ctx := context.WithValue(r.Context(), requestInfoKey{}, &requestInfo{id: requestId})
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+func RequestId(ctx context.Context) string {
+	if info := requestInfoFrom(ctx); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+/**
+ * Remember which account the request is made by, so it shows up in the log and the trace.
+ */
+func SetRequestAccount(ctx context.Context, accountId int) {
+	if info := requestInfoFrom(ctx); info != nil {
+		info.accountId.Store(int64(accountId))
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("photobeam.account_id", accountId))
+}
+
+/**
+ * Turn a panic in a handler into a logged 500, instead of net/http just dropping the connection.
+ * Handlers should return errors for anything that can go wrong at runtime; a panic here is a bug.
+ */
+func withRecovery(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				// Deliberate abort, net/http knows what to do.
+				panic(recovered)
+			}
+
+			Logger(r.Context()).Error("panic serving request",
+				"method", r.Method, "path", r.URL.Path, "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+			if recorder.status == 0 {
+				WriteError(recorder, r, APIErrInternal)
+			}
+		}()
+		handler.ServeHTTP(recorder, r)
+	})
+}
+
+/**
+ * Remembers the status code written to the response.
+ */
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(b []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return recorder.ResponseWriter.Write(b)
+}
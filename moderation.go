@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrBlockSelf = errors.New("Cannot block yourself")
+
+/**
+ * Returns true if either of the two accounts has blocked the other.
+ */
+func IsBlocked(store Store, accountId int, otherId int) (bool, error) {
+	blocks, err := store.ListBlocks(accountId)
+	if err != nil {
+		return false, err
+	}
+	for _, block := range blocks {
+		if block.BlockerId == otherId || block.BlockedId == otherId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+/**
+ * Block another account. Any connection between the two (pending or live) is removed along
+ * with its payloads, and the blocked account can no longer link to the blocker.
+ */
+func BlockAccount(store Store, blocker *Account, blockedId int) error {
+	if blocker.Id == blockedId {
+		return ErrBlockSelf
+	}
+
+	block := &Block{
+		BlockerId:   blocker.Id,
+		BlockedId:   blockedId,
+		TimeCreated: time.Now(),
+	}
+	err := store.InsertBlock(block)
+	if err != nil {
+		return err
+	}
+
+	return UnlinkAccounts(store, blocker.Id, blockedId)
+}
+
+/**
+ * Remove a block again. This does not restore any connection that was removed.
+ */
+func UnblockAccount(store Store, blocker *Account, blockedId int) error {
+	return store.DeleteBlock(blocker.Id, blockedId)
+}
+
+/**
+ * Delete the connection between exactly these two accounts, if there is one.
+ */
+func UnlinkAccounts(store Store, accountId int, otherId int) error {
+	connections, err := store.ListConnections(accountId)
+	if err != nil {
+		return err
+	}
+
+	for _, connection := range connections {
+		if connection.GetPeerId(accountId) != otherId {
+			continue
+		}
+		_, err = store.DeletePayloads(connection.Id)
+		if err != nil {
+			return err
+		}
+		err = store.DeleteConnection(connection.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * File a report against the current peer of the reporter. The connection and the payload the peer
+ * sent (if it has not been cleared yet) are copied into the report.
+ */
+func ReportPeer(store Store, reporter *Account, reason string) (*Report, error) {
+	connection, err := GetConnection(store, reporter.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	peerId := connection.GetPeerId(reporter.Id)
+	report := &Report{
+		ReporterId:            reporter.Id,
+		ReportedId:            peerId,
+		Reason:                reason,
+		ConnectionId:          connection.Id,
+		ConnectionInitiatorId: connection.InitiatorId,
+		ConnectionInviteeId:   connection.InviteeId,
+		ConnectionStatus:      connection.Status,
+		TimeCreated:           time.Now(),
+	}
+
+	payload, err := store.GetPayload(connection.Id, peerId)
+	if err == nil {
+		// Still encrypted at rest, with the data key of the payload.
+		report.PayloadData = payload.Data
+		report.PayloadCaption = payload.Caption
+		report.PayloadKind = payload.GetKind()
+		report.PayloadContentType = payload.ContentType
+		report.PayloadVideo = payload.Video
+		report.PayloadVideoContentType = payload.VideoContentType
+		report.PayloadDataKey = payload.DataKey
+		report.PayloadMasterKeyId = payload.MasterKeyId
+		report.PayloadTimeCreated.Time = payload.TimeCreated
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	err = store.InsertReport(report)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+/**
+ * List reports for moderators, oldest first. Resolved reports are only included if asked for.
+ */
+func ListReports(store Store, includeResolved bool) ([]Report, error) {
+	return store.ListReports(includeResolved)
+}
+
+func GetReport(store Store, reportId int) (*Report, error) {
+	report, err := store.GetReport(reportId)
+	if err != nil {
+		return nil, err
+	}
+	return report, OpenReportPayload(report)
+}
+
+/**
+ * Mark a report as handled. The snapshot of the payload is dropped at this point.
+ */
+func ResolveReport(store Store, reportId int) error {
+	return store.ResolveReport(reportId, time.Now())
+}
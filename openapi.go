@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Builds the OpenAPI 3 document for the v1 API from the route table and the request and response
+ * types. A copy is checked in as openapi.json for the app teams; TestOpenAPIDocument fails when
+ * it no longer matches (run `go test -run TestOpenAPIDocument -update` to refresh it).
+ */
+func BuildOpenAPIDocument() map[string]interface{} {
+	builder := &openAPIBuilder{schemas: map[string]interface{}{}}
+
+	paths := map[string]interface{}{}
+	for _, route := range v1Routes {
+		operations, ok := paths[route.Path].(map[string]interface{})
+		if !ok {
+			operations = map[string]interface{}{}
+			paths[route.Path] = operations
+		}
+		operations[strings.ToLower(route.Method)] = builder.operation(route)
+	}
+
+	// Clients should switch on these, never on the message.
+	codes := []string{}
+	for _, apiErr := range allAPIErrors {
+		codes = append(codes, apiErr.Code)
+	}
+	builder.schemaFor(reflect.TypeOf(ErrorResponse{}))
+	errorDetails := builder.schemas["ErrorDetails"].(map[string]interface{})
+	errorDetails["properties"].(map[string]interface{})["code"].(map[string]interface{})["enum"] = codes
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Photobeam API",
+			"version": "1",
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": "/v1"},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"authKey": []string{}},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": builder.schemas,
+			"securitySchemes": map[string]interface{}{
+				"authKey": map[string]interface{}{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        "Authorization",
+					"description": "The auth key of the device, as returned by /register, /devices/add or /rotate-key.",
+				},
+			},
+		},
+	}
+}
+
+var openAPIDocument struct {
+	once sync.Once
+	json []byte
+}
+
+/**
+ * The document as served and checked in.
+ */
+func OpenAPIDocumentJSON() []byte {
+	openAPIDocument.once.Do(func() {
+		data, err := json.MarshalIndent(BuildOpenAPIDocument(), "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		openAPIDocument.json = append(data, '\n')
+	})
+	return openAPIDocument.json
+}
+
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(OpenAPIDocumentJSON())
+}
+
+type openAPIBuilder struct {
+	schemas map[string]interface{}
+}
+
+func (builder *openAPIBuilder) operation(route Route) map[string]interface{} {
+	operation := map[string]interface{}{
+		"operationId": operationId(route.Path),
+		"summary":     route.Summary,
+	}
+	if route.Public {
+		operation["security"] = []interface{}{}
+	}
+
+	parameters := []interface{}{}
+	for _, parameter := range route.Query {
+		parameters = append(parameters, map[string]interface{}{
+			"name":        parameter.Name,
+			"in":          "query",
+			"required":    true,
+			"description": parameter.Description,
+			"schema":      map[string]interface{}{"type": parameter.Type},
+		})
+	}
+	for _, header := range route.Headers {
+		parameters = append(parameters, map[string]interface{}{
+			"name":        header.Name,
+			"in":          "header",
+			"required":    false,
+			"description": header.Description,
+			"schema":      map[string]interface{}{"type": header.Type},
+		})
+	}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+
+	if route.Request != nil {
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  builder.content(route.Request),
+		}
+	}
+
+	responses := map[string]interface{}{
+		"default": map[string]interface{}{
+			"description": "Error",
+			"content":     builder.content(ErrorResponse{}),
+		},
+	}
+	if route.Response == nil {
+		responses["204"] = map[string]interface{}{"description": "Done"}
+	} else {
+		ok := map[string]interface{}{
+			"description": "OK",
+			"content":     builder.content(route.Response),
+		}
+		if len(route.ResponseHeaders) > 0 {
+			headers := map[string]interface{}{}
+			for _, header := range route.ResponseHeaders {
+				headers[header.Name] = map[string]interface{}{
+					"description": header.Description,
+					"schema":      map[string]interface{}{"type": header.Type},
+				}
+			}
+			ok["headers"] = headers
+		}
+		responses["200"] = ok
+	}
+	operation["responses"] = responses
+
+	return operation
+}
+
+func (builder *openAPIBuilder) content(body interface{}) map[string]interface{} {
+	if raw, ok := body.(RawBody); ok {
+		return map[string]interface{}{
+			raw.ContentType: map[string]interface{}{
+				"schema": map[string]interface{}{"type": "string", "format": "binary"},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{
+			"schema": builder.schemaFor(reflect.TypeOf(body)),
+		},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+/**
+ * The JSON schema for a Go type, as encoding/json would serialize it. Structs are added to the
+ * components and referenced by name.
+ */
+func (builder *openAPIBuilder) schemaFor(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Ptr:
+		schema := builder.schemaFor(t.Elem())
+		if _, isRef := schema["$ref"]; isRef {
+			// Siblings of $ref are ignored in OpenAPI 3.0.
+			return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return map[string]interface{}{"type": "string", "format": "byte"}
+	case t.Kind() == reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": builder.schemaFor(t.Elem())}
+	case t.Kind() == reflect.Struct:
+		if _, exists := builder.schemas[t.Name()]; !exists {
+			builder.schemas[t.Name()] = nil // Guard against recursion
+			builder.schemas[t.Name()] = builder.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	panic("no JSON schema for type " + t.String())
+}
+
+func (builder *openAPIBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for _, field := range jsonFields(t) {
+		properties[field.name] = builder.schemaFor(field.Type)
+		if !field.omitEmpty && field.Type.Kind() != reflect.Ptr {
+			required = append(required, field.name)
+		}
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+type jsonField struct {
+	reflect.StructField
+	name      string
+	omitEmpty bool
+}
+
+/**
+ * The fields of a struct which end up in its JSON, under their JSON names.
+ */
+func jsonFields(t reflect.Type) []jsonField {
+	fields := []jsonField{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = field.Name
+		}
+		omitEmpty := false
+		for _, option := range tag[1:] {
+			omitEmpty = omitEmpty || option == "omitempty"
+		}
+		fields = append(fields, jsonField{StructField: field, name: name, omitEmpty: omitEmpty})
+	}
+	return fields
+}
+
+// "/devices/pair" becomes "devicesPair", "/rotate-key" becomes "rotateKey".
+func operationId(path string) string {
+	parts := strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '-' })
+	for i := 1; i < len(parts); i++ {
+		parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+	}
+	return strings.Join(parts, "")
+}
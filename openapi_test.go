@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"github.com/miracle2k/photobeam-server/client"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+var updateOpenAPI = flag.Bool("update", false, "rewrite openapi.json from the route table")
+
+func TestOpenAPIDocument(t *testing.T) {
+	generated := OpenAPIDocumentJSON()
+	if *updateOpenAPI {
+		if err := ioutil.WriteFile("openapi.json", generated, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkedIn, err := ioutil.ReadFile("openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(checkedIn, generated) {
+		t.Errorf("openapi.json is out of date, run: go test -run TestOpenAPIDocument -update")
+	}
+}
+
+func TestOpenAPIRoutesDocumented(t *testing.T) {
+	for _, route := range v1Routes {
+		if route.Summary == "" {
+			t.Errorf("%s %s has no summary", route.Method, route.Path)
+		}
+		if route.Method == "GET" && route.Request != nil {
+			t.Errorf("%s %s expects a body", route.Method, route.Path)
+		}
+	}
+}
+
+/**
+ * The client package keeps its own copies of the models; they have to produce the same schemas.
+ */
+func TestOpenAPIClientModels(t *testing.T) {
+	var pairs = []struct {
+		server, client interface{}
+	}{
+		{StateResponse{}, client.StateResponse{}},
+		{ProfileResponse{}, client.ProfileResponse{}},
+		{PublicKeyResponse{}, client.PublicKeyResponse{}},
+		{AccountResponse{}, client.AccountResponse{}},
+		{PairingResponse{}, client.PairingResponse{}},
+		{DeviceResponse{}, client.DeviceResponse{}},
+		{SetPropsArguments{}, client.SetPropsArguments{}},
+		{AddDeviceArguments{}, client.AddDeviceArguments{}},
+		{RevokeDeviceArguments{}, client.RevokeDeviceArguments{}},
+		{ConnectArguments{}, client.ConnectArguments{}},
+		{AcceptArguments{}, client.AcceptArguments{}},
+		{BlockArguments{}, client.BlockArguments{}},
+		{ReportArguments{}, client.ReportArguments{}},
+		{ErrorResponse{}, client.ErrorResponse{}},
+	}
+
+	serverSchemas := &openAPIBuilder{schemas: map[string]interface{}{}}
+	clientSchemas := &openAPIBuilder{schemas: map[string]interface{}{}}
+	for _, pair := range pairs {
+		serverSchemas.schemaFor(reflect.TypeOf(pair.server))
+		clientSchemas.schemaFor(reflect.TypeOf(pair.client))
+	}
+
+	for name, schema := range serverSchemas.schemas {
+		if !reflect.DeepEqual(schema, clientSchemas.schemas[name]) {
+			t.Errorf("client.%s does not match the server model:\nserver: %v\nclient: %v", name, schema, clientSchemas.schemas[name])
+		}
+	}
+
+	// And every model the API uses is covered above.
+	document := BuildOpenAPIDocument()
+	for name := range document["components"].(map[string]interface{})["schemas"].(map[string]interface{}) {
+		if _, ok := serverSchemas.schemas[name]; !ok {
+			t.Errorf("%s is missing from the client models check", name)
+		}
+	}
+}
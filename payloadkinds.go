@@ -0,0 +1,136 @@
+package main
+
+import (
+	"mime"
+	"strings"
+	"sync/atomic"
+)
+
+// The kinds of payloads, see payloadKind.
+const (
+	PayloadKindPhoto     = "photo"
+	PayloadKindAnimation = "animation"
+	PayloadKindVideo     = "video"
+	// A still with a short video, which Data and Video carry.
+	PayloadKindLivePhoto = "livePhoto"
+	// Only a caption.
+	PayloadKindText = "text"
+)
+
+/**
+ * What a payload carries, so that the receiving app knows what it is about to download before it
+ * does. Senders declare the kind, and a MIME type which has to fit it; we do not look into the data,
+ * which may well be encrypted to the peer.
+ */
+type payloadKind struct {
+	// The top-level type the content type must have, "image/" or "video/". Empty for no data.
+	mediaType string
+	// In bytes, for Data and for Video. A zero maxVideoSize means the kind has no video part.
+	maxSize      int
+	maxVideoSize int
+}
+
+var defaultPayloadKinds = map[string]payloadKind{
+	PayloadKindPhoto:     {mediaType: "image/", maxSize: 20 << 20},
+	PayloadKindAnimation: {mediaType: "image/", maxSize: 20 << 20},
+	PayloadKindVideo:     {mediaType: "video/", maxSize: 100 << 20},
+	PayloadKindLivePhoto: {mediaType: "image/", maxSize: 20 << 20, maxVideoSize: 20 << 20},
+	PayloadKindText:      {},
+}
+
+// Replaces the default kinds while set, so that tests can make the limits smaller.
+var payloadKindsOverride atomic.Pointer[map[string]payloadKind]
+
+// The kinds we accept, with their limits.
+func payloadKinds() map[string]payloadKind {
+	if kinds := payloadKindsOverride.Load(); kinds != nil {
+		return *kinds
+	}
+	return defaultPayloadKinds
+}
+
+/**
+ * The most an upload to /set can be, parts and caption together, with some room for the multipart
+ * framing. Checked before we read the body; the limits per kind after.
+ */
+func maxUploadSize() int64 {
+	var largest int
+	for _, kind := range payloadKinds() {
+		largest = max(largest, kind.maxSize+kind.maxVideoSize)
+	}
+	return int64(largest) + 64<<10
+}
+
+/**
+ * The kind the sender declared, or what the parts suggest if it did not. Payloads stored before
+ * there were kinds are photos, or text beams if they have no data.
+ */
+func (payload *Payload) GetKind() string {
+	switch {
+	case payload.Kind != "":
+		return payload.Kind
+	case len(payload.Video) > 0:
+		return PayloadKindLivePhoto
+	case len(payload.Data) == 0:
+		return PayloadKindText
+	case strings.HasPrefix(payload.ContentType, "video/"):
+		return PayloadKindVideo
+	default:
+		return PayloadKindPhoto
+	}
+}
+
+/**
+ * Make a content type as clients send it into what we store: the bare media type, or nothing if
+ * they did not say. Multipart parts default to application/octet-stream, which says nothing either.
+ */
+func normalizeContentType(contentType string) (string, error) {
+	if contentType == "" {
+		return "", nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", ErrInvalidKind
+	}
+	if mediaType == "application/octet-stream" {
+		return "", nil
+	}
+	return mediaType, nil
+}
+
+// Whether a content type is one of those the kinds have, see payloadKind.mediaType.
+func isMediaContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "image/") || strings.HasPrefix(contentType, "video/")
+}
+
+/**
+ * Fill in the kind if the sender left it out, and check that the parts and their content types fit
+ * it and its size limits.
+ */
+func checkPayloadKind(payload *Payload) error {
+	payload.Kind = payload.GetKind()
+	kind, ok := payloadKinds()[payload.Kind]
+	if !ok {
+		return ErrInvalidKind
+	}
+
+	if kind.mediaType == "" {
+		if len(payload.Data) > 0 || payload.ContentType != "" {
+			return ErrInvalidKind
+		}
+	} else if len(payload.Data) == 0 || payload.ContentType != "" && !strings.HasPrefix(payload.ContentType, kind.mediaType) {
+		return ErrInvalidKind
+	}
+	if kind.maxVideoSize == 0 {
+		if len(payload.Video) > 0 || payload.VideoContentType != "" {
+			return ErrInvalidKind
+		}
+	} else if len(payload.Video) == 0 || payload.VideoContentType != "" && !strings.HasPrefix(payload.VideoContentType, "video/") {
+		return ErrInvalidKind
+	}
+
+	if len(payload.Data) > kind.maxSize || len(payload.Video) > kind.maxVideoSize {
+		return ErrPayloadTooLarge
+	}
+	return nil
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"strconv"
+	"time"
+)
+
+/**
+ * The Store on Postgres, which is what we run in production.
+ */
+type pgStore struct {
+	db  *pg.DB
+	tx  *pg.Tx // Inside RunInTransaction
+	ctx context.Context
+}
+
+func NewPgStore(db *pg.DB) Store {
+	return &pgStore{db: db, ctx: db.Context()}
+}
+
+func (s *pgStore) conn() orm.DB {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+func (s *pgStore) model(model ...interface{}) *orm.Query {
+	return s.conn().ModelContext(s.ctx, model...)
+}
+
+func (s *pgStore) exec(query string, params ...interface{}) (orm.Result, error) {
+	return s.conn().ExecContext(s.ctx, query, params...)
+}
+
+// The Store interface does not leak go-pg errors the callers would have to know about.
+func pgNotFound(err error) error {
+	if err == pg.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *pgStore) Context() context.Context {
+	return s.ctx
+}
+
+func (s *pgStore) WithContext(ctx context.Context) Store {
+	return &pgStore{db: s.db, tx: s.tx, ctx: ctx}
+}
+
+func (s *pgStore) RunInTransaction(fn func(tx Store) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+	return s.db.RunInTransaction(s.ctx, func(tx *pg.Tx) error {
+		return fn(&pgStore{db: s.db, tx: tx, ctx: s.ctx})
+	})
+}
+
+func (s *pgStore) CreateSchema() error {
+	return CreateSchema(s.db.WithContext(s.ctx))
+}
+
+func (s *pgStore) SchemaVersion() (int, int, error) {
+	version, err := SchemaVersion(s.db.WithContext(s.ctx))
+	return version, len(migrations), err
+}
+
+func (s *pgStore) Close() error {
+	return s.db.Close()
+}
+
+// For the metrics.
+func (s *pgStore) PoolStats() *pg.PoolStats {
+	return s.db.PoolStats()
+}
+
+func (s *pgStore) InsertAccount(account *Account) error {
+	_, err := s.model(account).Insert()
+	return err
+}
+
+func (s *pgStore) GetAccount(accountId int) (*Account, error) {
+	account := &Account{Id: accountId}
+	err := s.model(account).WherePK().Select()
+	if err != nil {
+		return nil, pgNotFound(err)
+	}
+	return account, nil
+}
+
+func (s *pgStore) GetAccountByConnectCode(connectCode string) (*Account, error) {
+	account := new(Account)
+	err := s.model(account).Where("connect_code = ?", connectCode).Limit(1).Select()
+	if err != nil {
+		return nil, pgNotFound(err)
+	}
+	return account, nil
+}
+
+func (s *pgStore) UpdateAccount(account *Account) error {
+	_, err := s.model(account).Column("connect_code", "display_name", "public_key", "public_key_algorithm", "public_key_id").WherePK().Update()
+	return err
+}
+
+func (s *pgStore) SearchAccounts(search string, limit int) ([]Account, error) {
+	var accounts []Account
+	query := s.model(&accounts).Order("id DESC").Limit(limit)
+	if search != "" {
+		if id, err := strconv.Atoi(search); err == nil {
+			query = query.WhereOr("id = ?", id)
+		}
+		query = query.
+			WhereOr("connect_code = ?", search).
+			WhereOr("display_name ILIKE ?", "%"+search+"%")
+	}
+	err := query.Select()
+	return accounts, err
+}
+
+func (s *pgStore) DeleteAccount(accountId int) error {
+	return s.RunInTransaction(func(tx Store) error {
+		statements := []string{
+			`DELETE FROM payloads WHERE from_id = ?0
+				OR connection_id IN (SELECT id FROM connections WHERE invitee_id = ?0 OR initiator_id = ?0)`,
+			`DELETE FROM connections WHERE invitee_id = ?0 OR initiator_id = ?0`,
+			`DELETE FROM blocks WHERE blocker_id = ?0 OR blocked_id = ?0`,
+			`DELETE FROM reports WHERE reporter_id = ?0`,
+			`UPDATE reports SET payload_data = NULL, payload_caption = NULL, payload_video = NULL, payload_data_key = NULL,
+				payload_master_key_id = NULL
+			WHERE reported_id = ?0`,
+			`DELETE FROM device_pairings WHERE account_id = ?0`,
+			`DELETE FROM devices WHERE account_id = ?0`,
+			`DELETE FROM avatars WHERE account_id = ?0`,
+			`DELETE FROM accounts WHERE id = ?0`,
+		}
+		for _, statement := range statements {
+			_, err := tx.(*pgStore).exec(statement, accountId)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *pgStore) InsertDevice(device *Device) error {
+	_, err := s.model(device).Insert()
+	return err
+}
+
+func (s *pgStore) UpdateDevice(device *Device) error {
+	_, err := s.model(device).WherePK().Update()
+	return err
+}
+
+func (s *pgStore) ListDevices(accountId int) ([]Device, error) {
+	var devices []Device
+	err := s.model(&devices).Where("account_id = ?", accountId).Order("id ASC").Select()
+	return devices, err
+}
+
+func (s *pgStore) FindDevicesByKeyPrefix(keyPrefix string) ([]Device, error) {
+	var devices []Device
+	err := s.model(&devices).Where("key_prefix = ?", keyPrefix).Select()
+	return devices, err
+}
+
+func (s *pgStore) DeleteDevice(accountId int, deviceId int) (bool, error) {
+	result, err := s.model(new(Device)).
+		Where("id = ?0 AND account_id = ?1", deviceId, accountId).
+		Delete()
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() > 0, nil
+}
+
+func (s *pgStore) ResetPushTokens(accountId int) (int, error) {
+	result, err := s.model(new(Device)).
+		Set("push_token = NULL").
+		Where("account_id = ? AND push_token IS NOT NULL AND push_token != ''", accountId).
+		Update()
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+func (s *pgStore) InsertPairing(pairing *DevicePairing) error {
+	_, err := s.model(pairing).Insert()
+	return err
+}
+
+func (s *pgStore) TakePairing(code string) (*DevicePairing, error) {
+	pairing := &DevicePairing{Code: code}
+	_, err := s.model(pairing).WherePK().Returning("*").Delete()
+	if err != nil {
+		return nil, pgNotFound(err)
+	}
+	return pairing, nil
+}
+
+func (s *pgStore) DeleteExpiredPairings(now time.Time) error {
+	_, err := s.model(new(DevicePairing)).Where("time_expires < ?", now).Delete()
+	return err
+}
+
+func (s *pgStore) InsertConnection(connection *Connection) error {
+	_, err := s.model(connection).Insert()
+	return err
+}
+
+func (s *pgStore) UpdateConnection(connection *Connection) error {
+	_, err := s.model(connection).Column("status").WherePK().Update()
+	return err
+}
+
+func (s *pgStore) ListConnections(accountId int) ([]Connection, error) {
+	var connections []Connection
+	err := s.model(&connections).
+		Where("invitee_id = ?0 OR initiator_id = ?0", accountId).
+		Order("id ASC").
+		Select()
+	return connections, err
+}
+
+func (s *pgStore) DeleteConnection(connectionId int) error {
+	_, err := s.model(new(Connection)).Where("id = ?", connectionId).Delete()
+	return err
+}
+
+func (s *pgStore) PutPayload(payload *Payload) error {
+	return s.RunInTransaction(func(tx Store) error {
+		_, err := tx.(*pgStore).model(new(Payload)).
+			Where("connection_id = ?0 AND from_id = ?1", payload.ConnectionId, payload.FromId).
+			Delete()
+		if err != nil {
+			return err
+		}
+		_, err = tx.(*pgStore).model(payload).Insert()
+		return err
+	})
+}
+
+func (s *pgStore) GetPayload(connectionId int, fromId int) (*Payload, error) {
+	payload := new(Payload)
+	err := s.model(payload).Where("connection_id = ?0 AND from_id = ?1", connectionId, fromId).Select()
+	if err != nil {
+		return nil, pgNotFound(err)
+	}
+	return payload, nil
+}
+
+func (s *pgStore) ListPayloads(connectionId int) ([]Payload, error) {
+	var payloads []Payload
+	err := s.model(&payloads).Where("connection_id = ?", connectionId).Order("time_created ASC").Select()
+	return payloads, err
+}
+
+func (s *pgStore) ListAccountPayloads(accountId int) ([]Payload, error) {
+	var payloads []Payload
+	err := s.model(&payloads).
+		Where("from_id = ?0 OR connection_id IN (SELECT id FROM connections WHERE invitee_id = ?0 OR initiator_id = ?0)", accountId).
+		Order("time_created ASC").
+		Select()
+	return payloads, err
+}
+
+func (s *pgStore) UpdatePayload(payload *Payload) error {
+	_, err := s.model(payload).WherePK().Update()
+	return err
+}
+
+func (s *pgStore) DeletePayloads(connectionId int) (int, error) {
+	result, err := s.model(new(Payload)).Where("connection_id = ?", connectionId).Delete()
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+func (s *pgStore) ListPayloadsToSeal(masterKeyId string, limit int) ([]Payload, error) {
+	var payloads []Payload
+	err := s.model(&payloads).
+		Where("(octet_length(data) > 0 OR octet_length(caption) > 0 OR octet_length(video) > 0) AND COALESCE(master_key_id, '') != ?", masterKeyId).
+		Order("connection_id ASC", "from_id ASC").
+		Limit(limit).
+		Select()
+	return payloads, err
+}
+
+func (s *pgStore) ResealPayload(payload *Payload, previousMasterKeyId string) (bool, error) {
+	result, err := s.model(payload).
+		Column("data", "caption", "video", "data_key", "master_key_id").
+		Where("connection_id = ? AND from_id = ?", payload.ConnectionId, payload.FromId).
+		Where("time_created = ? AND NOT fetched", payload.TimeCreated).
+		Where("COALESCE(master_key_id, '') = ?", previousMasterKeyId).
+		Update()
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() > 0, nil
+}
+
+func (s *pgStore) InsertBlock(block *Block) error {
+	_, err := s.model(block).OnConflict("DO NOTHING").Insert()
+	return err
+}
+
+func (s *pgStore) DeleteBlock(blockerId int, blockedId int) error {
+	_, err := s.model(new(Block)).
+		Where("blocker_id = ?0 AND blocked_id = ?1", blockerId, blockedId).
+		Delete()
+	return err
+}
+
+func (s *pgStore) ListBlocks(accountId int) ([]Block, error) {
+	var blocks []Block
+	err := s.model(&blocks).
+		Where("blocker_id = ?0 OR blocked_id = ?0", accountId).
+		Order("blocker_id ASC", "blocked_id ASC").
+		Select()
+	return blocks, err
+}
+
+func (s *pgStore) PutAvatar(avatar *Avatar) error {
+	_, err := s.model(avatar).
+		OnConflict("(account_id) DO UPDATE").
+		Set("data = EXCLUDED.data, content_type = EXCLUDED.content_type, hash = EXCLUDED.hash, time_updated = EXCLUDED.time_updated").
+		Insert()
+	return err
+}
+
+func (s *pgStore) GetAvatar(accountId int) (*Avatar, error) {
+	avatar := &Avatar{AccountId: accountId}
+	err := s.model(avatar).WherePK().Select()
+	if err != nil {
+		return nil, pgNotFound(err)
+	}
+	return avatar, nil
+}
+
+func (s *pgStore) GetAvatarHash(accountId int) (string, error) {
+	avatar := &Avatar{AccountId: accountId}
+	err := s.model(avatar).Column("hash").WherePK().Select()
+	if err == pg.ErrNoRows {
+		return "", nil
+	}
+	return avatar.Hash, err
+}
+
+func (s *pgStore) DeleteAvatar(accountId int) error {
+	_, err := s.model(new(Avatar)).Where("account_id = ?", accountId).Delete()
+	return err
+}
+
+func (s *pgStore) InsertReport(report *Report) error {
+	_, err := s.model(report).Insert()
+	return err
+}
+
+func (s *pgStore) GetReport(reportId int) (*Report, error) {
+	report := &Report{Id: reportId}
+	err := s.model(report).WherePK().Select()
+	if err != nil {
+		return nil, pgNotFound(err)
+	}
+	return report, nil
+}
+
+func (s *pgStore) ListReports(includeResolved bool) ([]Report, error) {
+	var reports []Report
+	query := s.model(&reports).ExcludeColumn("payload_data", "payload_caption", "payload_video").Order("id ASC")
+	if !includeResolved {
+		query = query.Where("time_resolved IS NULL")
+	}
+	err := query.Select()
+	return reports, err
+}
+
+func (s *pgStore) ListReportsFiledBy(reporterId int) ([]Report, error) {
+	var reports []Report
+	err := s.model(&reports).ExcludeColumn("payload_data", "payload_caption", "payload_video").Where("reporter_id = ?", reporterId).Order("id ASC").Select()
+	return reports, err
+}
+
+func (s *pgStore) CountReports(accountId int) (int, int, error) {
+	var counts struct {
+		Filed   int
+		Against int
+	}
+	_, err := s.conn().QueryOneContext(s.ctx, &counts, `
+		SELECT
+			(SELECT count(*) FROM reports WHERE reporter_id = ?0) AS filed,
+			(SELECT count(*) FROM reports WHERE reported_id = ?0) AS against`, accountId)
+	return counts.Filed, counts.Against, err
+}
+
+func (s *pgStore) ResolveReport(reportId int, now time.Time) error {
+	result, err := s.model(new(Report)).
+		Set("time_resolved = ?", now).
+		Set("payload_data = NULL, payload_caption = NULL, payload_video = NULL, payload_data_key = NULL, payload_master_key_id = NULL").
+		Where("id = ?", reportId).
+		Update()
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) ListReportsToSeal(masterKeyId string, limit int) ([]Report, error) {
+	var reports []Report
+	err := s.model(&reports).
+		Where("(octet_length(payload_data) > 0 OR octet_length(payload_caption) > 0 OR octet_length(payload_video) > 0)").
+		Where("COALESCE(payload_master_key_id, '') != ?", masterKeyId).
+		Order("id ASC").
+		Limit(limit).
+		Select()
+	return reports, err
+}
+
+func (s *pgStore) ResealReport(report *Report, previousMasterKeyId string) (bool, error) {
+	result, err := s.model(report).
+		Column("payload_data", "payload_caption", "payload_video", "payload_data_key", "payload_master_key_id").
+		Where("id = ? AND (payload_data IS NOT NULL OR payload_caption IS NOT NULL OR payload_video IS NOT NULL)", report.Id).
+		Where("COALESCE(payload_master_key_id, '') = ?", previousMasterKeyId).
+		Update()
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() > 0, nil
+}
+
+func (s *pgStore) IncrementActivity(day time.Time, column string) error {
+	_, err := s.exec(`
+		INSERT INTO daily_activities (day, ?0) VALUES (?1, 1)
+		ON CONFLICT (day) DO UPDATE SET ?0 = COALESCE(daily_activities.?0, 0) + 1`,
+		pg.Ident(column), day.Format("2006-01-02"))
+	return err
+}
+
+func (s *pgStore) ListActivity(since time.Time) ([]DailyActivity, error) {
+	var activity []DailyActivity
+	err := s.model(&activity).
+		Where("day >= ?", since.Format("2006-01-02")).
+		Order("day DESC").
+		Select()
+	return activity, err
+}
+
+func (s *pgStore) Stats() (*AdminStats, error) {
+	stats := new(AdminStats)
+	_, err := s.conn().QueryOneContext(s.ctx, stats, `
+		SELECT
+			(SELECT count(*) FROM accounts) AS accounts,
+			(SELECT count(*) FROM devices) AS devices,
+			(SELECT count(*) FROM devices WHERE push_token IS NOT NULL AND push_token != '') AS devices_with_push,
+			(SELECT count(*) FROM connections WHERE status != ?0) AS connections_live,
+			(SELECT count(*) FROM connections WHERE status = ?0) AS connections_pending,
+			(SELECT count(*) FROM payloads WHERE data IS NOT NULL) AS payloads_waiting,
+			(SELECT COALESCE(sum(length(data)), 0) + COALESCE(sum(length(video)), 0) FROM payloads) AS payload_bytes,
+			(SELECT count(*) FROM reports WHERE time_resolved IS NULL) AS open_reports,
+			(SELECT count(*) FROM blocks) AS blocks`, PENDING)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	ErrDisplayNameTooLong = errors.New("Display name is too long")
+	ErrAvatarTooLarge     = errors.New("Avatar is too large")
+	ErrAvatarType         = errors.New("Avatar must be a JPEG or PNG image")
+	ErrPublicKeyInvalid   = errors.New("Unknown public key algorithm, or wrong key length")
+)
+
+const maxDisplayNameLength = 50
+
+// Avatars are shown as small thumbnails, there is no reason to accept anything big.
+const maxAvatarSize = 64 * 1024
+
+var avatarContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+/**
+ * Apply /setprops: the settings of the calling device, and the profile of the account. Every field
+ * is checked before anything is written, and all of it is written in one transaction, so a request
+ * with a bad avatar does not leave the new name behind. Returns whether the public key changed, in
+ * which case the peers need to be told.
+ */
+func SetProps(store Store, account *Account, device *Device, args *SetPropsArguments) (bool, error) {
+	var displayName string
+	var err error
+	if args.DisplayName != nil {
+		displayName, err = checkDisplayName(*args.DisplayName)
+		if err != nil {
+			return false, err
+		}
+	}
+	var deviceName string
+	if args.DeviceName != nil {
+		deviceName, err = checkDeviceName(*args.DeviceName)
+		if err != nil {
+			return false, err
+		}
+	}
+	if args.Platform != nil {
+		if err := checkPlatform(*args.Platform); err != nil {
+			return false, err
+		}
+	}
+	var avatar *Avatar
+	if args.Avatar != nil {
+		avatar, err = newAvatar(account.Id, *args.Avatar)
+		if err != nil {
+			return false, err
+		}
+	}
+	var publicKey []byte
+	var algorithm, keyId string
+	if args.PublicKey != nil {
+		if args.PublicKeyAlgorithm != nil {
+			algorithm = *args.PublicKeyAlgorithm
+		}
+		publicKey, algorithm, keyId, err = checkPublicKey(*args.PublicKey, algorithm)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if args.ApnsToken != nil {
+		device.PushToken = *args.ApnsToken
+	}
+	if args.DeviceName != nil {
+		device.Name = deviceName
+	}
+	if args.Platform != nil {
+		device.Platform = *args.Platform
+	}
+	if args.AlertPushes != nil {
+		device.AlertPushes = *args.AlertPushes
+	}
+	if args.DisplayName != nil {
+		account.DisplayName = displayName
+	}
+	keyChanged := args.PublicKey != nil && keyId != account.PublicKeyId
+	if keyChanged {
+		account.PublicKey = publicKey
+		account.PublicKeyAlgorithm = algorithm
+		account.PublicKeyId = keyId
+	}
+
+	err = store.RunInTransaction(func(tx Store) error {
+		err := tx.UpdateDevice(device)
+		if err != nil {
+			return err
+		}
+		if args.DisplayName != nil || keyChanged {
+			err = tx.UpdateAccount(account)
+			if err != nil {
+				return err
+			}
+		}
+		switch {
+		case args.Avatar == nil:
+			return nil
+		case avatar == nil:
+			return tx.DeleteAvatar(account.Id)
+		default:
+			return tx.PutAvatar(avatar)
+		}
+	})
+	if err != nil {
+		return false, err
+	}
+	return keyChanged, nil
+}
+
+/**
+ * The name the peer sees for the account, as we store it. An empty name removes it.
+ */
+func checkDisplayName(displayName string) (string, error) {
+	displayName = strings.TrimSpace(displayName)
+	if utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+		return "", ErrDisplayNameTooLong
+	}
+	return displayName, nil
+}
+
+/**
+ * The avatar to store for the account, or nil for empty data, which removes it.
+ */
+func newAvatar(accountId int, data []byte) (*Avatar, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	if len(data) > maxAvatarSize {
+		return nil, ErrAvatarTooLarge
+	}
+	contentType := http.DetectContentType(data)
+	if !avatarContentTypes[contentType] {
+		return nil, ErrAvatarType
+	}
+
+	sum := sha256.Sum256(data)
+	return &Avatar{
+		AccountId:   accountId,
+		Data:        data,
+		ContentType: contentType,
+		Hash:        hex.EncodeToString(sum[:8]),
+		TimeUpdated: time.Now(),
+	}, nil
+}
+
+// The key algorithms the apps may use, with the length of their keys.
+var publicKeyLengths = map[string]int{
+	"x25519": 32,
+	"p256":   65,
+}
+
+/**
+ * Check the key peers should encrypt payloads to, and derive its id. An empty key removes it, and
+ * comes back as nil with an empty algorithm and id.
+ */
+func checkPublicKey(key []byte, algorithm string) ([]byte, string, string, error) {
+	if len(key) == 0 {
+		return nil, "", "", nil
+	}
+	if length, known := publicKeyLengths[algorithm]; !known || len(key) != length {
+		return nil, "", "", ErrPublicKeyInvalid
+	}
+
+	sum := sha256.Sum256(append([]byte(algorithm+":"), key...))
+	return key, algorithm, hex.EncodeToString(sum[:8]), nil
+}
+
+func GetAvatar(store Store, accountId int) (*Avatar, error) {
+	return store.GetAvatar(accountId)
+}
+
+/**
+ * The public profile of an account, as shown to its peer.
+ */
+func GetProfile(store Store, accountId int) (*ProfileResponse, error) {
+	account, err := store.GetAccount(accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &ProfileResponse{
+		AccountId:   account.Id,
+		DisplayName: account.DisplayName,
+	}
+	if account.PublicKeyId != "" {
+		profile.PublicKey = &PublicKeyResponse{
+			KeyId:     account.PublicKeyId,
+			Algorithm: account.PublicKeyAlgorithm,
+			Key:       account.PublicKey,
+		}
+	}
+
+	profile.AvatarHash, err = store.GetAvatarHash(accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+/**
+ * Whether the account may see the profile of the other: its own, that of anyone it has a live
+ * connection with, and that of anyone asking to connect with it, so it knows whom it accepts.
+ * Whoever asks does not get to see the profile before being accepted; otherwise a guessed connect
+ * code would be enough.
+ */
+func CanSeeProfile(store Store, account *Account, otherId int) (bool, error) {
+	if account.Id == otherId {
+		return true, nil
+	}
+	connections, err := store.ListConnections(account.Id)
+	if err != nil {
+		return false, err
+	}
+	for _, connection := range connections {
+		if connection.GetPeerId(account.Id) != otherId {
+			continue
+		}
+		if connection.Status != PENDING || connection.InviteeId == account.Id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -1,52 +1,231 @@
 package main
 
 import (
-	"github.com/go-pg/pg/v10"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/sideshow/apns2"
 	"github.com/sideshow/apns2/certificate"
 	"github.com/sideshow/apns2/payload"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"sync"
 )
 
-func SendNotification(deviceToken string) {
+// APNs answered that the token is no longer valid, e.g. because the app was uninstalled.
+var ErrPushUnregistered = errors.New("device token is no longer registered")
+
+var pushClient struct {
+	sync.Mutex
+	client *apns2.Client
+	// Where to send pushes. Development is for builds running directly from Xcode; apps from
+	// the App Store or ad-hoc builds need apns2.HostProduction.
+	host string
+}
+
+/**
+ * Send pushes to another APNs server, see --apns-url.
+ */
+func ConfigurePush(host string) {
+	pushClient.Lock()
+	defer pushClient.Unlock()
+	pushClient.host = host
+	pushClient.client = nil
+}
+
+/**
+ * Use this client instead of loading the certificate, e.g. FakeAPNs.Client(). Nil goes back to
+ * the certificate.
+ */
+func SetPushClient(client *apns2.Client) {
+	pushClient.Lock()
+	defer pushClient.Unlock()
+	pushClient.client = client
+}
+
+/**
+ * The APNs client, loaded from ./cert.p12 on first use. A failed load is retried next time, so
+ * adding the certificate does not need a restart.
+ */
+func PushClient() (*apns2.Client, error) {
+	pushClient.Lock()
+	defer pushClient.Unlock()
+	if pushClient.client != nil {
+		return pushClient.client, nil
+	}
+
 	cert, err := certificate.FromP12File("./cert.p12", "")
 	if err != nil {
-		log.Fatal("Cert Error:", err)
+		return nil, fmt.Errorf("cert error: %s", err)
+	}
+	pushClient.client = apns2.NewClient(cert)
+	pushClient.client.Host = apns2.HostDevelopment
+	if pushClient.host != "" {
+		pushClient.client.Host = pushClient.host
+	}
+	return pushClient.client, nil
+}
+
+/**
+ * What an alert push shows, for devices which allow them.
+ */
+type PushAlert struct {
+	Title string
+	Body  string
+}
+
+/**
+ * Send a push to one device: a background push, or with an alert an alert push which also wakes
+ * the app. The context is only used to tie the log lines and the span to the request which caused
+ * the push.
+ */
+func SendNotification(ctx context.Context, deviceToken string, kind string, alert *PushAlert) (err error) {
+	ctx, span := tracer.Start(ctx, "apns.push", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { endSpan(span, err) }()
+
+	client, err := PushClient()
+	if err != nil {
+		pushNotificationsTotal.WithLabelValues("error", "certificate").Inc()
+		return err
 	}
 
 	notification := &apns2.Notification{}
 	notification.PushType = apns2.PushTypeBackground
 	notification.DeviceToken = deviceToken
 	notification.Topic = "com.elsdoerfer.photobeam"
-	notification.Payload = payload.NewPayload().ContentAvailable()
+	content := payload.NewPayload().ContentAvailable()
+	if alert != nil {
+		notification.PushType = apns2.PushTypeAlert
+		content = content.AlertTitle(alert.Title).AlertBody(alert.Body).Sound("default")
+	}
+	// So the app can get ready for a video before it asks /query.
+	if kind != "" {
+		content = content.Custom("kind", kind)
+	}
+	notification.Payload = content
 
-	// If you want to test push notifications for builds running directly from XCode (Development), use
-	// For apps published to the app store or installed as an ad-hoc distribution use Production()
-	//client := apns2.NewClient(cert).Production()
-	client := apns2.NewClient(cert).Development()
-	res, err := client.Push(notification)
+	res, err := client.PushWithContext(ctx, notification)
 
 	if err != nil {
-		log.Fatal("Error:", err)
+		pushNotificationsTotal.WithLabelValues("error", "transport").Inc()
+		return err
 	}
 
-	log.Printf("%v %v %v\n", res.StatusCode, res.ApnsID, res.Reason)
+	span.SetAttributes(
+		attribute.Int("apns.status", res.StatusCode),
+		attribute.String("apns.reason", res.Reason),
+		attribute.String("apns.id", res.ApnsID),
+	)
+	Logger(ctx).Info("push sent", "status", res.StatusCode, "apns_id", res.ApnsID, "reason", res.Reason)
+	if !res.Sent() {
+		pushNotificationsTotal.WithLabelValues("rejected", res.Reason).Inc()
+		if res.StatusCode == http.StatusGone {
+			return ErrPushUnregistered
+		}
+		return fmt.Errorf("push rejected: %d %s", res.StatusCode, res.Reason)
+	}
+	pushNotificationsTotal.WithLabelValues("sent", "").Inc()
+	return nil
 }
 
-func SendNotificationToAccountId(db *pg.DB, accountId int) error {
-	// We need to get the device key for the target user.
-	peerAccount := new(Account)
-	err := db.Model(peerAccount).
-		Where("id = ?", accountId).
-		Limit(1).
-		Select()
+/**
+ * Notify every device of the account which has a push token.
+ */
+func SendNotificationToAccountId(store Store, accountId int) error {
+	return SendBeamNotification(store, accountId, "", nil)
+}
+
+/**
+ * Like SendNotificationToAccountId, for a new payload of this kind, with an alert for the devices
+ * which allow them.
+ */
+func SendBeamNotification(store Store, accountId int, kind string, alert *PushAlert) (err error) {
+	store, span := startSpan(store, "notify account", attribute.Int("photobeam.to_account_id", accountId))
+	defer func() { endSpan(span, err) }()
+
+	// We need the device tokens of the target user.
+	devices, err := store.ListDevices(accountId)
 	if err != nil {
 		return err;
 	}
 
-	if peerAccount.ApnsToken != "" {
-		SendNotification(peerAccount.ApnsToken)
+	for _, device := range devices {
+		if device.PushToken == "" {
+			continue
+		}
+		if device.Platform != PLATFORM_IOS {
+			Logger(store.Context()).Info("no push support for platform", "platform", device.Platform, "device_id", device.Id)
+			continue
+		}
+		// One device failing should not keep the others from getting the push.
+		deviceAlert := alert
+		if !device.AlertPushes {
+			deviceAlert = nil
+		}
+		err = SendNotification(store.Context(), device.PushToken, kind, deviceAlert)
+		if err == ErrPushUnregistered {
+			// Sending to it again would not work either.
+			Logger(store.Context()).Info("forgetting unregistered push token", "device_id", device.Id)
+			device.PushToken = ""
+			err = store.UpdateDevice(&device)
+		}
+		if err != nil {
+			Logger(store.Context()).Warn("push failed", "device_id", device.Id, "to_account_id", accountId, "error", err)
+		}
 	}
 
 	return nil
 }
+
+// What an alert says for a payload without a caption.
+var beamAlertBodies = map[string]string{
+	PayloadKindPhoto:     "Sent you a photo.",
+	PayloadKindAnimation: "Sent you an animation.",
+	PayloadKindVideo:     "Sent you a video.",
+	PayloadKindLivePhoto: "Sent you a Live Photo.",
+}
+
+// Longest caption an alert shows, in characters; APNs takes at most 4 KB for the whole push.
+const maxAlertCaptionLength = 200
+
+/**
+ * The alert for a new payload: who sent it, and the caption. Build it before the payload is
+ * stored, which encrypts the caption.
+ *
+ * A sender who encrypts the photo to the peer would not want its caption to pass through Apple,
+ * so then the alert only says what was sent, and the caption waits for /get.
+ */
+func BeamAlert(sender *Account, payload *Payload) *PushAlert {
+	alert := &PushAlert{Title: sender.DisplayName, Body: beamAlertBodies[payload.GetKind()]}
+	if alert.Title == "" {
+		alert.Title = "Photobeam"
+	}
+	if payload.KeyId != "" {
+		return alert
+	}
+	if caption := []rune(string(payload.Caption)); len(caption) > maxAlertCaptionLength {
+		alert.Body = string(caption[:maxAlertCaptionLength-1]) + "…"
+	} else if len(caption) > 0 {
+		alert.Body = string(caption)
+	}
+	return alert
+}
+
+/**
+ * Notify everyone the account has a connection or pending request with, e.g. because its public
+ * key changed.
+ */
+func NotifyPeers(store Store, accountId int) error {
+	connections, err := store.ListConnections(accountId)
+	if err != nil {
+		return err
+	}
+	for _, connection := range connections {
+		err = SendNotificationToAccountId(store, connection.GetPeerId(accountId))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
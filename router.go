@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/**
+ * One endpoint of the API: the handler for a method on a path, and what it expects and returns,
+ * which is what the OpenAPI document is built from.
+ */
+type Route struct {
+	Method  string
+	Path    string
+	Handler http.HandlerFunc
+
+	Summary string
+	Public  bool // Does not need an Authorization header
+	Query   []QueryParameter
+
+	// Optional headers of the request, and headers the response may have.
+	Headers         []QueryParameter
+	ResponseHeaders []QueryParameter
+
+	// A zero value of the JSON body type, or a RawBody. Nil if there is no body.
+	Request interface{}
+
+	// A zero value of the JSON response type, or a RawBody. Nil if the response is a 204.
+	Response interface{}
+}
+
+// A query parameter, or a header.
+type QueryParameter struct {
+	Name        string
+	Description string
+	Type        string // As in JSON schema
+}
+
+/**
+ * A request or response body which is not JSON, e.g. a photo.
+ */
+type RawBody struct {
+	ContentType string
+}
+
+/**
+ * Dispatches requests by exact path and method. Unlike http.ServeMux, a request with the wrong
+ * method gets a 405 with an Allow header instead of reaching the handler.
+ */
+type Router struct {
+	paths map[string]map[string]http.Handler
+}
+
+// Stands in for the method of routes which accept all of them.
+const anyMethod = "*"
+
+func NewRouter() *Router {
+	return &Router{paths: map[string]map[string]http.Handler{}}
+}
+
+func (router *Router) Handle(method string, path string, handler http.Handler) {
+	methods, ok := router.paths[path]
+	if !ok {
+		methods = map[string]http.Handler{}
+		router.paths[path] = methods
+	}
+	if _, exists := methods[method]; exists {
+		panic("duplicate route: " + method + " " + path)
+	}
+	methods[method] = handler
+}
+
+/**
+ * Register a table of routes below the given prefix (e.g. "/v1").
+ */
+func (router *Router) HandleRoutes(prefix string, routes []Route) {
+	for _, route := range routes {
+		router.Handle(route.Method, prefix+route.Path, route.Handler)
+	}
+}
+
+/**
+ * Like HandleRoutes, but the routes accept any method. For paths which existed before we checked
+ * methods at all, so clients out there may be using anything.
+ */
+func (router *Router) HandleRoutesAnyMethod(prefix string, routes []Route) {
+	for _, route := range routes {
+		router.Handle(anyMethod, prefix+route.Path, route.Handler)
+	}
+}
+
+/**
+ * The registered path for a request path, or "unmatched". For metrics and traces, which must not
+ * get a new series for every random URL a client tries.
+ */
+func (router *Router) RouteLabel(path string) string {
+	if _, ok := router.paths[path]; ok {
+		return path
+	}
+	return "unmatched"
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	methods, ok := router.paths[r.URL.Path]
+	if !ok {
+		WriteError(w, r, APIErrNotFound)
+		return
+	}
+
+	handler, ok := methods[r.Method]
+	if !ok && r.Method == http.MethodHead {
+		handler, ok = methods[http.MethodGet]
+	}
+	if !ok {
+		handler, ok = methods[anyMethod]
+	}
+	if !ok {
+		allowed := make([]string, 0, len(methods))
+		for method := range methods {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		WriteError(w, r, APIErrMethodNotAllowed)
+		return
+	}
+
+	handler.ServeHTTP(w, r)
+}
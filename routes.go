@@ -0,0 +1,207 @@
+package main
+
+import "net/http"
+
+/**
+ * The current API. Shipped clients depend on all of this, so changes have to be backwards
+ * compatible; anything breaking goes into a new version (a v2Routes table mounted at /v2, which
+ * can reuse the handlers that did not change).
+ */
+var v1Routes = []Route{
+	{
+		Method: http.MethodPost, Path: "/register", Handler: RegisterHandler,
+		Summary:  "Create a new account, along with credentials for the calling device.",
+		Public:   true,
+		Response: AccountResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/setprops", Handler: SetPropsHandler,
+		Summary:  "Change the push token or name of the calling device, or the profile of the account.",
+		Request:  SetPropsArguments{},
+		Response: AccountResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/avatar", Handler: AvatarHandler,
+		Summary:  "Load the avatar of your own account, of an account you are connected to, or of one asking to connect to you.",
+		Query:    []QueryParameter{{Name: "accountId", Description: "Account to load the avatar of.", Type: "integer"}},
+		Response: RawBody{ContentType: "image/*"},
+	},
+	{
+		Method: http.MethodPost, Path: "/rotate-key", Handler: RotateKeyHandler,
+		Summary:  "Issue a new auth key for the calling device; the current one stops working.",
+		Response: AccountResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/devices", Handler: ListDevicesHandler,
+		Summary:  "List the devices signed in to the account.",
+		Response: []DeviceResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/devices/pair", Handler: PairDeviceHandler,
+		Summary:  "Get a short-lived code with which another device can join the account.",
+		Response: PairingResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/devices/add", Handler: AddDeviceHandler,
+		Summary:  "Join an account with a pairing code, getting credentials for the new device.",
+		Public:   true,
+		Request:  AddDeviceArguments{},
+		Response: AccountResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/devices/revoke", Handler: RevokeDeviceHandler,
+		Summary: "Sign a device out of the account.",
+		Request: RevokeDeviceArguments{},
+	},
+	{
+		Method: http.MethodPost, Path: "/connect", Handler: ConnectHandler,
+		Summary:  "Ask the account with the given connect code to connect. Leaves any current connection.",
+		Request:  ConnectArguments{},
+		Response: StateResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/disconnect", Handler: DisconnectHandler,
+		Summary:  "Leave the current connection.",
+		Response: StateResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/query", Handler: QueryHandler,
+		Summary:  "Return the connection state, and whether there are payloads to fetch.",
+		Response: StateResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/accept", Handler: AcceptHandler,
+		Summary:  "Accept a pending connection request.",
+		Request:  AcceptArguments{},
+		Response: StateResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/set", Handler: SetPictureHandler,
+		Summary:  "Upload a photo, animation, video or Live Photo, a caption or both for the peer, replacing what they have not fetched yet. Content-Type says what the body is. Also takes a multipart form with the file, video, caption and kind fields.",
+		Headers:  payloadHeaders,
+		Request:  RawBody{ContentType: "application/octet-stream"},
+		Response: StateResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/get", Handler: GetPictureHandler,
+		Summary:         "Download the photo the peer sent, or the still of a Live Photo; empty for a text beam. Content-Type is what the sender declared.",
+		ResponseHeaders: payloadHeaders,
+		Response:        RawBody{ContentType: "application/octet-stream"},
+	},
+	{
+		Method: http.MethodGet, Path: "/get/video", Handler: GetVideoHandler,
+		Summary:  "Download the video of a Live Photo the peer sent.",
+		Response: RawBody{ContentType: "application/octet-stream"},
+	},
+	{
+		Method: http.MethodPost, Path: "/clear", Handler: ClearPictureHandler,
+		Summary:  "Confirm the photo was fetched, so the server can delete it.",
+		Response: StateResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/block", Handler: BlockHandler,
+		Summary:  "Block an account, removing any connection with it.",
+		Request:  BlockArguments{},
+		Response: StateResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/unblock", Handler: UnblockHandler,
+		Summary:  "Remove a block.",
+		Request:  BlockArguments{},
+		Response: StateResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/report", Handler: ReportHandler,
+		Summary:  "Report the current peer, along with the photo they sent if it was not cleared yet.",
+		Request:  ReportArguments{},
+		Response: StateResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/delete-account", Handler: DeleteAccountHandler,
+		Summary: "Delete the account and everything stored about it.",
+	},
+	{
+		Method: http.MethodGet, Path: "/export", Handler: ExportHandler,
+		Summary:  "Download a zip archive of everything stored about the account.",
+		Response: RawBody{ContentType: "application/zip"},
+	},
+}
+
+/**
+ * The iOS app shipped talking to these paths without a version prefix, and without us checking
+ * the method, so they stay as they were. Only these: everything added since is under /v1 alone.
+ */
+var legacyRoutes = []Route{
+	{Path: "/register", Handler: RegisterHandler},
+	{Path: "/setprops", Handler: SetPropsHandler},
+	{Path: "/connect", Handler: ConnectHandler},
+	{Path: "/disconnect", Handler: DisconnectHandler},
+	{Path: "/query", Handler: QueryHandler},
+	{Path: "/accept", Handler: AcceptHandler},
+	{Path: "/set", Handler: SetPictureHandler},
+	{Path: "/get", Handler: GetPictureHandler},
+	{Path: "/clear", Handler: ClearPictureHandler},
+}
+
+// The kind and caption of a payload, and how it was encrypted to the public key of the receiver. Sent with
+// /set, and passed on with /get; without the key id, the payload is not encrypted.
+var payloadHeaders = []QueryParameter{
+	{Name: HeaderKind, Description: "photo, animation, video, livePhoto or text. Guessed from the parts and Content-Type if left out.", Type: "string"},
+	{Name: HeaderCaption, Description: "Text sent with the photo, or instead of it; percent-encoded UTF-8, at most 1000 characters. Not covered by the encryption.", Type: "string"},
+	{Name: HeaderKeyId, Description: "The keyId of the public key of the peer the payload is encrypted to.", Type: "string"},
+	{Name: HeaderAlgorithm, Description: "The encryption algorithm, as the apps name it. Required with a key id.", Type: "string"},
+	{Name: HeaderNonce, Description: "Nonce of the encryption, base64 encoded.", Type: "string"},
+}
+
+func NewAPIRouter() *Router {
+	router := NewRouter()
+	router.HandleRoutes("/v1", v1Routes)
+	router.HandleRoutesAnyMethod("", legacyRoutes)
+
+	router.Handle(http.MethodGet, "/openapi.json", http.HandlerFunc(OpenAPIHandler))
+
+	// For the orchestrator, not for clients.
+	router.Handle(http.MethodGet, "/healthz", http.HandlerFunc(HealthzHandler))
+	router.Handle(http.MethodGet, "/readyz", http.HandlerFunc(ReadyzHandler))
+
+	return router
+}
+
+/**
+ * The API with all the middleware, as the server serves it.
+ */
+func NewAPIHandler() http.Handler {
+	router := NewAPIRouter()
+	return withRequestId(logRequest(withTracing(router, withMetrics(router, withRecovery(router)))))
+}
+
+/**
+ * The admin API, served on its own listener. Not part of the OpenAPI document; it may change
+ * whenever we like.
+ */
+var adminRoutes = []Route{
+	{Method: http.MethodGet, Path: "/", Handler: AdminDashboardHandler, Summary: "HTML dashboard."},
+	{Method: http.MethodGet, Path: "/api/stats", Handler: AdminStatsHandler, Summary: "Counts of accounts, connections and payloads."},
+	{Method: http.MethodGet, Path: "/api/activity", Handler: AdminActivityHandler, Summary: "Registrations, connections and beams per day."},
+	{Method: http.MethodGet, Path: "/api/accounts", Handler: AdminSearchAccountsHandler, Summary: "Search accounts by id, connect code or name."},
+	{Method: http.MethodGet, Path: "/api/account", Handler: AdminAccountHandler, Summary: "An account with its devices, connection and payloads."},
+	{Method: http.MethodPost, Path: "/api/account/disconnect", Handler: AdminDisconnectHandler, Summary: "Remove all connections of an account."},
+	{Method: http.MethodPost, Path: "/api/account/purge-payloads", Handler: AdminPurgePayloadsHandler, Summary: "Delete all payloads of an account."},
+	{Method: http.MethodPost, Path: "/api/account/reset-push", Handler: AdminResetPushHandler, Summary: "Forget the push tokens of an account."},
+	{Method: http.MethodPost, Path: "/api/account/test-push", Handler: AdminTestPushHandler, Summary: "Send a push to all devices of an account."},
+	{Method: http.MethodPost, Path: "/api/account/delete", Handler: AdminDeleteAccountHandler, Summary: "Delete an account and everything about it."},
+	{Method: http.MethodGet, Path: "/api/reports", Handler: AdminListReportsHandler, Summary: "Open reports, or all with all=true."},
+	{Method: http.MethodGet, Path: "/api/report", Handler: AdminReportHandler, Summary: "A single report."},
+	{Method: http.MethodGet, Path: "/api/report/payload", Handler: AdminReportPayloadHandler, Summary: "The reported photo."},
+	{Method: http.MethodGet, Path: "/api/report/video", Handler: AdminReportVideoHandler, Summary: "The video of a reported Live Photo."},
+	{Method: http.MethodPost, Path: "/api/report/resolve", Handler: AdminResolveReportHandler, Summary: "Mark a report as handled."},
+}
+
+/**
+ * Everything on the admin listener needs the admin token.
+ */
+func NewAdminRouter(token string) http.Handler {
+	router := NewRouter()
+	router.HandleRoutes("", adminRoutes)
+	return withAdminAuth(token, router)
+}
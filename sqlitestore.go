@@ -0,0 +1,892 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-pg/pg/v10"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	_ "modernc.org/sqlite"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * Like migrations, for SQLite. A fresh SQLite database starts empty, so the first one creates all
+ * the tables as they are now. Only ever append to this list.
+ */
+var sqliteMigrations = []string{
+	// 1: Everything.
+	`
+	CREATE TABLE accounts (
+		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		connect_code TEXT NOT NULL DEFAULT '',
+		display_name TEXT NOT NULL DEFAULT '',
+		time_created TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX accounts_connect_code_idx ON accounts (connect_code);
+
+	CREATE TABLE avatars (
+		account_id   INTEGER PRIMARY KEY,
+		data         BLOB,
+		content_type TEXT NOT NULL DEFAULT '',
+		hash         TEXT NOT NULL DEFAULT '',
+		time_updated TIMESTAMP
+	);
+
+	CREATE TABLE devices (
+		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		account_id   INTEGER NOT NULL,
+		name         TEXT NOT NULL DEFAULT '',
+		platform     TEXT NOT NULL DEFAULT '',
+		key_prefix   TEXT NOT NULL DEFAULT '',
+		key_hash     TEXT NOT NULL DEFAULT '',
+		push_token   TEXT NOT NULL DEFAULT '',
+		time_created TIMESTAMP
+	);
+	CREATE INDEX devices_key_prefix_idx ON devices (key_prefix);
+	CREATE INDEX devices_account_id_idx ON devices (account_id);
+
+	CREATE TABLE device_pairings (
+		code         TEXT PRIMARY KEY,
+		account_id   INTEGER NOT NULL,
+		time_expires TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE connections (
+		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		initiator_id INTEGER NOT NULL,
+		invitee_id   INTEGER NOT NULL,
+		status       TEXT NOT NULL DEFAULT '',
+		time_created TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX connections_initiator_id_idx ON connections (initiator_id);
+	CREATE INDEX connections_invitee_id_idx ON connections (invitee_id);
+
+	CREATE TABLE payloads (
+		connection_id INTEGER NOT NULL,
+		from_id       INTEGER NOT NULL,
+		time_created  TIMESTAMP,
+		time_fetched  TIMESTAMP,
+		fetched       INTEGER NOT NULL DEFAULT 0,
+		data          BLOB,
+		PRIMARY KEY (connection_id, from_id)
+	);
+
+	CREATE TABLE blocks (
+		blocker_id   INTEGER NOT NULL,
+		blocked_id   INTEGER NOT NULL,
+		time_created TIMESTAMP,
+		PRIMARY KEY (blocker_id, blocked_id)
+	);
+
+	CREATE TABLE reports (
+		id                      INTEGER PRIMARY KEY AUTOINCREMENT,
+		reporter_id             INTEGER NOT NULL,
+		reported_id             INTEGER NOT NULL,
+		reason                  TEXT NOT NULL DEFAULT '',
+		connection_id           INTEGER NOT NULL DEFAULT 0,
+		connection_initiator_id INTEGER NOT NULL DEFAULT 0,
+		connection_invitee_id   INTEGER NOT NULL DEFAULT 0,
+		connection_status       TEXT NOT NULL DEFAULT '',
+		payload_data            BLOB,
+		payload_time_created    TIMESTAMP,
+		time_created            TIMESTAMP,
+		time_resolved           TIMESTAMP
+	);
+
+	CREATE TABLE daily_activities (
+		day           DATE PRIMARY KEY,
+		registrations INTEGER NOT NULL DEFAULT 0,
+		connections   INTEGER NOT NULL DEFAULT 0,
+		beams         INTEGER NOT NULL DEFAULT 0
+	);
+	`,
+
+	// 2: Public keys, and payloads encrypted to them.
+	`
+	ALTER TABLE accounts ADD COLUMN public_key BLOB;
+	ALTER TABLE accounts ADD COLUMN public_key_algorithm TEXT NOT NULL DEFAULT '';
+	ALTER TABLE accounts ADD COLUMN public_key_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE payloads ADD COLUMN key_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE payloads ADD COLUMN algorithm TEXT NOT NULL DEFAULT '';
+	ALTER TABLE payloads ADD COLUMN nonce BLOB;
+	`,
+
+	// 3: Encryption at rest.
+	`
+	ALTER TABLE payloads ADD COLUMN data_key BLOB;
+	ALTER TABLE payloads ADD COLUMN master_key_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE reports ADD COLUMN payload_data_key BLOB;
+	ALTER TABLE reports ADD COLUMN payload_master_key_id TEXT NOT NULL DEFAULT '';
+	`,
+
+	// 4: Captions, and alert pushes.
+	`
+	ALTER TABLE payloads ADD COLUMN caption BLOB;
+	ALTER TABLE reports ADD COLUMN payload_caption BLOB;
+	ALTER TABLE devices ADD COLUMN alert_pushes BOOLEAN NOT NULL DEFAULT 0;
+	`,
+
+	// 5: Payload kinds, and the video of Live Photos.
+	`
+	ALTER TABLE payloads ADD COLUMN kind TEXT NOT NULL DEFAULT '';
+	ALTER TABLE payloads ADD COLUMN content_type TEXT NOT NULL DEFAULT '';
+	ALTER TABLE payloads ADD COLUMN video BLOB;
+	ALTER TABLE payloads ADD COLUMN video_content_type TEXT NOT NULL DEFAULT '';
+	`,
+
+	// 6: The kind and video of reported payloads.
+	`
+	ALTER TABLE reports ADD COLUMN payload_kind TEXT NOT NULL DEFAULT '';
+	ALTER TABLE reports ADD COLUMN payload_content_type TEXT NOT NULL DEFAULT '';
+	ALTER TABLE reports ADD COLUMN payload_video BLOB;
+	ALTER TABLE reports ADD COLUMN payload_video_content_type TEXT NOT NULL DEFAULT '';
+	`,
+
+	// 7: Payloads which leaving a connection used to leave behind.
+	`
+	DELETE FROM payloads WHERE connection_id NOT IN (SELECT id FROM connections);
+	`,
+}
+
+/**
+ * The Store on an SQLite file, so a small installation does not need a Postgres server.
+ */
+type sqliteStore struct {
+	db  *sql.DB
+	tx  *sql.Tx // Inside RunInTransaction
+	ctx context.Context
+}
+
+/**
+ * Open (or create) the database at path. Transactions take the write lock right away, and
+ * writers wait for each other instead of failing with "database is locked".
+ */
+func NewSqliteStore(path string) Store {
+	dsn := "file:" + path + "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_txlock=immediate&_time_format=sqlite"
+	// This only fails for an unknown driver; problems with the file come up on the first query.
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		panic(err)
+	}
+	return &sqliteStore{db: db, ctx: context.Background()}
+}
+
+// What the queries run on, inside a transaction or not.
+type sqliteConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (s *sqliteStore) conn() sqliteConn {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+/**
+ * Trace and log a query like the hooks do on Postgres. Call the returned function with the error
+ * once the query is done.
+ */
+func (s *sqliteStore) startQuery(query string) (context.Context, func(error)) {
+	operation := "query"
+	if fields := strings.Fields(query); len(fields) > 0 {
+		operation = strings.ToUpper(fields[0])
+	}
+	start := time.Now()
+	ctx, span := tracer.Start(s.ctx, operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "sqlite"),
+			attribute.String("db.operation", operation),
+		))
+	return ctx, func(err error) {
+		if err != nil && err != sql.ErrNoRows {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+
+		logger := Logger(s.ctx)
+		if logger.Enabled(s.ctx, slog.LevelDebug) {
+			attrs := []interface{}{"query", strings.Join(strings.Fields(query), " "), "duration_ms", time.Since(start).Milliseconds()}
+			if err != nil {
+				attrs = append(attrs, "error", err)
+			}
+			logger.Debug("query", attrs...)
+		}
+	}
+}
+
+func (s *sqliteStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	ctx, done := s.startQuery(query)
+	result, err := s.conn().ExecContext(ctx, query, args...)
+	done(err)
+	return result, err
+}
+
+// Returns how many rows the statement changed.
+func (s *sqliteStore) execCount(query string, args ...interface{}) (int, error) {
+	result, err := s.exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	count, err := result.RowsAffected()
+	return int(count), err
+}
+
+// Runs an INSERT and returns the id of the new row.
+func (s *sqliteStore) insert(query string, args ...interface{}) (int, error) {
+	result, err := s.exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+/**
+ * Run a query and call scan for each row. scan gets the Scan of the current row.
+ */
+func (s *sqliteStore) query(query string, args []interface{}, scan func(scan func(dest ...interface{}) error) error) error {
+	ctx, done := s.startQuery(query)
+	rows, err := s.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		done(err)
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = scan(rows.Scan); err != nil {
+			done(err)
+			return err
+		}
+	}
+	err = rows.Err()
+	done(err)
+	return err
+}
+
+// Like query, for at most one row. Returns ErrNotFound if there is none.
+func (s *sqliteStore) queryOne(query string, args []interface{}, dest ...interface{}) error {
+	found := false
+	err := s.query(query, args, func(scan func(dest ...interface{}) error) error {
+		found = true
+		return scan(dest...)
+	})
+	if err == nil && !found {
+		return ErrNotFound
+	}
+	return err
+}
+
+func args(values ...interface{}) []interface{} {
+	return values
+}
+
+// NULL for the zero time, like go-pg does.
+func sqliteTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func sqliteNullTime(t sql.NullTime) pg.NullTime {
+	if !t.Valid {
+		return pg.NullTime{}
+	}
+	return pg.NullTime{Time: t.Time}
+}
+
+func (s *sqliteStore) Context() context.Context {
+	return s.ctx
+}
+
+func (s *sqliteStore) WithContext(ctx context.Context) Store {
+	return &sqliteStore{db: s.db, tx: s.tx, ctx: ctx}
+}
+
+func (s *sqliteStore) RunInTransaction(fn func(tx Store) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = fn(&sqliteStore{db: s.db, tx: tx, ctx: s.ctx})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) CreateSchema() error {
+	_, err := s.exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, time_applied TIMESTAMP)`)
+	if err != nil {
+		return err
+	}
+	version, _, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(sqliteMigrations); version++ {
+		migration := sqliteMigrations[version]
+		err = s.RunInTransaction(func(tx Store) error {
+			_, err := tx.(*sqliteStore).exec(migration)
+			if err != nil {
+				return err
+			}
+			_, err = tx.(*sqliteStore).exec(`INSERT INTO schema_migrations (version, time_applied) VALUES (?, ?)`, version+1, time.Now())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d failed: %s", version+1, err)
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) SchemaVersion() (int, int, error) {
+	var version int
+	err := s.queryOne(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`, nil, &version)
+	return version, len(sqliteMigrations), err
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+const sqliteAccountColumns = `id, connect_code, display_name, time_created, public_key, public_key_algorithm, public_key_id`
+
+func scanAccount(scan func(dest ...interface{}) error, account *Account) error {
+	return scan(&account.Id, &account.ConnectCode, &account.DisplayName, &account.TimeCreated,
+		&account.PublicKey, &account.PublicKeyAlgorithm, &account.PublicKeyId)
+}
+
+func (s *sqliteStore) getAccount(where string, value interface{}) (*Account, error) {
+	account := new(Account)
+	found := false
+	err := s.query(`SELECT `+sqliteAccountColumns+` FROM accounts WHERE `+where+` LIMIT 1`, args(value),
+		func(scan func(dest ...interface{}) error) error {
+			found = true
+			return scanAccount(scan, account)
+		})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	return account, nil
+}
+
+func (s *sqliteStore) InsertAccount(account *Account) (err error) {
+	account.Id, err = s.insert(`INSERT INTO accounts (connect_code, display_name, time_created) VALUES (?, ?, ?)`,
+		account.ConnectCode, account.DisplayName, account.TimeCreated)
+	return err
+}
+
+func (s *sqliteStore) GetAccount(accountId int) (*Account, error) {
+	return s.getAccount(`id = ?`, accountId)
+}
+
+func (s *sqliteStore) GetAccountByConnectCode(connectCode string) (*Account, error) {
+	return s.getAccount(`connect_code = ?`, connectCode)
+}
+
+func (s *sqliteStore) UpdateAccount(account *Account) error {
+	_, err := s.exec(`
+		UPDATE accounts SET connect_code = ?, display_name = ?, public_key = ?, public_key_algorithm = ?, public_key_id = ?
+		WHERE id = ?`,
+		account.ConnectCode, account.DisplayName, account.PublicKey, account.PublicKeyAlgorithm, account.PublicKeyId, account.Id)
+	return err
+}
+
+func (s *sqliteStore) SearchAccounts(search string, limit int) ([]Account, error) {
+	query := `SELECT ` + sqliteAccountColumns + ` FROM accounts`
+	var values []interface{}
+	if search != "" {
+		id, err := strconv.Atoi(search)
+		if err != nil {
+			id = -1
+		}
+		query += ` WHERE id = ? OR connect_code = ? OR display_name LIKE ?`
+		values = args(id, search, "%"+search+"%")
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	values = append(values, limit)
+
+	accounts := []Account{}
+	err := s.query(query, values, func(scan func(dest ...interface{}) error) error {
+		var account Account
+		if err := scanAccount(scan, &account); err != nil {
+			return err
+		}
+		accounts = append(accounts, account)
+		return nil
+	})
+	return accounts, err
+}
+
+func (s *sqliteStore) DeleteAccount(accountId int) error {
+	return s.RunInTransaction(func(tx Store) error {
+		statements := []string{
+			`DELETE FROM payloads WHERE from_id = ?1
+				OR connection_id IN (SELECT id FROM connections WHERE invitee_id = ?1 OR initiator_id = ?1)`,
+			`DELETE FROM connections WHERE invitee_id = ?1 OR initiator_id = ?1`,
+			`DELETE FROM blocks WHERE blocker_id = ?1 OR blocked_id = ?1`,
+			`DELETE FROM reports WHERE reporter_id = ?1`,
+			`UPDATE reports SET payload_data = NULL, payload_caption = NULL, payload_video = NULL, payload_data_key = NULL,
+				payload_master_key_id = ''
+			WHERE reported_id = ?1`,
+			`DELETE FROM device_pairings WHERE account_id = ?1`,
+			`DELETE FROM devices WHERE account_id = ?1`,
+			`DELETE FROM avatars WHERE account_id = ?1`,
+			`DELETE FROM accounts WHERE id = ?1`,
+		}
+		for _, statement := range statements {
+			_, err := tx.(*sqliteStore).exec(statement, accountId)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+const sqliteDeviceColumns = `id, account_id, name, platform, key_prefix, key_hash, push_token, time_created, alert_pushes`
+
+func (s *sqliteStore) listDevices(where string, value interface{}) ([]Device, error) {
+	devices := []Device{}
+	err := s.query(`SELECT `+sqliteDeviceColumns+` FROM devices WHERE `+where+` ORDER BY id ASC`, args(value),
+		func(scan func(dest ...interface{}) error) error {
+			var device Device
+			err := scan(&device.Id, &device.AccountId, &device.Name, &device.Platform,
+				&device.KeyPrefix, &device.KeyHash, &device.PushToken, &device.TimeCreated, &device.AlertPushes)
+			if err != nil {
+				return err
+			}
+			devices = append(devices, device)
+			return nil
+		})
+	return devices, err
+}
+
+func (s *sqliteStore) InsertDevice(device *Device) (err error) {
+	device.Id, err = s.insert(`
+		INSERT INTO devices (account_id, name, platform, key_prefix, key_hash, push_token, time_created, alert_pushes)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		device.AccountId, device.Name, device.Platform, device.KeyPrefix, device.KeyHash, device.PushToken, device.TimeCreated,
+		device.AlertPushes)
+	return err
+}
+
+func (s *sqliteStore) UpdateDevice(device *Device) error {
+	_, err := s.exec(`
+		UPDATE devices SET name = ?, platform = ?, key_prefix = ?, key_hash = ?, push_token = ?, alert_pushes = ?
+		WHERE id = ?`,
+		device.Name, device.Platform, device.KeyPrefix, device.KeyHash, device.PushToken, device.AlertPushes, device.Id)
+	return err
+}
+
+func (s *sqliteStore) ListDevices(accountId int) ([]Device, error) {
+	return s.listDevices(`account_id = ?`, accountId)
+}
+
+func (s *sqliteStore) FindDevicesByKeyPrefix(keyPrefix string) ([]Device, error) {
+	return s.listDevices(`key_prefix = ?`, keyPrefix)
+}
+
+func (s *sqliteStore) DeleteDevice(accountId int, deviceId int) (bool, error) {
+	count, err := s.execCount(`DELETE FROM devices WHERE id = ? AND account_id = ?`, deviceId, accountId)
+	return count > 0, err
+}
+
+func (s *sqliteStore) ResetPushTokens(accountId int) (int, error) {
+	return s.execCount(`UPDATE devices SET push_token = '' WHERE account_id = ? AND push_token != ''`, accountId)
+}
+
+func (s *sqliteStore) InsertPairing(pairing *DevicePairing) error {
+	_, err := s.exec(`INSERT INTO device_pairings (code, account_id, time_expires) VALUES (?, ?, ?)`,
+		pairing.Code, pairing.AccountId, pairing.TimeExpires)
+	return err
+}
+
+func (s *sqliteStore) TakePairing(code string) (*DevicePairing, error) {
+	pairing := &DevicePairing{Code: code}
+	err := s.queryOne(`DELETE FROM device_pairings WHERE code = ? RETURNING account_id, time_expires`, args(code),
+		&pairing.AccountId, &pairing.TimeExpires)
+	if err != nil {
+		return nil, err
+	}
+	return pairing, nil
+}
+
+func (s *sqliteStore) DeleteExpiredPairings(now time.Time) error {
+	_, err := s.exec(`DELETE FROM device_pairings WHERE time_expires < ?`, now)
+	return err
+}
+
+func (s *sqliteStore) InsertConnection(connection *Connection) (err error) {
+	connection.Id, err = s.insert(`INSERT INTO connections (initiator_id, invitee_id, status, time_created) VALUES (?, ?, ?, ?)`,
+		connection.InitiatorId, connection.InviteeId, connection.Status, connection.TimeCreated)
+	return err
+}
+
+func (s *sqliteStore) UpdateConnection(connection *Connection) error {
+	_, err := s.exec(`UPDATE connections SET status = ? WHERE id = ?`, connection.Status, connection.Id)
+	return err
+}
+
+func (s *sqliteStore) ListConnections(accountId int) ([]Connection, error) {
+	connections := []Connection{}
+	err := s.query(`
+		SELECT id, initiator_id, invitee_id, status, time_created FROM connections
+		WHERE invitee_id = ?1 OR initiator_id = ?1 ORDER BY id ASC`, args(accountId),
+		func(scan func(dest ...interface{}) error) error {
+			var connection Connection
+			err := scan(&connection.Id, &connection.InitiatorId, &connection.InviteeId, &connection.Status, &connection.TimeCreated)
+			if err != nil {
+				return err
+			}
+			connections = append(connections, connection)
+			return nil
+		})
+	return connections, err
+}
+
+func (s *sqliteStore) DeleteConnection(connectionId int) error {
+	_, err := s.exec(`DELETE FROM connections WHERE id = ?`, connectionId)
+	return err
+}
+
+const sqlitePayloadColumns = `connection_id, from_id, time_created, time_fetched, fetched, data, key_id, algorithm, nonce,
+	data_key, master_key_id, caption, kind, content_type, video, video_content_type`
+
+func scanPayload(scan func(dest ...interface{}) error, payload *Payload) error {
+	var timeFetched sql.NullTime
+	err := scan(&payload.ConnectionId, &payload.FromId, &payload.TimeCreated, &timeFetched, &payload.Fetched, &payload.Data,
+		&payload.KeyId, &payload.Algorithm, &payload.Nonce, &payload.DataKey, &payload.MasterKeyId, &payload.Caption,
+		&payload.Kind, &payload.ContentType, &payload.Video, &payload.VideoContentType)
+	payload.TimeFetched = sqliteNullTime(timeFetched)
+	return err
+}
+
+func (s *sqliteStore) PutPayload(payload *Payload) error {
+	_, err := s.exec(`INSERT OR REPLACE INTO payloads (`+sqlitePayloadColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		payload.ConnectionId, payload.FromId, payload.TimeCreated, sqliteTime(payload.TimeFetched.Time), payload.Fetched, payload.Data,
+		payload.KeyId, payload.Algorithm, payload.Nonce, payload.DataKey, payload.MasterKeyId, payload.Caption,
+		payload.Kind, payload.ContentType, payload.Video, payload.VideoContentType)
+	return err
+}
+
+func (s *sqliteStore) GetPayload(connectionId int, fromId int) (*Payload, error) {
+	payload := new(Payload)
+	found := false
+	err := s.query(`SELECT `+sqlitePayloadColumns+` FROM payloads WHERE connection_id = ? AND from_id = ?`, args(connectionId, fromId),
+		func(scan func(dest ...interface{}) error) error {
+			found = true
+			return scanPayload(scan, payload)
+		})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	return payload, nil
+}
+
+func (s *sqliteStore) ListPayloads(connectionId int) ([]Payload, error) {
+	payloads := []Payload{}
+	err := s.query(`SELECT `+sqlitePayloadColumns+` FROM payloads WHERE connection_id = ? ORDER BY time_created ASC`, args(connectionId),
+		func(scan func(dest ...interface{}) error) error {
+			var payload Payload
+			if err := scanPayload(scan, &payload); err != nil {
+				return err
+			}
+			payloads = append(payloads, payload)
+			return nil
+		})
+	return payloads, err
+}
+
+func (s *sqliteStore) ListAccountPayloads(accountId int) ([]Payload, error) {
+	payloads := []Payload{}
+	err := s.query(`SELECT `+sqlitePayloadColumns+` FROM payloads
+		WHERE from_id = ?1 OR connection_id IN (SELECT id FROM connections WHERE invitee_id = ?1 OR initiator_id = ?1)
+		ORDER BY time_created ASC`, args(accountId),
+		func(scan func(dest ...interface{}) error) error {
+			var payload Payload
+			if err := scanPayload(scan, &payload); err != nil {
+				return err
+			}
+			payloads = append(payloads, payload)
+			return nil
+		})
+	return payloads, err
+}
+
+func (s *sqliteStore) UpdatePayload(payload *Payload) error {
+	_, err := s.exec(`
+		UPDATE payloads SET time_created = ?, time_fetched = ?, fetched = ?, data = ?, key_id = ?, algorithm = ?, nonce = ?,
+			data_key = ?, master_key_id = ?, caption = ?, kind = ?, content_type = ?, video = ?, video_content_type = ?
+		WHERE connection_id = ? AND from_id = ?`,
+		payload.TimeCreated, sqliteTime(payload.TimeFetched.Time), payload.Fetched, payload.Data,
+		payload.KeyId, payload.Algorithm, payload.Nonce, payload.DataKey, payload.MasterKeyId, payload.Caption,
+		payload.Kind, payload.ContentType, payload.Video, payload.VideoContentType,
+		payload.ConnectionId, payload.FromId)
+	return err
+}
+
+func (s *sqliteStore) ListPayloadsToSeal(masterKeyId string, limit int) ([]Payload, error) {
+	payloads := []Payload{}
+	err := s.query(`
+		SELECT `+sqlitePayloadColumns+` FROM payloads WHERE (length(data) > 0 OR length(caption) > 0 OR length(video) > 0) AND master_key_id != ?
+		ORDER BY connection_id ASC, from_id ASC LIMIT ?`, args(masterKeyId, limit),
+		func(scan func(dest ...interface{}) error) error {
+			var payload Payload
+			if err := scanPayload(scan, &payload); err != nil {
+				return err
+			}
+			payloads = append(payloads, payload)
+			return nil
+		})
+	return payloads, err
+}
+
+func (s *sqliteStore) ResealPayload(payload *Payload, previousMasterKeyId string) (bool, error) {
+	count, err := s.execCount(`
+		UPDATE payloads SET data = ?, caption = ?, video = ?, data_key = ?, master_key_id = ?
+		WHERE connection_id = ? AND from_id = ? AND time_created = ? AND NOT fetched AND master_key_id = ?`,
+		payload.Data, payload.Caption, payload.Video, payload.DataKey, payload.MasterKeyId, payload.ConnectionId, payload.FromId, payload.TimeCreated,
+		previousMasterKeyId)
+	return count > 0, err
+}
+
+func (s *sqliteStore) DeletePayloads(connectionId int) (int, error) {
+	return s.execCount(`DELETE FROM payloads WHERE connection_id = ?`, connectionId)
+}
+
+func (s *sqliteStore) InsertBlock(block *Block) error {
+	_, err := s.exec(`INSERT OR IGNORE INTO blocks (blocker_id, blocked_id, time_created) VALUES (?, ?, ?)`,
+		block.BlockerId, block.BlockedId, block.TimeCreated)
+	return err
+}
+
+func (s *sqliteStore) DeleteBlock(blockerId int, blockedId int) error {
+	_, err := s.exec(`DELETE FROM blocks WHERE blocker_id = ? AND blocked_id = ?`, blockerId, blockedId)
+	return err
+}
+
+func (s *sqliteStore) ListBlocks(accountId int) ([]Block, error) {
+	blocks := []Block{}
+	err := s.query(`
+		SELECT blocker_id, blocked_id, time_created FROM blocks
+		WHERE blocker_id = ?1 OR blocked_id = ?1 ORDER BY blocker_id ASC, blocked_id ASC`, args(accountId),
+		func(scan func(dest ...interface{}) error) error {
+			var block Block
+			if err := scan(&block.BlockerId, &block.BlockedId, &block.TimeCreated); err != nil {
+				return err
+			}
+			blocks = append(blocks, block)
+			return nil
+		})
+	return blocks, err
+}
+
+func (s *sqliteStore) PutAvatar(avatar *Avatar) error {
+	_, err := s.exec(`INSERT OR REPLACE INTO avatars (account_id, data, content_type, hash, time_updated) VALUES (?, ?, ?, ?, ?)`,
+		avatar.AccountId, avatar.Data, avatar.ContentType, avatar.Hash, avatar.TimeUpdated)
+	return err
+}
+
+func (s *sqliteStore) GetAvatar(accountId int) (*Avatar, error) {
+	avatar := &Avatar{AccountId: accountId}
+	err := s.queryOne(`SELECT data, content_type, hash, time_updated FROM avatars WHERE account_id = ?`, args(accountId),
+		&avatar.Data, &avatar.ContentType, &avatar.Hash, &avatar.TimeUpdated)
+	if err != nil {
+		return nil, err
+	}
+	return avatar, nil
+}
+
+func (s *sqliteStore) GetAvatarHash(accountId int) (string, error) {
+	var hash string
+	err := s.queryOne(`SELECT hash FROM avatars WHERE account_id = ?`, args(accountId), &hash)
+	if err == ErrNotFound {
+		return "", nil
+	}
+	return hash, err
+}
+
+func (s *sqliteStore) DeleteAvatar(accountId int) error {
+	_, err := s.exec(`DELETE FROM avatars WHERE account_id = ?`, accountId)
+	return err
+}
+
+// The copy of the payload, which the lists leave out by selecting NULL in its place.
+const (
+	sqliteReportPayloadColumns   = "payload_data, payload_caption, payload_video"
+	sqliteReportNoPayloadColumns = "NULL, NULL, NULL"
+)
+
+func (s *sqliteStore) listReports(payloadColumns string, where string, values ...interface{}) ([]Report, error) {
+	reports := []Report{}
+	err := s.query(`
+		SELECT id, reporter_id, reported_id, reason, connection_id, connection_initiator_id, connection_invitee_id,
+			connection_status, `+payloadColumns+`, payload_time_created, payload_data_key, payload_master_key_id,
+			payload_kind, payload_content_type, payload_video_content_type, time_created, time_resolved
+		FROM reports WHERE `+where+` ORDER BY id ASC`, values,
+		func(scan func(dest ...interface{}) error) error {
+			var report Report
+			var payloadTimeCreated, timeResolved sql.NullTime
+			err := scan(&report.Id, &report.ReporterId, &report.ReportedId, &report.Reason, &report.ConnectionId,
+				&report.ConnectionInitiatorId, &report.ConnectionInviteeId, &report.ConnectionStatus, &report.PayloadData,
+				&report.PayloadCaption, &report.PayloadVideo, &payloadTimeCreated, &report.PayloadDataKey, &report.PayloadMasterKeyId,
+				&report.PayloadKind, &report.PayloadContentType, &report.PayloadVideoContentType, &report.TimeCreated, &timeResolved)
+			if err != nil {
+				return err
+			}
+			report.PayloadTimeCreated = sqliteNullTime(payloadTimeCreated)
+			report.TimeResolved = sqliteNullTime(timeResolved)
+			reports = append(reports, report)
+			return nil
+		})
+	return reports, err
+}
+
+func (s *sqliteStore) InsertReport(report *Report) (err error) {
+	report.Id, err = s.insert(`
+		INSERT INTO reports (reporter_id, reported_id, reason, connection_id, connection_initiator_id, connection_invitee_id,
+			connection_status, payload_data, payload_caption, payload_video, payload_time_created, payload_data_key,
+			payload_master_key_id, payload_kind, payload_content_type, payload_video_content_type, time_created, time_resolved)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		report.ReporterId, report.ReportedId, report.Reason, report.ConnectionId, report.ConnectionInitiatorId,
+		report.ConnectionInviteeId, report.ConnectionStatus, report.PayloadData, report.PayloadCaption, report.PayloadVideo,
+		sqliteTime(report.PayloadTimeCreated.Time), report.PayloadDataKey, report.PayloadMasterKeyId,
+		report.PayloadKind, report.PayloadContentType, report.PayloadVideoContentType,
+		report.TimeCreated, sqliteTime(report.TimeResolved.Time))
+	return err
+}
+
+func (s *sqliteStore) GetReport(reportId int) (*Report, error) {
+	reports, err := s.listReports(sqliteReportPayloadColumns, "id = ?", reportId)
+	if err != nil {
+		return nil, err
+	}
+	if len(reports) == 0 {
+		return nil, ErrNotFound
+	}
+	return &reports[0], nil
+}
+
+func (s *sqliteStore) ListReports(includeResolved bool) ([]Report, error) {
+	if includeResolved {
+		return s.listReports(sqliteReportNoPayloadColumns, "1 = 1")
+	}
+	return s.listReports(sqliteReportNoPayloadColumns, "time_resolved IS NULL")
+}
+
+func (s *sqliteStore) ListReportsFiledBy(reporterId int) ([]Report, error) {
+	return s.listReports(sqliteReportNoPayloadColumns, "reporter_id = ?", reporterId)
+}
+
+func (s *sqliteStore) CountReports(accountId int) (int, int, error) {
+	var filed, against int
+	err := s.queryOne(`
+		SELECT
+			(SELECT count(*) FROM reports WHERE reporter_id = ?1),
+			(SELECT count(*) FROM reports WHERE reported_id = ?1)`, args(accountId), &filed, &against)
+	return filed, against, err
+}
+
+func (s *sqliteStore) ListReportsToSeal(masterKeyId string, limit int) ([]Report, error) {
+	return s.listReports(sqliteReportPayloadColumns, `id IN (
+		SELECT id FROM reports
+		WHERE (length(payload_data) > 0 OR length(payload_caption) > 0 OR length(payload_video) > 0) AND payload_master_key_id != ?1
+		ORDER BY id ASC LIMIT ?2)`,
+		masterKeyId, limit)
+}
+
+func (s *sqliteStore) ResealReport(report *Report, previousMasterKeyId string) (bool, error) {
+	count, err := s.execCount(`
+		UPDATE reports SET payload_data = ?, payload_caption = ?, payload_video = ?, payload_data_key = ?, payload_master_key_id = ?
+		WHERE id = ? AND (payload_data IS NOT NULL OR payload_caption IS NOT NULL OR payload_video IS NOT NULL)
+			AND payload_master_key_id = ?`,
+		report.PayloadData, report.PayloadCaption, report.PayloadVideo, report.PayloadDataKey, report.PayloadMasterKeyId, report.Id, previousMasterKeyId)
+	return count > 0, err
+}
+
+func (s *sqliteStore) ResolveReport(reportId int, now time.Time) error {
+	count, err := s.execCount(`
+		UPDATE reports SET time_resolved = ?, payload_data = NULL, payload_caption = NULL, payload_video = NULL, payload_data_key = NULL,
+			payload_master_key_id = ''
+		WHERE id = ?`, now, reportId)
+	if err == nil && count == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+var errUnknownActivity = errors.New("unknown activity")
+
+func (s *sqliteStore) IncrementActivity(day time.Time, column string) error {
+	switch column {
+	case ActivityRegistrations, ActivityConnections, ActivityBeams:
+	default:
+		return errUnknownActivity
+	}
+	_, err := s.exec(`
+		INSERT INTO daily_activities (day, `+column+`) VALUES (?, 1)
+		ON CONFLICT (day) DO UPDATE SET `+column+` = `+column+` + 1`, day.Format("2006-01-02"))
+	return err
+}
+
+func (s *sqliteStore) ListActivity(since time.Time) ([]DailyActivity, error) {
+	activity := []DailyActivity{}
+	err := s.query(`
+		SELECT day, registrations, connections, beams FROM daily_activities
+		WHERE day >= ? ORDER BY day DESC`, args(since.Format("2006-01-02")),
+		func(scan func(dest ...interface{}) error) error {
+			var day DailyActivity
+			if err := scan(&day.Day, &day.Registrations, &day.Connections, &day.Beams); err != nil {
+				return err
+			}
+			activity = append(activity, day)
+			return nil
+		})
+	return activity, err
+}
+
+func (s *sqliteStore) Stats() (*AdminStats, error) {
+	stats := new(AdminStats)
+	err := s.queryOne(`
+		SELECT
+			(SELECT count(*) FROM accounts),
+			(SELECT count(*) FROM devices),
+			(SELECT count(*) FROM devices WHERE push_token != ''),
+			(SELECT count(*) FROM connections WHERE status != ?1),
+			(SELECT count(*) FROM connections WHERE status = ?1),
+			(SELECT count(*) FROM payloads WHERE data IS NOT NULL),
+			(SELECT COALESCE(sum(length(data)), 0) + COALESCE(sum(length(video)), 0) FROM payloads),
+			(SELECT count(*) FROM reports WHERE time_resolved IS NULL),
+			(SELECT count(*) FROM blocks)`, args(PENDING),
+		&stats.Accounts, &stats.Devices, &stats.DevicesWithPush, &stats.ConnectionsLive, &stats.ConnectionsPending,
+		&stats.PayloadsWaiting, &stats.PayloadBytes, &stats.OpenReports, &stats.Blocks)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
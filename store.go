@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Returned by the Store methods which look up a single row, if there is none.
+var ErrNotFound = errors.New("Not found")
+
+/**
+ * Everything we keep about accounts, their devices, connections and payloads. The logic works
+ * against this instead of the database directly, so it can run on Postgres in production, on
+ * SQLite for a small installation and in memory in the tests.
+ *
+ * Implementations only store and find rows. Which connection counts as the current one, who may
+ * see what and so on is decided by the logic on top.
+ */
+type Store interface {
+	// The context of the request the store is used for, for logging and tracing.
+	Context() context.Context
+	WithContext(ctx context.Context) Store
+
+	// Runs fn with a store whose changes are all applied, or none if fn returns an error.
+	RunInTransaction(fn func(tx Store) error) error
+
+	// Creates what is missing in the database, and applies pending migrations.
+	CreateSchema() error
+	// The migration the database is at, and the one it should be at.
+	SchemaVersion() (current int, latest int, err error)
+
+	Close() error
+
+	// Accounts. InsertAccount sets the id. UpdateAccount saves the connect code, display name and
+	// public key.
+	InsertAccount(account *Account) error
+	GetAccount(accountId int) (*Account, error)
+	GetAccountByConnectCode(connectCode string) (*Account, error)
+	UpdateAccount(account *Account) error
+	// By id, connect code or part of the display name; newest first.
+	SearchAccounts(search string, limit int) ([]Account, error)
+	// Removes the account with everything that belongs to it. Reports against the account are
+	// kept, without the payload.
+	DeleteAccount(accountId int) error
+
+	// Devices. InsertDevice sets the id.
+	InsertDevice(device *Device) error
+	UpdateDevice(device *Device) error
+	// Oldest first.
+	ListDevices(accountId int) ([]Device, error)
+	FindDevicesByKeyPrefix(keyPrefix string) ([]Device, error)
+	// Returns false if the account has no such device.
+	DeleteDevice(accountId int, deviceId int) (bool, error)
+	// Returns how many devices had a token.
+	ResetPushTokens(accountId int) (int, error)
+
+	// Pairing codes. TakePairing deletes the pairing it returns, so it can only be used once.
+	InsertPairing(pairing *DevicePairing) error
+	TakePairing(code string) (*DevicePairing, error)
+	DeleteExpiredPairings(now time.Time) error
+
+	// Connections. InsertConnection sets the id. ListConnections returns those where the account
+	// is either side, oldest first.
+	InsertConnection(connection *Connection) error
+	UpdateConnection(connection *Connection) error
+	ListConnections(accountId int) ([]Connection, error)
+	DeleteConnection(connectionId int) error
+
+	// Payloads, one per sender and connection. PutPayload replaces the previous one.
+	PutPayload(payload *Payload) error
+	GetPayload(connectionId int, fromId int) (*Payload, error)
+	ListPayloads(connectionId int) ([]Payload, error)
+	// Those the account sent, and those on any of its connections; for the data export.
+	ListAccountPayloads(accountId int) ([]Payload, error)
+	UpdatePayload(payload *Payload) error
+	// Returns how many there were.
+	DeletePayloads(connectionId int) (int, error)
+	// For rotate-master-key: payloads with data which is not encrypted with the master key of
+	// this id, or not encrypted at all. ResealPayload saves Data, DataKey and MasterKeyId, unless
+	// the payload was replaced, cleared or resealed since it was loaded with previousMasterKeyId,
+	// and returns whether it did.
+	ListPayloadsToSeal(masterKeyId string, limit int) ([]Payload, error)
+	ResealPayload(payload *Payload, previousMasterKeyId string) (bool, error)
+
+	// Blocks. Inserting a block which exists already does nothing. ListBlocks returns those where
+	// the account is either side.
+	InsertBlock(block *Block) error
+	DeleteBlock(blockerId int, blockedId int) error
+	ListBlocks(accountId int) ([]Block, error)
+
+	// Avatars. PutAvatar replaces the previous one. GetAvatarHash does not load the image, and
+	// returns an empty hash if there is no avatar.
+	PutAvatar(avatar *Avatar) error
+	GetAvatar(accountId int) (*Avatar, error)
+	GetAvatarHash(accountId int) (string, error)
+	DeleteAvatar(accountId int) error
+
+	// Reports. InsertReport sets the id. The lists do not load the payloads, oldest first.
+	InsertReport(report *Report) error
+	GetReport(reportId int) (*Report, error)
+	ListReports(includeResolved bool) ([]Report, error)
+	ListReportsFiledBy(reporterId int) ([]Report, error)
+	CountReports(accountId int) (filed int, against int, err error)
+	// Drops the payload snapshot. Returns ErrNotFound if there is no such report.
+	ResolveReport(reportId int, now time.Time) error
+	// Like ListPayloadsToSeal and ResealPayload, for the payload snapshots.
+	ListReportsToSeal(masterKeyId string, limit int) ([]Report, error)
+	ResealReport(report *Report, previousMasterKeyId string) (bool, error)
+
+	// Counts one event in a column of DailyActivity.
+	IncrementActivity(day time.Time, column string) error
+	// Newest first.
+	ListActivity(since time.Time) ([]DailyActivity, error)
+
+	Stats() (*AdminStats, error)
+}
+
+var defaultStore struct {
+	sync.Mutex
+	store Store
+}
+
+// What OpenStore opens, from the --database and --data-dir flags.
+var storeConfig = struct {
+	backend string
+	dataDir string
+	// Set by tests, which run the commands against a memory store; closing that does nothing.
+	store Store
+}{backend: "postgres"}
+
+/**
+ * Pick the database: "postgres", or "sqlite" for a file in dataDir, which is created if needed.
+ */
+func ConfigureStore(backend string, dataDir string) error {
+	switch backend {
+	case "postgres":
+	case "sqlite":
+		if err := os.MkdirAll(dataDir, 0700); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown database %q, want postgres or sqlite", backend)
+	}
+	storeConfig.backend = backend
+	storeConfig.dataDir = dataDir
+	return nil
+}
+
+/**
+ * The store the server shares between all requests: the configured one, unless SetDefaultStore
+ * picked another one first. Do not close it. Handlers use DefaultStore().WithContext(r.Context()), so
+ * the logic can log with the request id.
+ */
+func DefaultStore() Store {
+	defaultStore.Lock()
+	defer defaultStore.Unlock()
+	if defaultStore.store == nil {
+		defaultStore.store = OpenStore()
+	}
+	return defaultStore.store
+}
+
+/**
+ * A store of its own, for commands which run once. Close it when done.
+ */
+func OpenStore() Store {
+	if storeConfig.store != nil {
+		return storeConfig.store
+	}
+	if storeConfig.backend == "sqlite" {
+		return NewSqliteStore(filepath.Join(storeConfig.dataDir, "photobeam.db"))
+	}
+	return NewPgStore(Connect())
+}
+
+func SetDefaultStore(store Store) {
+	defaultStore.Lock()
+	defer defaultStore.Unlock()
+	defaultStore.store = store
+}
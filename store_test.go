@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/go-pg/pg/v10"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The stores the tests run against, each empty and with the schema created.
+func testStores(t *testing.T) map[string]Store {
+	sqlite := NewSqliteStore(filepath.Join(t.TempDir(), "photobeam.db"))
+	t.Cleanup(func() { sqlite.Close() })
+	if err := sqlite.CreateSchema(); err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Store{"memory": NewMemoryStore(), "sqlite": sqlite}
+}
+
+func TestStoreTransaction(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) { testStoreTransaction(t, store) })
+	}
+}
+
+func testStoreTransaction(t *testing.T, store Store) {
+	failure := errors.New("failure")
+	err := store.RunInTransaction(func(tx Store) error {
+		if err := tx.InsertAccount(&Account{ConnectCode: "gone"}); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("got %v, want the error of the transaction", err)
+	}
+	if _, err := store.GetAccountByConnectCode("gone"); err != ErrNotFound {
+		t.Errorf("account of a failed transaction was kept: %v", err)
+	}
+
+	account, device, err := CreateAccount(store, "phone", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err := store.ListDevices(account.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].Id != device.Id || devices[0].Platform != PLATFORM_IOS {
+		t.Errorf("got devices %v", devices)
+	}
+	if devices[0].Key != "" {
+		t.Errorf("the plaintext key was stored")
+	}
+}
+
+func TestGetConnection(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) { testGetConnection(t, store) })
+	}
+}
+
+func testGetConnection(t *testing.T, store Store) {
+	invitee, _ := CreateTestAccount(store, "invitee")
+	peer, _ := CreateTestAccount(store, "peer")
+	first, _ := CreateTestAccount(store, "first")
+	second, _ := CreateTestAccount(store, "second")
+
+	if _, err := GetConnection(store, invitee.Id); err != ErrNoConnection {
+		t.Errorf("got %v without any connection", err)
+	}
+
+	// The most recent request wins...
+	LinkAccounts(store, first, invitee, PENDING)
+	LinkAccounts(store, second, invitee, PENDING)
+	connection, err := GetConnection(store, invitee.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connection.InitiatorId != second.Id {
+		t.Errorf("got the request of %d, want %d", connection.InitiatorId, second.Id)
+	}
+
+	// ...but not over a live connection, even an older one.
+	if err := store.DeleteConnection(connection.Id); err != nil {
+		t.Fatal(err)
+	}
+	LinkAccounts(store, peer, invitee, PENDING)
+	if err := AcceptLink(store, invitee, peer.Id); err != nil {
+		t.Fatal(err)
+	}
+	LinkAccounts(store, second, invitee, PENDING)
+	connection, err = GetConnection(store, invitee.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connection.GetPeerId(invitee.Id) != peer.Id || connection.Status == PENDING {
+		t.Errorf("got %+v, want the live connection with %d", connection, peer.Id)
+	}
+}
+
+func TestSqliteStore(t *testing.T) {
+	store := testStores(t)["sqlite"]
+
+	// Migrating again does nothing.
+	if err := store.CreateSchema(); err != nil {
+		t.Fatal(err)
+	}
+	if current, latest, err := store.SchemaVersion(); err != nil || current != latest {
+		t.Errorf("got version %d of %d: %v", current, latest, err)
+	}
+
+	sender, _ := CreateTestAccount(store, "sender")
+	receiver, _ := CreateTestAccount(store, "receiver")
+	if err := LinkAccounts(store, sender, receiver, "live"); err != nil {
+		t.Fatal(err)
+	}
+	connection, err := GetConnection(store, sender.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Truncate(time.Microsecond)
+	payload := &Payload{ConnectionId: connection.Id, FromId: sender.Id, TimeCreated: now, Data: []byte("photo"),
+		KeyId: "key", Algorithm: "x25519", Nonce: []byte("nonce")}
+	if err := store.PutPayload(payload); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := store.GetPayload(connection.Id, sender.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.TimeCreated.Equal(now) || !bytes.Equal(stored.Data, payload.Data) || !stored.TimeFetched.IsZero() ||
+		stored.KeyId != "key" || stored.Algorithm != "x25519" || !bytes.Equal(stored.Nonce, payload.Nonce) {
+		t.Errorf("got payload %+v, want %+v", stored, payload)
+	}
+	stored.Fetched = true
+	stored.TimeFetched.Time = now
+	if err := store.UpdatePayload(stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ = store.GetPayload(connection.Id, sender.Id); !stored.Fetched || !stored.TimeFetched.Equal(now) {
+		t.Errorf("update was not stored: %+v", stored)
+	}
+
+	report := &Report{ReporterId: receiver.Id, ReportedId: sender.Id, Reason: "spam", PayloadData: []byte("photo"), TimeCreated: now}
+	if err := store.InsertReport(report); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ResolveReport(report.Id, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ResolveReport(report.Id+1, now); err != ErrNotFound {
+		t.Errorf("got %v for resolving a report which does not exist, want ErrNotFound", err)
+	}
+	resolved, err := store.GetReport(report.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resolved.TimeResolved.Equal(now) || resolved.PayloadData != nil {
+		t.Errorf("got report %+v after resolving", resolved)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := store.IncrementActivity(now, ActivityBeams); err != nil {
+			t.Fatal(err)
+		}
+	}
+	activity, err := store.ListActivity(now.AddDate(0, 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activity) != 1 || activity[0].Beams != 2 || activity[0].Day.Format("2006-01-02") != now.Format("2006-01-02") {
+		t.Errorf("got activity %+v", activity)
+	}
+
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Accounts != 2 || stats.ConnectionsLive != 1 || stats.PayloadsWaiting != 1 || stats.PayloadBytes != 5 {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	if err := store.DeleteAccount(sender.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetAccount(sender.Id); err != ErrNotFound {
+		t.Errorf("account still there: %v", err)
+	}
+	if payloads, _ := store.ListPayloads(connection.Id); len(payloads) != 0 {
+		t.Errorf("payloads of a deleted account were kept: %v", payloads)
+	}
+}
+
+/**
+ * Upgrade a database as the first release left it. Needs a Postgres database to wipe, e.g.
+ * PHOTOBEAM_TEST_POSTGRES=postgres://postgres@localhost:5432/photobeam_test?sslmode=disable
+ */
+func TestPostgresMigrateFromBaseline(t *testing.T) {
+	url := os.Getenv("PHOTOBEAM_TEST_POSTGRES")
+	if url == "" {
+		t.Skip("PHOTOBEAM_TEST_POSTGRES is not set")
+	}
+	options, err := pg.ParseURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := pg.Connect(options)
+	t.Cleanup(func() { db.Close() })
+
+	baseline := []string{
+		`DROP SCHEMA public CASCADE`,
+		`CREATE SCHEMA public`,
+		`CREATE TABLE accounts (id bigserial PRIMARY KEY, key text, apns_token text, connect_code text, time_created text)`,
+		`CREATE TABLE connections (id bigserial PRIMARY KEY, initiator_id bigint, invitee_id bigint, status text, time_created text)`,
+		`CREATE TABLE payloads (connection_id bigserial, from_id bigserial, time_created timestamptz, time_fetched timestamptz,
+			fetched boolean, data bytea, PRIMARY KEY (connection_id, from_id))`,
+		`INSERT INTO accounts (key, apns_token, connect_code, time_created) VALUES ('key-of-the-first-account', 'token', 'ABCD', '2020-01-01')`,
+		`INSERT INTO accounts (key, connect_code, time_created) VALUES ('key-of-the-second-account', 'EFGH', '2020-01-01')`,
+		`INSERT INTO connections (initiator_id, invitee_id, status, time_created) VALUES (1, 2, 'live', '2020-01-01')`,
+		`INSERT INTO payloads (connection_id, from_id, time_created, fetched, data) VALUES (1, 1, now(), false, 'photo')`,
+	}
+	for _, statement := range baseline {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := NewPgStore(db)
+	if err := store.CreateSchema(); err != nil {
+		t.Fatal(err)
+	}
+	// Migrating again does nothing.
+	if err := store.CreateSchema(); err != nil {
+		t.Fatal(err)
+	}
+	if current, latest, err := store.SchemaVersion(); err != nil || current != latest {
+		t.Errorf("got version %d of %d: %v", current, latest, err)
+	}
+
+	// Every column of the models is there.
+	models := []interface{}{&[]Account{}, &[]Avatar{}, &[]Device{}, &[]DevicePairing{}, &[]Connection{}, &[]Payload{},
+		&[]Block{}, &[]Report{}, &[]DailyActivity{}, &[]SchemaMigration{}}
+	for _, model := range models {
+		if err := db.Model(model).Limit(1).Select(); err != nil {
+			t.Errorf("%T: %v", model, err)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/query", nil)
+	request.Header.Set("Authorization", "key-of-the-first-account")
+	account, device, err := ReadAuth(store, request)
+	if err != nil || account.Id != 1 || device.PushToken != "token" {
+		t.Errorf("got %+v, %v, want the device with the key of the account", device, err)
+	}
+	payload, err := store.GetPayload(1, 1)
+	if err != nil || string(payload.Data) != "photo" || payload.GetKind() != PayloadKindPhoto {
+		t.Errorf("got %+v, %v, want the payload from before", payload, err)
+	}
+	reporter, err := store.GetAccount(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReportPeer(store, reporter, "spam"); err != nil {
+		t.Errorf("reporting failed: %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Until SetupTracing installs a provider, spans from this tracer are no-ops.
+var tracer = otel.Tracer("github.com/miracle2k/photobeam-server")
+
+/**
+ * Install the global tracer provider. The exporter is "none", "stdout" (pretty-printed to stderr,
+ * for looking at locally) or "otlp" (OTLP over HTTP, configured by the standard
+ * OTEL_EXPORTER_OTLP_* variables). The returned function flushes the remaining spans.
+ */
+func SetupTracing(ctx context.Context, exporterName string) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch exporterName {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr), stdouttrace.WithPrettyPrint())
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("invalid trace exporter %q", exporterName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES win over our defaults.
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "photobeam-server")),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+/**
+ * A span for every request, continuing the trace of the caller if it sent a traceparent header.
+ */
+func withTracing(router *Router, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := router.RouteLabel(r.URL.Path)
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("photobeam.request_id", RequestId(ctx)),
+			))
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(recorder, r.WithContext(ctx))
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+/**
+ * A span for every query. The statement is left out on purpose: it contains auth key hashes and
+ * whole photos.
+ */
+type queryTracingHook struct{}
+
+func (queryTracingHook) BeforeQuery(ctx context.Context, event *pg.QueryEvent) (context.Context, error) {
+	operation, table := describeQuery(event)
+	name := operation
+	if table != "" {
+		name += " " + table
+	}
+	ctx, _ = tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.operation", operation),
+			attribute.String("db.sql.table", table),
+		))
+	return ctx, nil
+}
+
+func (queryTracingHook) AfterQuery(ctx context.Context, event *pg.QueryEvent) error {
+	span := trace.SpanFromContext(ctx)
+	if event.Err != nil && event.Err != pg.ErrNoRows {
+		span.RecordError(event.Err)
+		span.SetStatus(codes.Error, event.Err.Error())
+	}
+	if event.Result != nil {
+		span.SetAttributes(attribute.Int("db.rows_affected", event.Result.RowsAffected()))
+	}
+	span.End()
+	return nil
+}
+
+// "SELECT", "devices" for a model query; just the first word for raw SQL.
+func describeQuery(event *pg.QueryEvent) (operation string, table string) {
+	switch query := event.Query.(type) {
+	case orm.QueryCommand:
+		operation = string(query.Operation())
+		if model := query.Query().TableModel(); model != nil {
+			table = string(model.Table().SQLName)
+		}
+	case string:
+		if fields := strings.Fields(query); len(fields) > 0 {
+			operation = strings.ToUpper(fields[0])
+		}
+	}
+	if operation == "" {
+		operation = "query"
+	}
+	return operation, table
+}
+
+/**
+ * Start a span for a piece of logic, and return the store to use inside it so the queries are its
+ * children. End the span with endSpan.
+ */
+func startSpan(store Store, name string, attributes ...attribute.KeyValue) (Store, trace.Span) {
+	ctx, span := tracer.Start(store.Context(), name, trace.WithAttributes(attributes...))
+	return store.WithContext(ctx), span
+}
+
+// Errors the client caused (see apiErrorsByCause) are recorded, but do not fail the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		if _, expected := apiErrorsByCause[err]; !expected {
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	span.End()
+}
@@ -1,24 +1,31 @@
 package main
 
 import (
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/go-pg/pg/v10"
-	"log"
-	"math/rand"
+	"math/big"
 	"net"
 	"net/http"
-	"time"
 )
 
-var seededRand *rand.Rand = rand.New(
-	rand.NewSource(time.Now().UnixNano()))
-
+/**
+ * A random string for codes which are secrets: connect codes, and pairing codes, which are as
+ * good as the credentials of a device. So it comes from crypto/rand.
+ */
 func StringWithCharset(length int, charset string) string {
 	b := make([]byte, length)
+	size := big.NewInt(int64(len(charset)))
 	for i := range b {
-		b[i] = charset[seededRand.Intn(len(charset))]
+		n, err := cryptorand.Int(cryptorand.Reader, size)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = charset[n.Int64()]
 	}
 	return string(b)
 }
@@ -28,6 +35,16 @@ func ConnectCode() string {
 	return StringWithCharset(4, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 }
 
+/**
+ * Write a successful JSON response. If this fails the client is gone, so there is nobody to tell.
+ */
+func WriteJSON(w http.ResponseWriter, r *http.Request, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		Logger(r.Context()).Warn("failed to write response", "error", err)
+	}
+}
+
 func GetFromReq(w http.ResponseWriter, r *http.Request, item interface{}) error {
 	if r.Body == nil {
 		return errors.New("No body")
@@ -35,27 +52,107 @@ func GetFromReq(w http.ResponseWriter, r *http.Request, item interface{}) error
 	return json.NewDecoder(http.MaxBytesReader(w, r.Body, 1048576)).Decode(item)
 }
 
-func ReadAuth(db *pg.DB, r *http.Request) (*Account, error) {
+/**
+ * Generate a new random auth key. The returned prefix and hash are what should be stored.
+ */
+func NewAuthKey() (key string, prefix string, hash string) {
+	b := make([]byte, 32)
+	if _, err := cryptorand.Read(b); err != nil {
+		panic(err)
+	}
+	key = hex.EncodeToString(b)
+	return key, AuthKeyPrefix(key), HashAuthKey(key)
+}
+
+// How many characters of an auth key we store in the clear to find the device.
+const authKeyPrefixLength = 8
+
+func AuthKeyPrefix(key string) string {
+	if len(key) < authKeyPrefixLength {
+		return key
+	}
+	return key[:authKeyPrefixLength]
+}
+
+/**
+ * The keys are long random strings, so a plain SHA-256 is enough here; there is nothing a slow
+ * password hash would protect against.
+ */
+func HashAuthKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+ * Give the device a fresh auth key. The old one stops working immediately.
+ */
+func RotateAuthKey(store Store, device *Device) error {
+	key, prefix, hash := NewAuthKey()
+	rotated := *device
+	rotated.KeyPrefix = prefix
+	rotated.KeyHash = hash
+	err := store.UpdateDevice(&rotated)
+	if err != nil {
+		return err
+	}
+	*device = rotated
+	device.Key = key
+	return nil
+}
+
+var ErrUnknownAuthKey = errors.New("Missing or unknown auth key")
+
+/**
+ * Find the device (and its account) for the key in the Authorization header.
+ */
+func ReadAuth(store Store, r *http.Request) (*Account, *Device, error) {
 	authKey := r.Header.Get("Authorization")
-	account := new(Account)
-	err := db.Model(account).
-		Where("key = ?", authKey).
-		Limit(1).
-		Select()
-	return account, err
+	if authKey == "" {
+		return nil, nil, ErrUnknownAuthKey
+	}
+
+	candidates, err := store.FindDevicesByKeyPrefix(AuthKeyPrefix(authKey))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hash := HashAuthKey(authKey)
+	for i := range candidates {
+		if subtle.ConstantTimeCompare([]byte(candidates[i].KeyHash), []byte(hash)) == 1 {
+			device := &candidates[i]
+			account, err := store.GetAccount(device.AccountId)
+			if err != nil {
+				return nil, nil, err
+			}
+			return account, device, nil
+		}
+	}
+	return nil, nil, ErrUnknownAuthKey
 }
 
-func ValidateAuth(db *pg.DB, r *http.Request, w http.ResponseWriter) (bool, *Account) {
-	actorAccount, err := ReadAuth(db, r)
+func ValidateAuth(store Store, r *http.Request, w http.ResponseWriter) (bool, *Account) {
+	canAccess, account, _ := ValidateDeviceAuth(store, r, w)
+	return canAccess, account
+}
+
+/**
+ * Like ValidateAuth, for handlers which also need to know which of the account's devices is calling.
+ */
+func ValidateDeviceAuth(store Store, r *http.Request, w http.ResponseWriter) (bool, *Account, *Device) {
+	actorAccount, actorDevice, err := ReadAuth(store, r)
+	if err == ErrUnknownAuthKey {
+		WriteError(w, r, APIErrUnauthorized)
+		return false, nil, nil
+	}
 	if err != nil {
 		if isBadConn(err, false) {
-			log.Println("bad connection!")
-			panic(err);
+			Logger(r.Context()).Warn("bad database connection", "error", err)
 		}
-		http.Error(w, fmt.Sprintf("auth not found: %s", err), http.StatusUnauthorized)
-		return false, nil
+		WriteInternalError(w, r, err, "ReadAuth")
+		return false, nil, nil
 	}
-	return true, actorAccount
+	SetRequestAccount(r.Context(), actorAccount.Id)
+	return true, actorAccount, actorDevice
 }
 
 /**